@@ -0,0 +1,244 @@
+-- 90_isucon_listen80_dump.sql が既存テーブルを作り直すため、
+-- 既存テーブルへのカラム追加や追加機能のテーブルはダンプ投入後に適用する
+use isucon_listen80
+
+ALTER TABLE `playlist`
+  ADD COLUMN `is_hidden` TINYINT(2) NOT NULL DEFAULT 0 AFTER `is_public`,
+  ADD COLUMN `is_locked` TINYINT(2) NOT NULL DEFAULT 0 AFTER `is_hidden`,
+  ADD COLUMN `moderation_reason` VARCHAR(191) NOT NULL DEFAULT '' AFTER `is_locked`;
+
+CREATE TABLE `report` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `target_type` VARCHAR(16) NOT NULL,
+  `target_id` VARCHAR(191) NOT NULL,
+  `reporter_account` VARCHAR(191) NOT NULL,
+  `category` VARCHAR(32) NOT NULL,
+  `comment` TEXT NOT NULL,
+  `resolution_id` BIGINT NOT NULL DEFAULT 0,
+  `created_at` TIMESTAMP(3) NOT NULL,
+  -- 未対応の通報だけ通報者を持つ 対応済みや退会した通報者の通報はNULLになり、一意制約の対象外になる
+  `open_reporter_account` VARCHAR(191) GENERATED ALWAYS AS (IF(`resolution_id` = 0 AND `reporter_account` <> '', `reporter_account`, NULL)) VIRTUAL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_open_report` (`target_type`, `target_id`, `open_reporter_account`),
+  KEY `idx_resolution_id_target` (`resolution_id`, `target_type`, `target_id`),
+  KEY `idx_reporter_account` (`reporter_account`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `report_resolution` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `target_type` VARCHAR(16) NOT NULL,
+  `target_id` VARCHAR(191) NOT NULL,
+  `action` VARCHAR(32) NOT NULL,
+  `note` VARCHAR(191) NOT NULL,
+  `admin_account` VARCHAR(191) NOT NULL,
+  `report_count` INT NOT NULL,
+  `created_at` TIMESTAMP(3) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_target` (`target_type`, `target_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE `song`
+  ADD COLUMN `duration` INT NOT NULL DEFAULT 0 AFTER `is_public`,
+  ADD COLUMN `genre` VARCHAR(64) NOT NULL DEFAULT '' AFTER `duration`,
+  ADD COLUMN `release_year` INT NOT NULL DEFAULT 0 AFTER `genre`,
+  ADD INDEX `idx_genre_release_year` (`genre`, `release_year`);
+
+CREATE TABLE `playlist_smart_rule` (
+  `playlist_id` BIGINT NOT NULL,
+  `rules` TEXT NOT NULL,
+  `created_at` TIMESTAMP(3) NOT NULL,
+  `updated_at` TIMESTAMP(3) NOT NULL,
+  PRIMARY KEY (`playlist_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE `playlist`
+  ADD COLUMN `is_unlisted` TINYINT(2) NOT NULL DEFAULT 0 AFTER `is_public`,
+  ADD COLUMN `share_token` VARCHAR(64) NOT NULL DEFAULT '' AFTER `is_unlisted`;
+
+ALTER TABLE `playlist`
+  ADD COLUMN `description` TEXT NOT NULL DEFAULT ('') AFTER `name`;
+
+CREATE TABLE `playlist_tag` (
+  `playlist_id` BIGINT NOT NULL,
+  `tag` VARCHAR(64) NOT NULL,
+  `sort_order` INT NOT NULL,
+  `created_at` TIMESTAMP(3) NOT NULL,
+  PRIMARY KEY (`playlist_id`, `tag`),
+  KEY `idx_tag_playlist_id` (`tag`, `playlist_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `playlist_comment` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `ulid` VARCHAR(191) NOT NULL,
+  `playlist_id` BIGINT NOT NULL,
+  `parent_id` BIGINT NOT NULL DEFAULT 0,
+  `user_account` VARCHAR(191) NOT NULL,
+  `body` TEXT NOT NULL,
+  `created_at` TIMESTAMP(3) NOT NULL,
+  `updated_at` TIMESTAMP(3) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_ulid` (`ulid`),
+  KEY `idx_playlist_id_parent_id_created_at` (`playlist_id`, `parent_id`, `created_at`),
+  KEY `idx_parent_id` (`parent_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `song_like` (
+  `song_id` BIGINT NOT NULL,
+  `user_account` VARCHAR(191) NOT NULL,
+  `created_at` TIMESTAMP(3) NOT NULL,
+  PRIMARY KEY (`user_account`, `song_id`),
+  KEY `idx_user_account_created_at` (`user_account`, `created_at`),
+  KEY `idx_song_id` (`song_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `play_event` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `user_account` VARCHAR(191) NOT NULL,
+  `song_id` BIGINT NOT NULL,
+  `playlist_id` BIGINT NOT NULL DEFAULT 0,
+  `played_at` TIMESTAMP(3) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_user_account_played_at` (`user_account`, `played_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `playlist_play_count` (
+  `playlist_id` BIGINT NOT NULL,
+  `play_count` BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`playlist_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- アーティストのランキングで、お気に入りを全て読まずに数える
+CREATE TABLE `playlist_favorite_count` (
+  `playlist_id` BIGINT NOT NULL,
+  `favorite_count` BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`playlist_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT INTO `playlist_favorite_count` (`playlist_id`, `favorite_count`)
+  SELECT `playlist_id`, COUNT(*) FROM `playlist_favorite` GROUP BY `playlist_id`;
+
+-- おすすめの計算で、曲やお気に入りしたユーザーから逆引きする
+ALTER TABLE `playlist_song`
+  ADD INDEX `idx_song_id` (`song_id`);
+
+ALTER TABLE `playlist_favorite`
+  ADD INDEX `idx_favorite_user_account` (`favorite_user_account`),
+  -- 1週間のランキングで、期間内のお気に入りだけを読む
+  ADD INDEX `idx_created_at` (`created_at`);
+
+-- プレイリスト名の部分一致検索 日本語も引けるようngramで分割する
+ALTER TABLE `playlist`
+  ADD FULLTEXT INDEX `ft_name` (`name`) WITH PARSER ngram;
+
+CREATE TABLE `webhook` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `ulid` VARCHAR(191) NOT NULL,
+  `user_account` VARCHAR(191) NOT NULL,
+  `url` TEXT NOT NULL,
+  `secret` VARCHAR(191) NOT NULL,
+  `events` VARCHAR(191) NOT NULL,
+  `created_at` TIMESTAMP(3) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_ulid` (`ulid`),
+  KEY `idx_user_account` (`user_account`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `webhook_delivery` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `ulid` VARCHAR(191) NOT NULL,
+  `webhook_id` BIGINT NOT NULL,
+  `event` VARCHAR(64) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `attempt_count` INT NOT NULL DEFAULT 0,
+  `next_attempt_at` TIMESTAMP(3) NOT NULL,
+  `last_status_code` INT NOT NULL DEFAULT 0,
+  `last_error` TEXT NOT NULL,
+  `created_at` TIMESTAMP(3) NOT NULL,
+  `updated_at` TIMESTAMP(3) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_status_next_attempt_at` (`status`, `next_attempt_at`),
+  KEY `idx_webhook_id_created_at` (`webhook_id`, `created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `access_token` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `ulid` VARCHAR(191) NOT NULL,
+  `user_account` VARCHAR(191) NOT NULL,
+  `name` VARCHAR(191) NOT NULL,
+  `token_hash` VARCHAR(64) NOT NULL,
+  `token_prefix` VARCHAR(16) NOT NULL,
+  `scopes` VARCHAR(191) NOT NULL,
+  `last_used_at` TIMESTAMP(3) NULL DEFAULT NULL,
+  `created_at` TIMESTAMP(3) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_ulid` (`ulid`),
+  UNIQUE KEY `uniq_token_hash` (`token_hash`),
+  KEY `idx_user_account` (`user_account`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- sessions_golang の中身は暗号化されていて検索できないので、誰のどの端末のセッションかを別に記録する
+CREATE TABLE `user_session` (
+  `session_id` BIGINT NOT NULL,
+  `ulid` VARCHAR(191) NOT NULL,
+  `user_account` VARCHAR(191) NOT NULL,
+  `user_agent` VARCHAR(191) NOT NULL,
+  `ip_address` VARCHAR(64) NOT NULL,
+  `created_at` TIMESTAMP(3) NOT NULL,
+  `last_seen_at` TIMESTAMP(3) NOT NULL,
+  PRIMARY KEY (`session_id`),
+  UNIQUE KEY `uniq_ulid` (`ulid`),
+  KEY `idx_user_account` (`user_account`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- 退会の申請 猶予期間が過ぎたら実行し、実行した記録として残す
+CREATE TABLE `account_deletion` (
+  `user_account` VARCHAR(191) NOT NULL,
+  `requested_at` TIMESTAMP(3) NOT NULL,
+  `scheduled_at` TIMESTAMP(3) NOT NULL,
+  `deleted_at` TIMESTAMP(3) NULL DEFAULT NULL,
+  PRIMARY KEY (`user_account`),
+  KEY `idx_deleted_at_scheduled_at` (`deleted_at`, `scheduled_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- 曲をプレイリストに追加した日時 初期データは追加日時が分からないので、プレイリストを作成した日時にしておく
+ALTER TABLE `playlist_song`
+  ADD COLUMN `created_at` TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3) AFTER `song_id`,
+  ADD INDEX `idx_created_at` (`created_at`);
+UPDATE `playlist_song` JOIN `playlist` ON `playlist`.`id` = `playlist_song`.`playlist_id`
+  SET `playlist_song`.`created_at` = `playlist`.`created_at`;
+
+-- 初期データの控え /initialize で、追加機能が書き換えたり消したりした初期データを元に戻すために使う
+-- ダンプ投入直後の内容を残すので、このファイルの最後に置く
+CREATE TABLE `seed_user` AS
+  SELECT `account`, `display_name`, `password_hash`, `is_ban` FROM `user`;
+ALTER TABLE `seed_user`
+  ADD PRIMARY KEY (`account`);
+
+CREATE TABLE `seed_artist` AS
+  SELECT `id`, `ulid`, `name` FROM `artist`;
+ALTER TABLE `seed_artist`
+  ADD PRIMARY KEY (`id`);
+
+CREATE TABLE `seed_song` AS
+  SELECT `id`, `ulid`, `title`, `artist_id`, `album`, `track_number`, `is_public`, `duration`, `genre`, `release_year` FROM `song`;
+ALTER TABLE `seed_song`
+  ADD PRIMARY KEY (`id`);
+
+CREATE TABLE `seed_playlist` AS
+  SELECT `id`, `ulid`, `name`, `user_account`, `is_public`, `created_at`, `updated_at` FROM `playlist`;
+ALTER TABLE `seed_playlist`
+  ADD PRIMARY KEY (`id`),
+  ADD KEY `idx_user_account` (`user_account`);
+
+CREATE TABLE `seed_playlist_song` AS
+  SELECT `playlist_id`, `sort_order`, `song_id`, `created_at` FROM `playlist_song`;
+ALTER TABLE `seed_playlist_song`
+  ADD PRIMARY KEY (`playlist_id`, `sort_order`);
+
+CREATE TABLE `seed_playlist_favorite` AS
+  SELECT `id`, `playlist_id`, `favorite_user_account`, `created_at` FROM `playlist_favorite`;
+ALTER TABLE `seed_playlist_favorite`
+  ADD PRIMARY KEY (`id`),
+  ADD KEY `idx_playlist_id` (`playlist_id`),
+  ADD KEY `idx_favorite_user_account` (`favorite_user_account`);
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// アカウント設定
+// 入力チェックはsignupと共通
+
+// POST /api/account/password
+
+func apiAccountPasswordHandler(c echo.Context) error {
+	// パスワードの変更はtokenではできない
+	user, sess, err := validateCookieSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateCookieSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	var req UpdatePasswordRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to UpdatePasswordRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	// validation
+	if req.CurrentPassword == "" {
+		return errorResponse(c, 400, "bad current_password")
+	}
+	if !isValidPassword(req.NewPassword) {
+		return errorResponse(c, 400, "bad new_password")
+	}
+	if req.NewPassword == req.CurrentPassword {
+		return errorResponse(c, 400, "new_password must be different from current_password")
+	}
+	// 乗っ取ったセッションで今のパスワードを総当たりされないよう、ログインと同じく失敗を数える
+	if wait := getLoginLockout(c, user.Account); 0 < wait {
+		setRetryAfter(c, wait)
+		return errorResponse(c, http.StatusTooManyRequests, "too many login attempts")
+	}
+	matched, err := comparePasswordHash(req.CurrentPassword, user.PasswordHash)
+	if err != nil {
+		c.Logger().Errorf("error comparePasswordHash: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !matched {
+		recordLoginFailure(c, user.Account)
+		return errorResponse(c, 403, "wrong current_password")
+	}
+	passwordHash, err := generatePasswordHash(req.NewPassword)
+	if err != nil {
+		c.Logger().Errorf("error generatePasswordHash: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	currentSessionID, _ := getSessionRowID(sess)
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Errorf("error conn.BeginTxx: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE user SET `password_hash` = ? WHERE `account` = ?",
+		passwordHash, user.Account,
+	); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Update user by password_hash, account=%s: %s", user.Account, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	// 今のセッション以外はログアウトさせる
+	if err := deleteUserSessionsWhere(ctx, tx, "user_account = ? AND session_id != ?", user.Account, currentSessionID); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error deleteUserSessionsWhere: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	// 漏れたパスワードで作られたtokenが残らないよう、個人用アクセストークンもすべて取り消す
+	if _, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM access_token WHERE `user_account` = ?",
+		user.Account,
+	); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Delete access_token by user_account=%s: %s", user.Account, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("error tx.Commit: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	recordLoginSuccess(user.Account)
+
+	body := BasicResponse{
+		Result: true,
+		Status: 200,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/account/profile
+
+func apiAccountProfileHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	var req UpdateProfileRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to UpdateProfileRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	// validation
+	if !isValidDisplayName(req.DisplayName) {
+		return errorResponse(c, 400, "bad display_name")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"UPDATE user SET `display_name` = ? WHERE `account` = ?",
+		req.DisplayName, user.Account,
+	); err != nil {
+		c.Logger().Errorf("error Update user by display_name=%s, account=%s: %s", req.DisplayName, user.Account, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := AccountProfileResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		UserAccount: user.Account,
+		DisplayName: req.DisplayName,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 個人データのエクスポートと退会
+// 退会は申請してから猶予期間が過ぎたら実行し、それまでは取り消せる
+// 実行するとユーザーの作ったものは全て消し、userの行は同じアカウント名で登録し直されないよう匿名化して残す
+
+const (
+	accountDeletionGracePeriod = 7 * 24 * time.Hour
+	// 猶予期間が過ぎた退会を実行する間隔
+	accountDeletionInterval = time.Minute
+	// 一度に実行する退会の数
+	accountDeletionBatchSize = 10
+)
+
+func getAccountDeletion(ctx context.Context, db connOrTx, userAccount string) (*AccountDeletionRow, error) {
+	var row AccountDeletionRow
+	if err := db.GetContext(
+		ctx,
+		&row,
+		"SELECT * FROM account_deletion WHERE `user_account` = ?",
+		userAccount,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error Get account_deletion by user_account=%s: %w", userAccount, err)
+	}
+	return &row, nil
+}
+
+func toAccountDeletionResponse(row *AccountDeletionRow) AccountDeletionResponse {
+	body := AccountDeletionResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+	}
+	if row != nil {
+		body.IsScheduled = true
+		body.RequestedAt = &row.RequestedAt
+		body.ScheduledAt = &row.ScheduledAt
+	}
+	return body
+}
+
+func buildAccountExport(ctx context.Context, db connOrTx, user *UserRow) (*AccountExport, error) {
+	export := &AccountExport{
+		ExportedAt: time.Now(),
+		Account: AccountExportUser{
+			UserAccount:   user.Account,
+			DisplayName:   user.DisplayName,
+			CreatedAt:     user.CreatedAt,
+			LastLoginedAt: user.LastLoginedAt,
+		},
+		Playlists: []AccountExportPlaylist{},
+		Favorites: []AccountExportFavorite{},
+	}
+
+	var playlists []PlaylistRow
+	if err := db.SelectContext(
+		ctx,
+		&playlists,
+		"SELECT * FROM playlist WHERE `user_account` = ? ORDER BY `created_at`, `id`",
+		user.Account,
+	); err != nil {
+		return nil, fmt.Errorf("error Select playlist by user_account=%s: %w", user.Account, err)
+	}
+	for i := range playlists {
+		playlist := &playlists[i]
+		songs, err := getPlaylistExportSongs(ctx, db, playlist)
+		if err != nil {
+			return nil, fmt.Errorf("error getPlaylistExportSongs: %w", err)
+		}
+		tags, err := getPlaylistTags(ctx, db, playlist.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error getPlaylistTags: %w", err)
+		}
+		export.Playlists = append(export.Playlists, AccountExportPlaylist{
+			ULID:        playlist.ULID,
+			Name:        playlist.Name,
+			Description: playlist.Description,
+			IsPublic:    playlist.IsPublic,
+			IsUnlisted:  playlist.IsUnlisted,
+			Tags:        tags,
+			Songs:       songs,
+			CreatedAt:   playlist.CreatedAt,
+			UpdatedAt:   playlist.UpdatedAt,
+		})
+	}
+
+	var favorites []PlaylistFavoriteRow
+	if err := db.SelectContext(
+		ctx,
+		&favorites,
+		"SELECT * FROM playlist_favorite WHERE `favorite_user_account` = ? ORDER BY `created_at`, `id`",
+		user.Account,
+	); err != nil {
+		return nil, fmt.Errorf("error Select playlist_favorite by favorite_user_account=%s: %w", user.Account, err)
+	}
+	for _, favorite := range favorites {
+		playlist, err := getPlaylistByID(ctx, db, favorite.PlaylistID)
+		if err != nil {
+			return nil, fmt.Errorf("error getPlaylistByID: %w", err)
+		}
+		if playlist == nil {
+			continue
+		}
+		entry := AccountExportFavorite{
+			PlaylistULID: playlist.ULID,
+			CreatedAt:    favorite.CreatedAt,
+		}
+		// 今は見れなくなったプレイリストの名前は含めない
+		if canViewPlaylist(playlist, user.Account, "") && (playlist.UserAccount == user.Account || !playlist.IsHidden) {
+			entry.PlaylistName = playlist.Name
+		}
+		export.Favorites = append(export.Favorites, entry)
+	}
+	return export, nil
+}
+
+// ユーザーの作ったものを全て消し、userを匿名化する
+// 消したプレイリストを返す
+func deleteUserAccount(ctx context.Context, db connOrTx, userAccount string) ([]PlaylistRow, error) {
+	var playlists []PlaylistRow
+	if err := db.SelectContext(
+		ctx,
+		&playlists,
+		"SELECT * FROM playlist WHERE `user_account` = ?",
+		userAccount,
+	); err != nil {
+		return nil, fmt.Errorf("error Select playlist by user_account=%s: %w", userAccount, err)
+	}
+
+	queries := []string{
+		// 作ったプレイリストとそれに付いたもの
+		"DELETE FROM playlist_song WHERE playlist_id IN (SELECT id FROM playlist WHERE user_account = ?)",
+		"DELETE FROM playlist_favorite WHERE playlist_id IN (SELECT id FROM playlist WHERE user_account = ?)",
+		"DELETE FROM playlist_smart_rule WHERE playlist_id IN (SELECT id FROM playlist WHERE user_account = ?)",
+		"DELETE FROM playlist_tag WHERE playlist_id IN (SELECT id FROM playlist WHERE user_account = ?)",
+		"DELETE FROM playlist_comment WHERE playlist_id IN (SELECT id FROM playlist WHERE user_account = ?)",
+		"DELETE FROM playlist_play_count WHERE playlist_id IN (SELECT id FROM playlist WHERE user_account = ?)",
+		"DELETE FROM playlist_favorite_count WHERE playlist_id IN (SELECT id FROM playlist WHERE user_account = ?)",
+		"DELETE FROM playlist WHERE user_account = ?",
+		// 他のプレイリストに付けたもの コメントはコメントの削除と同じく返信も消す
+		"UPDATE playlist_favorite_count JOIN playlist_favorite ON playlist_favorite.playlist_id = playlist_favorite_count.playlist_id" +
+			" SET playlist_favorite_count.favorite_count = playlist_favorite_count.favorite_count - 1 WHERE playlist_favorite.favorite_user_account = ?",
+		"DELETE FROM playlist_favorite WHERE favorite_user_account = ?",
+		"DELETE FROM playlist_comment WHERE parent_id IN (SELECT id FROM (SELECT id FROM playlist_comment WHERE user_account = ?) AS own_comment)",
+		"DELETE FROM playlist_comment WHERE user_account = ?",
+		"DELETE FROM song_like WHERE user_account = ?",
+		"DELETE FROM play_event WHERE user_account = ?",
+		"DELETE FROM webhook_delivery WHERE webhook_id IN (SELECT id FROM webhook WHERE user_account = ?)",
+		"DELETE FROM webhook WHERE user_account = ?",
+		"DELETE FROM access_token WHERE user_account = ?",
+		// 通報は管理の記録として残し、誰が通報したかだけ消す
+		"UPDATE report SET reporter_account = '' WHERE reporter_account = ?",
+	}
+	for _, query := range queries {
+		if _, err := db.ExecContext(ctx, query, userAccount); err != nil {
+			return nil, fmt.Errorf("error %s by user_account=%s: %w", query, userAccount, err)
+		}
+	}
+	if err := revokeUserSessions(ctx, db, userAccount); err != nil {
+		return nil, fmt.Errorf("error revokeUserSessions: %w", err)
+	}
+	// banしておけばログインできず、他のユーザーからも見えない
+	if _, err := db.ExecContext(
+		ctx,
+		"UPDATE user SET `display_name` = '', `password_hash` = '', `is_ban` = ? WHERE `account` = ?",
+		true, userAccount,
+	); err != nil {
+		return nil, fmt.Errorf("error Update user to anonymize account=%s: %w", userAccount, err)
+	}
+	if _, err := db.ExecContext(
+		ctx,
+		"UPDATE account_deletion SET `deleted_at` = ? WHERE `user_account` = ?",
+		time.Now(), userAccount,
+	); err != nil {
+		return nil, fmt.Errorf("error Update account_deletion by user_account=%s: %w", userAccount, err)
+	}
+	return playlists, nil
+}
+
+// 猶予期間が過ぎた退会をまとめて実行する 1件ずつトランザクションにする
+func processAccountDeletions(ctx context.Context) error {
+	var accounts []string
+	if err := db.SelectContext(
+		ctx,
+		&accounts,
+		"SELECT user_account FROM account_deletion WHERE deleted_at IS NULL AND scheduled_at <= ? ORDER BY scheduled_at LIMIT ?",
+		time.Now(), accountDeletionBatchSize,
+	); err != nil {
+		return fmt.Errorf("error Select account_deletion: %w", err)
+	}
+	for _, account := range accounts {
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("error db.BeginTxx: %w", err)
+		}
+		// 直前に取り消されていないか、ロックしてから確かめる
+		var count int
+		if err := tx.GetContext(
+			ctx,
+			&count,
+			"SELECT COUNT(*) FROM account_deletion WHERE user_account = ? AND deleted_at IS NULL AND scheduled_at <= ? FOR UPDATE",
+			account, time.Now(),
+		); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error Get count of account_deletion by user_account=%s: %w", account, err)
+		}
+		if count == 0 {
+			tx.Rollback()
+			continue
+		}
+		playlists, err := deleteUserAccount(ctx, tx, account)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error deleteUserAccount: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error tx.Commit: %w", err)
+		}
+		for i := range playlists {
+			if err := publishPlaylistDeleted(&playlists[i]); err != nil {
+				return fmt.Errorf("error publishPlaylistDeleted: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func runAccountDeletionWorker(logger echo.Logger) {
+	ticker := time.NewTicker(accountDeletionInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := processAccountDeletions(context.Background()); err != nil {
+			logger.Errorf("error processAccountDeletions: %s", err)
+		}
+	}
+}
+
+// GET /api/account/export
+
+func apiAccountExportHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	export, err := buildAccountExport(ctx, conn, user)
+	if err != nil {
+		c.Logger().Errorf("error buildAccountExport: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	body, err := json.Marshal(export)
+	if err != nil {
+		c.Logger().Errorf("error json.Marshal: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	c.Response().Header().Set(
+		echo.HeaderContentDisposition,
+		fmt.Sprintf(`attachment; filename="listen80-%s.json"`, user.Account),
+	)
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, body)
+}
+
+// GET /api/account/deletion
+
+func apiAccountDeletionHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	deletion, err := getAccountDeletion(ctx, conn, user.Account)
+	if err != nil {
+		c.Logger().Errorf("error getAccountDeletion: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if err := c.JSON(http.StatusOK, toAccountDeletionResponse(deletion)); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/account/delete
+
+func apiAccountDeleteHandler(c echo.Context) error {
+	// 退会はtokenではできない
+	user, _, err := validateCookieSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateCookieSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	var req DeleteAccountRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to DeleteAccountRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if req.Password == "" {
+		return errorResponse(c, 400, "bad password")
+	}
+	// パスワードの変更と同じく、失敗はログインの失敗として数える
+	if wait := getLoginLockout(c, user.Account); 0 < wait {
+		setRetryAfter(c, wait)
+		return errorResponse(c, http.StatusTooManyRequests, "too many login attempts")
+	}
+	matched, err := comparePasswordHash(req.Password, user.PasswordHash)
+	if err != nil {
+		c.Logger().Errorf("error comparePasswordHash: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !matched {
+		recordLoginFailure(c, user.Account)
+		return errorResponse(c, 403, "wrong password")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	// 既に申請していれば予定は変えない
+	now := time.Now()
+	if _, err := conn.ExecContext(
+		ctx,
+		"INSERT IGNORE INTO account_deletion (`user_account`, `requested_at`, `scheduled_at`) VALUES (?, ?, ?)",
+		user.Account, now, now.Add(accountDeletionGracePeriod),
+	); err != nil {
+		c.Logger().Errorf("error Insert account_deletion by user_account=%s: %s", user.Account, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	deletion, err := getAccountDeletion(ctx, conn, user.Account)
+	if err != nil {
+		c.Logger().Errorf("error getAccountDeletion: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if err := c.JSON(http.StatusOK, toAccountDeletionResponse(deletion)); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/account/delete/cancel
+
+func apiAccountDeleteCancelHandler(c echo.Context) error {
+	user, _, err := validateCookieSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateCookieSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	// 実行済みの退会はログインできないのでここには来ない
+	res, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM account_deletion WHERE `user_account` = ? AND `deleted_at` IS NULL",
+		user.Account,
+	)
+	if err != nil {
+		c.Logger().Errorf("error Delete account_deletion by user_account=%s: %s", user.Account, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	canceledCount, err := res.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("error RowsAffected: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if canceledCount == 0 {
+		return errorResponse(c, 404, "deletion not scheduled")
+	}
+
+	if err := c.JSON(http.StatusOK, toAccountDeletionResponse(nil)); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
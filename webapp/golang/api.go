@@ -1,25 +1,101 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // API essential types
 
 type Playlist struct {
-	ULID            string    `json:"ulid"`
-	Name            string    `json:"name"`
-	UserDisplayName string    `json:"user_display_name"`
-	UserAccount     string    `json:"user_account"`
-	SongCount       int       `json:"song_count"`
-	FavoriteCount   int       `json:"favorite_count"`
-	IsFavorited     bool      `json:"is_favorited"`
-	IsPublic        bool      `json:"is_public"`
+	ULID            string              `json:"ulid"`
+	Name            string              `json:"name"`
+	UserDisplayName string              `json:"user_display_name"`
+	UserAccount     string              `json:"user_account"`
+	SongCount       int                 `json:"song_count"`
+	Duration        int                 `json:"duration"`
+	FavoriteCount   int                 `json:"favorite_count"`
+	IsFavorited     bool                `json:"is_favorited"`
+	IsPublic        bool                `json:"is_public"`
+	IsUnlisted      bool                `json:"is_unlisted"`
+	ShareToken      string              `json:"share_token,omitempty"`
+	Tags            []string            `json:"tags"`
+	CommentCount    int                 `json:"comment_count"`
+	CreatedAt       time.Time           `json:"created_at"`
+	UpdatedAt       time.Time           `json:"updated_at"`
+	Moderation      *PlaylistModeration `json:"moderation,omitempty"`
+}
+
+// 管理者による措置の状態 作成者にのみ返す
+type PlaylistModeration struct {
+	IsHidden bool   `json:"is_hidden"`
+	IsLocked bool   `json:"is_locked"`
+	Reason   string `json:"reason"`
+}
+
+type Report struct {
+	ID              int       `json:"id"`
+	ReporterAccount string    `json:"reporter_account"`
+	Category        string    `json:"category"`
+	Comment         string    `json:"comment"`
 	CreatedAt       time.Time `json:"created_at"`
-	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// 通報対象ごとにまとめた未対応の通報
+type ReportTarget struct {
+	TargetType      string         `json:"target_type"`
+	TargetID        string         `json:"target_id"`
+	TargetName      string         `json:"target_name"`
+	ReportCount     int            `json:"report_count"`
+	Categories      map[string]int `json:"categories"`
+	FirstReportedAt time.Time      `json:"first_reported_at"`
+	LastReportedAt  time.Time      `json:"last_reported_at"`
+	Reports         []Report       `json:"reports"`
+}
+
+type ReportResolution struct {
+	ID           int       `json:"id"`
+	TargetType   string    `json:"target_type"`
+	TargetID     string    `json:"target_id"`
+	Action       string    `json:"action"`
+	Note         string    `json:"note"`
+	AdminAccount string    `json:"admin_account"`
+	ReportCount  int       `json:"report_count"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// SSEで配るイベント
+type PlaylistLiveEvent struct {
+	PlaylistULID string `json:"playlist_ulid"`
+}
+
+type PlaylistFavoriteCountEvent struct {
+	PlaylistULID  string `json:"playlist_ulid"`
+	FavoriteCount int    `json:"favorite_count"`
 }
 
 type PlaylistDetail struct {
 	*Playlist
-	Songs []Song `json:"songs"`
+	Songs         []Song              `json:"songs"`
+	TotalDuration int                 `json:"total_duration"`
+	SmartRules    *SmartPlaylistRules `json:"smart_rules,omitempty"`
+	// サニタイズ済みのHTML
+	Description string `json:"description"`
+	PlayCount   int    `json:"play_count"`
+}
+
+// スマートプレイリストの条件 conditions は全てANDで評価する
+type SmartPlaylistRules struct {
+	Conditions []SmartPlaylistCondition `json:"conditions"`
+	Sort       string                   `json:"sort"`
+	Order      string                   `json:"order"`
+	Limit      int                      `json:"limit"`
+}
+
+type SmartPlaylistCondition struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
 }
 
 type Song struct {
@@ -29,6 +105,169 @@ type Song struct {
 	Album       string `json:"album"`
 	TrackNumber int    `json:"track_number"`
 	IsPublic    bool   `json:"is_public"`
+	Duration    int    `json:"duration"`
+	Genre       string `json:"genre"`
+	ReleaseYear int    `json:"release_year"`
+}
+
+// format=json でエクスポートするプレイリスト
+type PlaylistExport struct {
+	ULID            string `json:"ulid"`
+	Name            string `json:"name"`
+	UserDisplayName string `json:"user_display_name"`
+	Songs           []Song `json:"songs"`
+}
+
+// 個人データのエクスポート
+type AccountExport struct {
+	ExportedAt time.Time               `json:"exported_at"`
+	Account    AccountExportUser       `json:"account"`
+	Playlists  []AccountExportPlaylist `json:"playlists"`
+	Favorites  []AccountExportFavorite `json:"favorites"`
+}
+
+type AccountExportUser struct {
+	UserAccount   string    `json:"user_account"`
+	DisplayName   string    `json:"display_name"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastLoginedAt time.Time `json:"last_logined_at"`
+}
+
+type AccountExportPlaylist struct {
+	ULID        string    `json:"ulid"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	IsPublic    bool      `json:"is_public"`
+	IsUnlisted  bool      `json:"is_unlisted"`
+	Tags        []string  `json:"tags"`
+	Songs       []Song    `json:"songs"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type AccountExportFavorite struct {
+	PlaylistULID string    `json:"playlist_ulid"`
+	PlaylistName string    `json:"playlist_name,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type Comment struct {
+	ULID            string    `json:"ulid"`
+	UserAccount     string    `json:"user_account"`
+	UserDisplayName string    `json:"user_display_name"`
+	Body            string    `json:"body"`
+	IsEdited        bool      `json:"is_edited"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	// スレッドの先頭のコメントにのみ入る
+	Replies []Comment `json:"replies,omitempty"`
+}
+
+type PlayHistory struct {
+	Song Song `json:"song"`
+	// プレイリストから再生した場合のみ入る
+	PlaylistULID string    `json:"playlist_ulid,omitempty"`
+	PlayedAt     time.Time `json:"played_at"`
+}
+
+type RecommendedPlaylist struct {
+	Playlist
+	// 重なっている曲の数、または両方をお気に入りしているユーザーの数
+	Score int `json:"score"`
+}
+
+type SongChartEntry struct {
+	Rank int `json:"rank"`
+	// 入っているプレイリストの数
+	Score int  `json:"score"`
+	Song  Song `json:"song"`
+}
+
+type ArtistChartEntry struct {
+	Rank int `json:"rank"`
+	// 曲が入っているプレイリストへのお気に入りの数
+	Score  int    `json:"score"`
+	Artist Artist `json:"artist"`
+}
+
+type TagSuggestion struct {
+	Tag           string `json:"tag" db:"tag"`
+	PlaylistCount int    `json:"playlist_count" db:"playlist_count"`
+}
+
+type SongDetail struct {
+	Song
+	LikeCount int  `json:"like_count"`
+	IsLiked   bool `json:"is_liked"`
+}
+
+type Artist struct {
+	ULID string `json:"ulid"`
+	Name string `json:"name"`
+}
+
+// secret は作成したときのみ返す
+type Webhook struct {
+	ULID      string    `json:"ulid"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ULID           string          `json:"ulid"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	AttemptCount   int             `json:"attempt_count"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	LastStatusCode int             `json:"last_status_code"`
+	LastError      string          `json:"last_error"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+type UserSession struct {
+	ULID       string    `json:"ulid"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	IsCurrent  bool      `json:"is_current"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// token は作成したときのみ返す
+type AccessToken struct {
+	ULID        string     `json:"ulid"`
+	Name        string     `json:"name"`
+	Token       string     `json:"token,omitempty"`
+	TokenPrefix string     `json:"token_prefix"`
+	Scopes      []string   `json:"scopes"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// webhookで送るリクエストボディ
+type WebhookEventBody struct {
+	DeliveryULID string      `json:"delivery_ulid"`
+	Event        string      `json:"event"`
+	CreatedAt    time.Time   `json:"created_at"`
+	Data         interface{} `json:"data"`
+}
+
+type WebhookPlaylistData struct {
+	PlaylistULID string    `json:"playlist_ulid"`
+	Name         string    `json:"name"`
+	IsPublic     bool      `json:"is_public"`
+	IsUnlisted   bool      `json:"is_unlisted"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type WebhookFavoriteData struct {
+	WebhookPlaylistData
+	FavoriteUserAccount string `json:"favorite_user_account"`
+	FavoriteCount       int    `json:"favorite_count"`
 }
 
 // API request types
@@ -44,14 +283,66 @@ type LoginRequest struct {
 	Password    string `json:"password"`
 }
 
+type UpdatePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type UpdateProfileRequest struct {
+	DisplayName string `json:"display_name"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
 type AddPlaylistRequest struct {
-	Name string `json:"name"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
 }
 
 type UpdatePlaylistRequest struct {
 	Name      *string  `json:"name"`
 	SongULIDs []string `json:"song_ulids,omitempty"`
 	IsPublic  bool     `json:"is_public"`
+	// 一覧に出さず、share_tokenを知っている人だけに見せる 指定されなければ変更しない
+	IsUnlisted *bool `json:"is_unlisted"`
+	// 指定されなければ変更しない
+	Description *string  `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+type SmartPlaylistRequest struct {
+	Rules *SmartPlaylistRules `json:"rules"`
+}
+
+type ImportPlaylistRequest struct {
+	Format  string `json:"format"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+type AddCommentRequest struct {
+	Body string `json:"body"`
+	// 返信の場合のみ指定する
+	ParentULID string `json:"parent_ulid"`
+}
+
+type UpdateCommentRequest struct {
+	Body string `json:"body"`
+}
+
+type LikeSongRequest struct {
+	IsLiked bool `json:"is_liked"`
+}
+
+type PlayRequest struct {
+	SongULID string `json:"song_ulid"`
+	// プレイリストから再生した場合のみ指定する
+	PlaylistULID string `json:"playlist_ulid"`
+	// 限定公開のプレイリストから再生した場合に指定する
+	ShareToken string `json:"share_token"`
 }
 
 type FavoritePlaylistRequest struct {
@@ -63,6 +354,78 @@ type AdminPlayerBanRequest struct {
 	IsBan       bool   `json:"is_ban"`
 }
 
+type AdminPlaylistModerateRequest struct {
+	PlaylistULID string `json:"playlist_ulid"`
+	Action       string `json:"action"`
+	Reason       string `json:"reason"`
+}
+
+type AdminLoginLockoutsClearRequest struct {
+	UserAccount string `json:"user_account"`
+	IPAddress   string `json:"ip_address"`
+}
+
+type ReportRequest struct {
+	TargetType string `json:"target_type"`
+	TargetID   string `json:"target_id"`
+	Category   string `json:"category"`
+	Comment    string `json:"comment"`
+}
+
+type AdminReportsResolveRequest struct {
+	TargetType string `json:"target_type"`
+	TargetID   string `json:"target_id"`
+	Action     string `json:"action"`
+	Note       string `json:"note"`
+}
+
+type AdminSongVisibilityRequest struct {
+	SongULID string `json:"song_ulid"`
+	IsPublic bool   `json:"is_public"`
+}
+
+type AdminArtistRequest struct {
+	Name string `json:"name"`
+}
+
+type AdminArtistMergeRequest struct {
+	SourceArtistULID string `json:"source_artist_ulid"`
+	TargetArtistULID string `json:"target_artist_ulid"`
+}
+
+type AdminSongAddRequest struct {
+	Title       string `json:"title"`
+	ArtistULID  string `json:"artist_ulid"`
+	Album       string `json:"album"`
+	TrackNumber int    `json:"track_number"`
+	IsPublic    bool   `json:"is_public"`
+	Duration    int    `json:"duration"`
+	Genre       string `json:"genre"`
+	ReleaseYear int    `json:"release_year"`
+}
+
+// 指定されたものだけ更新する
+type AdminSongUpdateRequest struct {
+	Title       *string `json:"title"`
+	ArtistULID  *string `json:"artist_ulid"`
+	Album       *string `json:"album"`
+	TrackNumber *int    `json:"track_number"`
+	IsPublic    *bool   `json:"is_public"`
+	Duration    *int    `json:"duration"`
+	Genre       *string `json:"genre"`
+	ReleaseYear *int    `json:"release_year"`
+}
+
+type AddWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type AddAccessTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
 // API response types
 
 type BasicResponse struct {
@@ -87,6 +450,20 @@ type AddPlaylistResponse struct {
 	PlaylistULID string `json:"playlist_ulid"`
 }
 
+// インポートできなかった曲
+type UnmatchedImportEntry struct {
+	Line   int    `json:"line"`
+	Text   string `json:"text"`
+	Reason string `json:"reason"`
+}
+
+type ImportPlaylistResponse struct {
+	BasicResponse
+	PlaylistULID     string                 `json:"playlist_ulid"`
+	MatchedSongCount int                    `json:"matched_song_count"`
+	Unmatched        []UnmatchedImportEntry `json:"unmatched"`
+}
+
 type SinglePlaylistResponse struct {
 	BasicResponse
 	Playlist PlaylistDetail `json:"playlist"`
@@ -99,3 +476,169 @@ type AdminPlayerBanResponse struct {
 	IsBan       bool      `json:"is_ban"`
 	CreatedAt   time.Time `json:"created_at"`
 }
+
+type AccountProfileResponse struct {
+	BasicResponse
+	UserAccount string `json:"user_account"`
+	DisplayName string `json:"display_name"`
+}
+
+type AccountDeletionResponse struct {
+	BasicResponse
+	IsScheduled bool       `json:"is_scheduled"`
+	RequestedAt *time.Time `json:"requested_at"`
+	ScheduledAt *time.Time `json:"scheduled_at"`
+}
+
+type AdminLoginLockoutsClearResponse struct {
+	BasicResponse
+	Cleared int `json:"cleared"`
+}
+
+type AdminPlaylistModerateResponse struct {
+	BasicResponse
+	PlaylistULID string             `json:"playlist_ulid"`
+	IsPublic     bool               `json:"is_public"`
+	Moderation   PlaylistModeration `json:"moderation"`
+}
+
+type ReportResponse struct {
+	BasicResponse
+	ReportID int `json:"report_id"`
+}
+
+type AdminReportsResponse struct {
+	BasicResponse
+	Targets []ReportTarget `json:"targets"`
+}
+
+type AdminReportsResolveResponse struct {
+	BasicResponse
+	Resolution ReportResolution `json:"resolution"`
+}
+
+type AdminReportsHistoryResponse struct {
+	BasicResponse
+	Resolutions []ReportResolution `json:"resolutions"`
+}
+
+type AdminSongVisibilityResponse struct {
+	BasicResponse
+	Song                  Song `json:"song"`
+	AffectedPlaylistCount int  `json:"affected_playlist_count"`
+}
+
+type AdminArtistResponse struct {
+	BasicResponse
+	Artist Artist `json:"artist"`
+}
+
+type AdminArtistMergeResponse struct {
+	BasicResponse
+	Artist         Artist `json:"artist"`
+	MovedSongCount int    `json:"moved_song_count"`
+}
+
+type AdminSongResponse struct {
+	BasicResponse
+	Song       Song   `json:"song"`
+	ArtistULID string `json:"artist_ulid"`
+}
+
+type GetSongsResponse struct {
+	BasicResponse
+	Songs []Song `json:"songs"`
+}
+
+type GetTagPlaylistsResponse struct {
+	BasicResponse
+	Tag       string     `json:"tag"`
+	Playlists []Playlist `json:"playlists"`
+}
+
+type GetTagsResponse struct {
+	BasicResponse
+	Tags []TagSuggestion `json:"tags"`
+}
+
+type GetCommentsResponse struct {
+	BasicResponse
+	Comments     []Comment `json:"comments"`
+	CommentCount int       `json:"comment_count"`
+	Page         int       `json:"page"`
+	HasNext      bool      `json:"has_next"`
+}
+
+type CommentResponse struct {
+	BasicResponse
+	Comment Comment `json:"comment"`
+}
+
+type SingleSongResponse struct {
+	BasicResponse
+	Song SongDetail `json:"song"`
+}
+
+type GetHistoryResponse struct {
+	BasicResponse
+	Histories []PlayHistory `json:"histories"`
+}
+
+type GetRecommendedPlaylistsResponse struct {
+	BasicResponse
+	Playlists []RecommendedPlaylist `json:"playlists"`
+}
+
+type GetSongChartResponse struct {
+	BasicResponse
+	Period    string           `json:"period"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	Songs     []SongChartEntry `json:"songs"`
+}
+
+type GetArtistChartResponse struct {
+	BasicResponse
+	Period    string             `json:"period"`
+	UpdatedAt time.Time          `json:"updated_at"`
+	Artists   []ArtistChartEntry `json:"artists"`
+}
+
+type SearchPlaylistsResponse struct {
+	BasicResponse
+	Query     string     `json:"q"`
+	Playlists []Playlist `json:"playlists"`
+	Page      int        `json:"page"`
+	HasNext   bool       `json:"has_next"`
+}
+
+type GetWebhooksResponse struct {
+	BasicResponse
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type WebhookResponse struct {
+	BasicResponse
+	Webhook Webhook `json:"webhook"`
+}
+
+type GetWebhookDeliveriesResponse struct {
+	BasicResponse
+	Deliveries []WebhookDelivery `json:"deliveries"`
+	Page       int               `json:"page"`
+	HasNext    bool              `json:"has_next"`
+}
+
+type GetAccessTokensResponse struct {
+	BasicResponse
+	Tokens []AccessToken `json:"tokens"`
+}
+
+type AccessTokenResponse struct {
+	BasicResponse
+	Token AccessToken `json:"token"`
+}
+
+type GetSessionsResponse struct {
+	BasicResponse
+	Sessions []UserSession `json:"sessions"`
+}
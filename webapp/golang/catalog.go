@@ -0,0 +1,794 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+// 楽曲カタログの管理
+
+func toSong(song *SongRow, artist *ArtistRow) Song {
+	return Song{
+		ULID:        song.ULID,
+		Title:       song.Title,
+		Artist:      artist.Name,
+		Album:       song.Album,
+		TrackNumber: song.TrackNumber,
+		IsPublic:    song.IsPublic,
+		Duration:    song.Duration,
+		Genre:       song.Genre,
+		ReleaseYear: song.ReleaseYear,
+	}
+}
+
+func getArtistByULID(ctx context.Context, db connOrTx, artistULID string) (*ArtistRow, error) {
+	var row ArtistRow
+	if err := db.GetContext(ctx, &row, "SELECT * FROM artist WHERE `ulid` = ?", artistULID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error Get artist by ulid=%s: %w", artistULID, err)
+	}
+	return &row, nil
+}
+
+func getArtistByID(ctx context.Context, db connOrTx, artistID int) (*ArtistRow, error) {
+	var row ArtistRow
+	if err := db.GetContext(ctx, &row, "SELECT * FROM artist WHERE `id` = ?", artistID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error Get artist by id=%d: %w", artistID, err)
+	}
+	return &row, nil
+}
+
+func getPlaylistsCountBySongID(ctx context.Context, db connOrTx, songID int) (int, error) {
+	var count int
+	if err := db.GetContext(
+		ctx,
+		&count,
+		"SELECT COUNT(DISTINCT playlist_id) AS cnt FROM playlist_song WHERE song_id = ?",
+		songID,
+	); err != nil {
+		return 0, fmt.Errorf("error Get count of playlist_song by song_id=%d: %w", songID, err)
+	}
+	return count, nil
+}
+
+// POST /api/admin/song/visibility
+
+func apiAdminSongVisibilityHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	// 管理者userであることを確認,でなければ403
+	if !isAdminUser(user.Account) {
+		return errorResponse(c, 403, "not admin user")
+	}
+
+	var req AdminSongVisibilityRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AdminSongVisibilityRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if req.SongULID == "" {
+		return errorResponse(c, 400, "bad song ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", req.SongULID); matched {
+		return errorResponse(c, 400, "bad song ulid")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	song, err := getSongByULID(ctx, conn, req.SongULID)
+	if err != nil {
+		c.Logger().Errorf("error getSongByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if song == nil {
+		return errorResponse(c, 400, "song not found")
+	}
+
+	// プレイリスト詳細は都度songを参照するので、更新すれば全てのプレイリストに反映される
+	if _, err := conn.ExecContext(
+		ctx,
+		"UPDATE song SET `is_public` = ? WHERE `id` = ?",
+		req.IsPublic, song.ID,
+	); err != nil {
+		c.Logger().Errorf("error Update song by is_public=%t, id=%d: %s", req.IsPublic, song.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	song.IsPublic = req.IsPublic
+
+	artist, err := getArtistByID(ctx, conn, song.ArtistID)
+	if err != nil {
+		c.Logger().Errorf("error getArtistByID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if artist == nil {
+		return errorResponse(c, 500, "artist not found")
+	}
+	affectedPlaylistCount, err := getPlaylistsCountBySongID(ctx, conn, song.ID)
+	if err != nil {
+		c.Logger().Errorf("error getPlaylistsCountBySongID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := AdminSongVisibilityResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Song:                  toSong(song, artist),
+		AffectedPlaylistCount: affectedPlaylistCount,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// GET /api/songs
+
+func apiSongsHandler(c echo.Context) error {
+	// ログインは不要 公開中の曲のみ返す
+	conditions := []string{"song.is_public = ?"}
+	args := []interface{}{true}
+	if genre := c.QueryParam("genre"); genre != "" {
+		conditions = append(conditions, "song.genre = ?")
+		args = append(args, genre)
+	}
+	for _, p := range []struct {
+		name string
+		cond string
+	}{
+		{"release_year_from", "song.release_year >= ?"},
+		{"release_year_to", "song.release_year <= ?"},
+	} {
+		v := c.QueryParam(p.name)
+		if v == "" {
+			continue
+		}
+		year, err := strconv.Atoi(v)
+		if err != nil {
+			return errorResponse(c, 400, "invalid "+p.name)
+		}
+		conditions = append(conditions, p.cond)
+		args = append(args, year)
+	}
+	limit, offset := 100, 0
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || 100 < n {
+			return errorResponse(c, 400, "invalid limit")
+		}
+		limit = n
+	}
+	if v := c.QueryParam("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errorResponse(c, 400, "invalid offset")
+		}
+		offset = n
+	}
+	args = append(args, limit, offset)
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	var rows []SongWithArtistRow
+	if err := conn.SelectContext(
+		ctx,
+		&rows,
+		"SELECT song.*, artist.name AS artist_name FROM song JOIN artist ON artist.id = song.artist_id WHERE "+
+			strings.Join(conditions, " AND ")+" ORDER BY song.id LIMIT ? OFFSET ?",
+		args...,
+	); err != nil {
+		c.Logger().Errorf("error Select song: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	songs := make([]Song, 0, len(rows))
+	for _, row := range rows {
+		songs = append(songs, toSong(&row.SongRow, &ArtistRow{Name: row.ArtistName}))
+	}
+
+	body := GetSongsResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Songs: songs,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+func validateArtistName(name string) error {
+	if name == "" || 191 < utf8.RuneCountInString(name) {
+		return errors.New("invalid name")
+	}
+	return nil
+}
+
+func validateSongTitle(title string) error {
+	if title == "" || 191 < utf8.RuneCountInString(title) {
+		return errors.New("invalid title")
+	}
+	return nil
+}
+
+func validateSongAlbum(album string) error {
+	if 191 < utf8.RuneCountInString(album) {
+		return errors.New("invalid album")
+	}
+	return nil
+}
+
+func validateSongTrackNumber(trackNumber int) error {
+	if trackNumber < 0 {
+		return errors.New("invalid track_number")
+	}
+	return nil
+}
+
+// 再生時間は秒
+func validateSongDuration(duration int) error {
+	if duration < 0 {
+		return errors.New("invalid duration")
+	}
+	return nil
+}
+
+func validateSongGenre(genre string) error {
+	if 64 < utf8.RuneCountInString(genre) {
+		return errors.New("invalid genre")
+	}
+	return nil
+}
+
+// 0は不明
+func validateSongReleaseYear(releaseYear int) error {
+	if releaseYear != 0 && (releaseYear < 1000 || 9999 < releaseYear) {
+		return errors.New("invalid release_year")
+	}
+	return nil
+}
+
+func insertArtist(ctx context.Context, db connOrTx, name string, createdAt time.Time) (*ArtistRow, error) {
+	artistULID, err := ulid.New(ulid.Timestamp(createdAt), entropy)
+	if err != nil {
+		return nil, fmt.Errorf("error ulid.New: %w", err)
+	}
+	res, err := db.ExecContext(
+		ctx,
+		"INSERT INTO artist (`ulid`, `name`) VALUES (?, ?)",
+		artistULID.String(), name,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error Insert artist by ulid=%s, name=%s: %w", artistULID, name, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("error LastInsertId: %w", err)
+	}
+	return &ArtistRow{
+		ID:   int(id),
+		ULID: artistULID.String(),
+		Name: name,
+	}, nil
+}
+
+// song.ULID が空なら採番する
+func insertSong(ctx context.Context, db connOrTx, song *SongRow, createdAt time.Time) error {
+	if song.ULID == "" {
+		songULID, err := ulid.New(ulid.Timestamp(createdAt), entropy)
+		if err != nil {
+			return fmt.Errorf("error ulid.New: %w", err)
+		}
+		song.ULID = songULID.String()
+	}
+	res, err := db.ExecContext(
+		ctx,
+		"INSERT INTO song (`ulid`, `title`, `artist_id`, `album`, `track_number`, `is_public`, `duration`, `genre`, `release_year`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		song.ULID, song.Title, song.ArtistID, song.Album, song.TrackNumber, song.IsPublic, song.Duration, song.Genre, song.ReleaseYear,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"error Insert song by ulid=%s, title=%s, artist_id=%d, album=%s, track_number=%d, is_public=%t, duration=%d, genre=%s, release_year=%d: %w",
+			song.ULID, song.Title, song.ArtistID, song.Album, song.TrackNumber, song.IsPublic, song.Duration, song.Genre, song.ReleaseYear, err,
+		)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error LastInsertId: %w", err)
+	}
+	song.ID = int(id)
+	return nil
+}
+
+func updateSong(ctx context.Context, db connOrTx, song *SongRow) error {
+	if _, err := db.ExecContext(
+		ctx,
+		"UPDATE song SET `title` = ?, `artist_id` = ?, `album` = ?, `track_number` = ?, `is_public` = ?, `duration` = ?, `genre` = ?, `release_year` = ? WHERE `id` = ?",
+		song.Title, song.ArtistID, song.Album, song.TrackNumber, song.IsPublic, song.Duration, song.Genre, song.ReleaseYear, song.ID,
+	); err != nil {
+		return fmt.Errorf(
+			"error Update song by title=%s, artist_id=%d, album=%s, track_number=%d, is_public=%t, duration=%d, genre=%s, release_year=%d, id=%d: %w",
+			song.Title, song.ArtistID, song.Album, song.TrackNumber, song.IsPublic, song.Duration, song.Genre, song.ReleaseYear, song.ID, err,
+		)
+	}
+	return nil
+}
+
+func adminSongResponse(c echo.Context, song *SongRow, artist *ArtistRow) error {
+	body := AdminSongResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Song:       toSong(song, artist),
+		ArtistULID: artist.ULID,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	return nil
+}
+
+// POST /api/admin/artist/add
+
+func apiAdminArtistAddHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	// 管理者userであることを確認,でなければ403
+	if !isAdminUser(user.Account) {
+		return errorResponse(c, 403, "not admin user")
+	}
+
+	var req AdminArtistRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AdminArtistRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if err := validateArtistName(req.Name); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	artist, err := insertArtist(ctx, conn, req.Name, time.Now())
+	if err != nil {
+		c.Logger().Errorf("error insertArtist: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := AdminArtistResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Artist: Artist{
+			ULID: artist.ULID,
+			Name: artist.Name,
+		},
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/admin/artist/:artistUlid/update
+
+func apiAdminArtistUpdateHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	// 管理者userであることを確認,でなければ403
+	if !isAdminUser(user.Account) {
+		return errorResponse(c, 403, "not admin user")
+	}
+
+	artistULID := c.Param("artistUlid")
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", artistULID); matched {
+		return errorResponse(c, 404, "bad artist ulid")
+	}
+	var req AdminArtistRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AdminArtistRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if err := validateArtistName(req.Name); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	artist, err := getArtistByULID(ctx, conn, artistULID)
+	if err != nil {
+		c.Logger().Errorf("error getArtistByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if artist == nil {
+		return errorResponse(c, 404, "artist not found")
+	}
+	if _, err := conn.ExecContext(
+		ctx,
+		"UPDATE artist SET `name` = ? WHERE `id` = ?",
+		req.Name, artist.ID,
+	); err != nil {
+		c.Logger().Errorf("error Update artist by name=%s, id=%d: %s", req.Name, artist.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := AdminArtistResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Artist: Artist{
+			ULID: artist.ULID,
+			Name: req.Name,
+		},
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/admin/artist/merge
+
+func apiAdminArtistMergeHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	// 管理者userであることを確認,でなければ403
+	if !isAdminUser(user.Account) {
+		return errorResponse(c, 403, "not admin user")
+	}
+
+	var req AdminArtistMergeRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AdminArtistMergeRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if req.SourceArtistULID == "" || req.TargetArtistULID == "" {
+		return errorResponse(c, 400, "source_artist_ulid and target_artist_ulid are required")
+	}
+	if req.SourceArtistULID == req.TargetArtistULID {
+		return errorResponse(c, 400, "can not merge the same artist")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Errorf("error conn.BeginTxx: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	source, err := getArtistByULID(ctx, tx, req.SourceArtistULID)
+	if err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error getArtistByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	target, err := getArtistByULID(ctx, tx, req.TargetArtistULID)
+	if err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error getArtistByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if source == nil || target == nil {
+		tx.Rollback()
+		return errorResponse(c, 400, "artist not found")
+	}
+
+	// playlist_song は song のIDを参照しているので、曲の付け替えだけでプレイリストはそのまま使える
+	res, err := tx.ExecContext(
+		ctx,
+		"UPDATE song SET `artist_id` = ? WHERE `artist_id` = ?",
+		target.ID, source.ID,
+	)
+	if err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Update song by artist_id=%d, artist_id=%d: %s", target.ID, source.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	movedSongCount, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error RowsAffected: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM artist WHERE `id` = ?",
+		source.ID,
+	); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Delete artist by id=%d: %s", source.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("error tx.Commit: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := AdminArtistMergeResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Artist: Artist{
+			ULID: target.ULID,
+			Name: target.Name,
+		},
+		MovedSongCount: int(movedSongCount),
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/admin/song/add
+
+func apiAdminSongAddHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	// 管理者userであることを確認,でなければ403
+	if !isAdminUser(user.Account) {
+		return errorResponse(c, 403, "not admin user")
+	}
+
+	var req AdminSongAddRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AdminSongAddRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	// validation
+	if err := validateSongTitle(req.Title); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+	if err := validateSongAlbum(req.Album); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+	if err := validateSongTrackNumber(req.TrackNumber); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+	if err := validateSongDuration(req.Duration); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+	if err := validateSongGenre(req.Genre); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+	if err := validateSongReleaseYear(req.ReleaseYear); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+	if req.ArtistULID == "" {
+		return errorResponse(c, 400, "artist_ulid is required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	artist, err := getArtistByULID(ctx, conn, req.ArtistULID)
+	if err != nil {
+		c.Logger().Errorf("error getArtistByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if artist == nil {
+		return errorResponse(c, 400, "artist not found")
+	}
+
+	song := SongRow{
+		Title:       req.Title,
+		ArtistID:    artist.ID,
+		Album:       req.Album,
+		TrackNumber: req.TrackNumber,
+		IsPublic:    req.IsPublic,
+		Duration:    req.Duration,
+		Genre:       req.Genre,
+		ReleaseYear: req.ReleaseYear,
+	}
+	if err := insertSong(ctx, conn, &song, time.Now()); err != nil {
+		c.Logger().Errorf("error insertSong: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return adminSongResponse(c, &song, artist)
+}
+
+// POST /api/admin/song/:songUlid/update
+
+func apiAdminSongUpdateHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	// 管理者userであることを確認,でなければ403
+	if !isAdminUser(user.Account) {
+		return errorResponse(c, 403, "not admin user")
+	}
+
+	songULID := c.Param("songUlid")
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", songULID); matched {
+		return errorResponse(c, 404, "bad song ulid")
+	}
+	var req AdminSongUpdateRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AdminSongUpdateRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	song, err := getSongByULID(ctx, conn, songULID)
+	if err != nil {
+		c.Logger().Errorf("error getSongByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if song == nil {
+		return errorResponse(c, 404, "song not found")
+	}
+
+	// 指定された項目だけ上書きする
+	if req.Title != nil {
+		if err := validateSongTitle(*req.Title); err != nil {
+			return errorResponse(c, 400, err.Error())
+		}
+		song.Title = *req.Title
+	}
+	if req.Album != nil {
+		if err := validateSongAlbum(*req.Album); err != nil {
+			return errorResponse(c, 400, err.Error())
+		}
+		song.Album = *req.Album
+	}
+	if req.TrackNumber != nil {
+		if err := validateSongTrackNumber(*req.TrackNumber); err != nil {
+			return errorResponse(c, 400, err.Error())
+		}
+		song.TrackNumber = *req.TrackNumber
+	}
+	if req.IsPublic != nil {
+		song.IsPublic = *req.IsPublic
+	}
+	if req.Duration != nil {
+		if err := validateSongDuration(*req.Duration); err != nil {
+			return errorResponse(c, 400, err.Error())
+		}
+		song.Duration = *req.Duration
+	}
+	if req.Genre != nil {
+		if err := validateSongGenre(*req.Genre); err != nil {
+			return errorResponse(c, 400, err.Error())
+		}
+		song.Genre = *req.Genre
+	}
+	if req.ReleaseYear != nil {
+		if err := validateSongReleaseYear(*req.ReleaseYear); err != nil {
+			return errorResponse(c, 400, err.Error())
+		}
+		song.ReleaseYear = *req.ReleaseYear
+	}
+	var artist *ArtistRow
+	if req.ArtistULID != nil {
+		artist, err = getArtistByULID(ctx, conn, *req.ArtistULID)
+	} else {
+		artist, err = getArtistByID(ctx, conn, song.ArtistID)
+	}
+	if err != nil {
+		c.Logger().Errorf("error get artist: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if artist == nil {
+		return errorResponse(c, 400, "artist not found")
+	}
+	song.ArtistID = artist.ID
+
+	if err := updateSong(ctx, conn, song); err != nil {
+		c.Logger().Errorf("error updateSong: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return adminSongResponse(c, song, artist)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 曲とアーティストのランキング
+// リクエストごとには集計せず、バックグラウンドで定期的に集計した結果を返す
+// 公開中で非表示でないプレイリスト、banされていないユーザーのみを対象にする
+
+const (
+	chartPeriodAll  = "all"
+	chartPeriodWeek = "week"
+
+	// 集計し直す間隔
+	chartRefreshInterval = time.Minute
+	// 各ランキングの件数
+	chartLimit = 100
+)
+
+var chartPeriods = []string{chartPeriodAll, chartPeriodWeek}
+
+// 曲: 何個のプレイリストに入っているか
+// week はプレイリストに追加された日時が1週間以内のもののみ数える
+const songChartQuery = "SELECT playlist_song.song_id AS id, COUNT(DISTINCT playlist_song.playlist_id) AS score FROM playlist_song" +
+	" JOIN playlist ON playlist.id = playlist_song.playlist_id" +
+	" JOIN user ON user.account = playlist.user_account" +
+	" JOIN song ON song.id = playlist_song.song_id" +
+	" WHERE playlist.is_public = ? AND playlist.is_hidden = ? AND user.is_ban = ? AND song.is_public = ?" +
+	" AND playlist_song.created_at >= ?" +
+	" GROUP BY playlist_song.song_id ORDER BY score DESC, playlist_song.song_id LIMIT ?"
+
+// アーティスト: 曲が入っているプレイリストへのお気に入りの数 banされたユーザーのお気に入りは数えない
+// all はお気に入りを全て読まないよう、プレイリストごとの数(playlist_favorite_count)からbanされたユーザーの分を引いて数える
+const artistChartQuery = "SELECT playlist_artist.artist_id AS id," +
+	" CAST(SUM(playlist_favorite_count.favorite_count - COALESCE(banned_favorite.cnt, 0)) AS SIGNED) AS score" +
+	" FROM (SELECT DISTINCT playlist_song.playlist_id, song.artist_id FROM playlist_song" +
+	" JOIN song ON song.id = playlist_song.song_id WHERE song.is_public = ?) AS playlist_artist" +
+	" JOIN playlist_favorite_count ON playlist_favorite_count.playlist_id = playlist_artist.playlist_id" +
+	" JOIN playlist ON playlist.id = playlist_artist.playlist_id" +
+	" JOIN user ON user.account = playlist.user_account" +
+	" LEFT JOIN (SELECT playlist_favorite.playlist_id, COUNT(*) AS cnt FROM user AS favorite_user" +
+	" JOIN playlist_favorite ON playlist_favorite.favorite_user_account = favorite_user.account" +
+	" WHERE favorite_user.is_ban = ? GROUP BY playlist_favorite.playlist_id) AS banned_favorite" +
+	" ON banned_favorite.playlist_id = playlist_artist.playlist_id" +
+	" WHERE playlist.is_public = ? AND playlist.is_hidden = ? AND user.is_ban = ?" +
+	" GROUP BY playlist_artist.artist_id HAVING 0 < score ORDER BY score DESC, playlist_artist.artist_id LIMIT ?"
+
+// week はお気に入りされた日時が1週間以内のものだけを created_at のindexで読んで数える
+const artistWeekChartQuery = "SELECT song.artist_id AS id, COUNT(DISTINCT playlist_favorite.id) AS score FROM playlist_favorite" +
+	" JOIN user AS favorite_user ON favorite_user.account = playlist_favorite.favorite_user_account" +
+	" JOIN playlist ON playlist.id = playlist_favorite.playlist_id" +
+	" JOIN user ON user.account = playlist.user_account" +
+	" JOIN playlist_song ON playlist_song.playlist_id = playlist.id" +
+	" JOIN song ON song.id = playlist_song.song_id" +
+	" WHERE playlist.is_public = ? AND playlist.is_hidden = ? AND user.is_ban = ? AND song.is_public = ?" +
+	" AND favorite_user.is_ban = ? AND playlist_favorite.created_at >= ?" +
+	" GROUP BY song.artist_id ORDER BY score DESC, song.artist_id LIMIT ?"
+
+type chartScore struct {
+	ID    int `db:"id"`
+	Score int `db:"score"`
+}
+
+type chartStore struct {
+	mu        sync.RWMutex
+	songs     map[string][]SongChartEntry
+	artists   map[string][]ArtistChartEntry
+	updatedAt time.Time
+	// 集計が同時に走らないようにする
+	refreshMu sync.Mutex
+}
+
+var charts = &chartStore{}
+
+func chartPeriodSince(period string, now time.Time) time.Time {
+	if period == chartPeriodWeek {
+		return now.Add(-7 * 24 * time.Hour)
+	}
+	return time.Unix(0, 0)
+}
+
+func aggregateSongChart(ctx context.Context, db connOrTx, since time.Time) ([]SongChartEntry, error) {
+	var scores []chartScore
+	if err := db.SelectContext(ctx, &scores, songChartQuery, true, false, false, true, since, chartLimit); err != nil {
+		return nil, fmt.Errorf("error Select song chart since=%s: %w", since, err)
+	}
+	entries := make([]SongChartEntry, 0, len(scores))
+	for i, score := range scores {
+		song, err := getSongWithArtistByID(ctx, db, score.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error getSongWithArtistByID: %w", err)
+		}
+		entries = append(entries, SongChartEntry{
+			Rank:  i + 1,
+			Score: score.Score,
+			Song:  toSong(&song.SongRow, &ArtistRow{Name: song.ArtistName}),
+		})
+	}
+	return entries, nil
+}
+
+func aggregateArtistChart(ctx context.Context, db connOrTx, period string, since time.Time) ([]ArtistChartEntry, error) {
+	var scores []chartScore
+	if period == chartPeriodAll {
+		if err := db.SelectContext(ctx, &scores, artistChartQuery, true, true, true, false, false, chartLimit); err != nil {
+			return nil, fmt.Errorf("error Select artist chart: %w", err)
+		}
+	} else {
+		if err := db.SelectContext(ctx, &scores, artistWeekChartQuery, true, false, false, true, false, since, chartLimit); err != nil {
+			return nil, fmt.Errorf("error Select artist chart since=%s: %w", since, err)
+		}
+	}
+	entries := make([]ArtistChartEntry, 0, len(scores))
+	for i, score := range scores {
+		artist, err := getArtistByID(ctx, db, score.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error getArtistByID: %w", err)
+		}
+		if artist == nil {
+			continue
+		}
+		entries = append(entries, ArtistChartEntry{
+			Rank:   i + 1,
+			Score:  score.Score,
+			Artist: Artist{ULID: artist.ULID, Name: artist.Name},
+		})
+	}
+	return entries, nil
+}
+
+// 全てのランキングを集計し直して差し替える
+func (s *chartStore) refresh(ctx context.Context) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	return s.refreshLocked(ctx)
+}
+
+func (s *chartStore) refreshLocked(ctx context.Context) error {
+	now := time.Now()
+	songs := make(map[string][]SongChartEntry, len(chartPeriods))
+	artists := make(map[string][]ArtistChartEntry, len(chartPeriods))
+	for _, period := range chartPeriods {
+		since := chartPeriodSince(period, now)
+		songEntries, err := aggregateSongChart(ctx, db, since)
+		if err != nil {
+			return fmt.Errorf("error aggregateSongChart: %w", err)
+		}
+		artistEntries, err := aggregateArtistChart(ctx, db, period, since)
+		if err != nil {
+			return fmt.Errorf("error aggregateArtistChart: %w", err)
+		}
+		songs[period] = songEntries
+		artists[period] = artistEntries
+	}
+
+	s.mu.Lock()
+	s.songs = songs
+	s.artists = artists
+	s.updatedAt = now
+	s.mu.Unlock()
+	return nil
+}
+
+// まだ一度も集計していなければその場で集計する
+func (s *chartStore) ensure(ctx context.Context) error {
+	s.mu.RLock()
+	ready := !s.updatedAt.IsZero()
+	s.mu.RUnlock()
+	if ready {
+		return nil
+	}
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	// 待っている間に他で集計が終わっていれば何もしない
+	s.mu.RLock()
+	ready = !s.updatedAt.IsZero()
+	s.mu.RUnlock()
+	if ready {
+		return nil
+	}
+	return s.refreshLocked(ctx)
+}
+
+func (s *chartStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.songs = nil
+	s.artists = nil
+	s.updatedAt = time.Time{}
+}
+
+// main から goroutine で起動する
+func runChartAggregator(logger echo.Logger) {
+	if err := charts.refresh(context.Background()); err != nil {
+		logger.Errorf("error charts.refresh: %s", err)
+	}
+	ticker := time.NewTicker(chartRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := charts.refresh(context.Background()); err != nil {
+			logger.Errorf("error charts.refresh: %s", err)
+		}
+	}
+}
+
+func getChartPeriodFromParam(c echo.Context) (string, bool) {
+	period := c.QueryParam("period")
+	if period == "" {
+		return chartPeriodAll, true
+	}
+	for _, p := range chartPeriods {
+		if p == period {
+			return period, true
+		}
+	}
+	return "", false
+}
+
+// GET /api/charts/songs
+
+func apiSongChartHandler(c echo.Context) error {
+	// ログインは不要
+	period, ok := getChartPeriodFromParam(c)
+	if !ok {
+		return errorResponse(c, 400, "invalid period")
+	}
+	if err := charts.ensure(c.Request().Context()); err != nil {
+		c.Logger().Errorf("error charts.ensure: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	charts.mu.RLock()
+	entries := charts.songs[period]
+	updatedAt := charts.updatedAt
+	charts.mu.RUnlock()
+	if entries == nil {
+		entries = []SongChartEntry{}
+	}
+
+	body := GetSongChartResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Period:    period,
+		UpdatedAt: updatedAt,
+		Songs:     entries,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// GET /api/charts/artists
+
+func apiArtistChartHandler(c echo.Context) error {
+	// ログインは不要
+	period, ok := getChartPeriodFromParam(c)
+	if !ok {
+		return errorResponse(c, 400, "invalid period")
+	}
+	if err := charts.ensure(c.Request().Context()); err != nil {
+		c.Logger().Errorf("error charts.ensure: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	charts.mu.RLock()
+	entries := charts.artists[period]
+	updatedAt := charts.updatedAt
+	charts.mu.RUnlock()
+	if entries == nil {
+		entries = []ArtistChartEntry{}
+	}
+
+	body := GetArtistChartResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Period:    period,
+		UpdatedAt: updatedAt,
+		Artists:   entries,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
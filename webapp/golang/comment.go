@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+// 公開中のプレイリストへのコメント
+// 返信は1段階まで 返信への返信は同じスレッドの末尾に付ける
+
+const (
+	// コメントの最大文字数
+	maxCommentLength = 1000
+	// 1ページに返すスレッド数
+	commentsPerPage = 20
+	// 投稿後に編集できる期間
+	commentEditableDuration = 15 * time.Minute
+)
+
+func getCommentByULID(ctx context.Context, db connOrTx, commentULID string) (*PlaylistCommentRow, error) {
+	var row PlaylistCommentRow
+	if err := db.GetContext(ctx, &row, "SELECT * FROM playlist_comment WHERE `ulid` = ?", commentULID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error Get playlist_comment by ulid=%s: %w", commentULID, err)
+	}
+	return &row, nil
+}
+
+// banされたユーザーのコメントと、その返信は数えない
+func getCommentsCountByPlaylistID(ctx context.Context, db connOrTx, playlistID int) (int, error) {
+	var count int
+	if err := db.GetContext(
+		ctx,
+		&count,
+		"SELECT COUNT(*) FROM playlist_comment"+
+			" JOIN user ON user.account = playlist_comment.user_account"+
+			" LEFT JOIN playlist_comment AS root ON root.id = playlist_comment.parent_id"+
+			" LEFT JOIN user AS root_user ON root_user.account = root.user_account"+
+			" WHERE playlist_comment.playlist_id = ? AND user.is_ban = ?"+
+			" AND (playlist_comment.parent_id = 0 OR root_user.is_ban = ?)",
+		playlistID, false, false,
+	); err != nil {
+		return 0, fmt.Errorf("error Get count of playlist_comment by playlist_id=%d: %w", playlistID, err)
+	}
+	return count, nil
+}
+
+// 一覧用に複数のプレイリストのコメント数をまとめて数える コメントのないプレイリストはmapに含まない
+func getCommentsCountsByPlaylistIDs(ctx context.Context, db connOrTx, playlistIDs []int) (map[int]int, error) {
+	result := make(map[int]int, len(playlistIDs))
+	if len(playlistIDs) == 0 {
+		return result, nil
+	}
+	query, args, err := sqlx.In(
+		"SELECT playlist_comment.playlist_id AS playlist_id, COUNT(*) AS cnt FROM playlist_comment"+
+			" JOIN user ON user.account = playlist_comment.user_account"+
+			" LEFT JOIN playlist_comment AS root ON root.id = playlist_comment.parent_id"+
+			" LEFT JOIN user AS root_user ON root_user.account = root.user_account"+
+			" WHERE playlist_comment.playlist_id IN (?) AND user.is_ban = ?"+
+			" AND (playlist_comment.parent_id = 0 OR root_user.is_ban = ?)"+
+			" GROUP BY playlist_comment.playlist_id",
+		playlistIDs, false, false,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error sqlx.In: %w", err)
+	}
+	var rows []struct {
+		PlaylistID int `db:"playlist_id"`
+		Count      int `db:"cnt"`
+	}
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, fmt.Errorf("error Select count of playlist_comment by playlist_ids: %w", err)
+	}
+	for _, row := range rows {
+		result[row.PlaylistID] = row.Count
+	}
+	return result, nil
+}
+
+// コメントできる、コメントを見れるプレイリストか
+// 公開中で、管理者によって非表示にされておらず、作成者がbanされていないもの
+func isCommentablePlaylist(ctx context.Context, db connOrTx, playlist *PlaylistRow) (bool, error) {
+	if !playlist.IsPublic || playlist.IsHidden {
+		return false, nil
+	}
+	owner, err := getUserByAccount(ctx, db, playlist.UserAccount)
+	if err != nil {
+		return false, fmt.Errorf("error getUserByAccount: %w", err)
+	}
+	return owner != nil && !owner.IsBan, nil
+}
+
+func validateCommentBody(body string) error {
+	if strings.TrimSpace(body) == "" || maxCommentLength < utf8.RuneCountInString(body) {
+		return fmt.Errorf("invalid body")
+	}
+	return nil
+}
+
+func toComment(row *PlaylistCommentWithUserRow) Comment {
+	return Comment{
+		ULID:            row.ULID,
+		UserAccount:     row.UserAccount,
+		UserDisplayName: row.UserDisplayName,
+		Body:            row.Body,
+		IsEdited:        row.UpdatedAt.After(row.CreatedAt),
+		CreatedAt:       row.CreatedAt,
+		UpdatedAt:       row.UpdatedAt,
+	}
+}
+
+func getCommentWithUserByID(ctx context.Context, db connOrTx, commentID int) (*PlaylistCommentWithUserRow, error) {
+	var row PlaylistCommentWithUserRow
+	if err := db.GetContext(
+		ctx,
+		&row,
+		"SELECT playlist_comment.*, user.display_name AS user_display_name FROM playlist_comment"+
+			" JOIN user ON user.account = playlist_comment.user_account WHERE playlist_comment.id = ?",
+		commentID,
+	); err != nil {
+		return nil, fmt.Errorf("error Get playlist_comment by id=%d: %w", commentID, err)
+	}
+	return &row, nil
+}
+
+// 新しいスレッド順に、スレッド内の返信は古い順に返す
+func getCommentThreads(ctx context.Context, db connOrTx, playlistID int, page int) ([]Comment, bool, error) {
+	var roots []PlaylistCommentWithUserRow
+	if err := db.SelectContext(
+		ctx,
+		&roots,
+		"SELECT playlist_comment.*, user.display_name AS user_display_name FROM playlist_comment"+
+			" JOIN user ON user.account = playlist_comment.user_account"+
+			" WHERE playlist_comment.playlist_id = ? AND playlist_comment.parent_id = 0 AND user.is_ban = ?"+
+			" ORDER BY playlist_comment.created_at DESC, playlist_comment.id DESC LIMIT ? OFFSET ?",
+		playlistID, false, commentsPerPage+1, (page-1)*commentsPerPage,
+	); err != nil {
+		return nil, false, fmt.Errorf("error Select playlist_comment by playlist_id=%d: %w", playlistID, err)
+	}
+	hasNext := len(roots) > commentsPerPage
+	if hasNext {
+		roots = roots[:commentsPerPage]
+	}
+
+	comments := make([]Comment, 0, len(roots))
+	for _, root := range roots {
+		var replies []PlaylistCommentWithUserRow
+		if err := db.SelectContext(
+			ctx,
+			&replies,
+			"SELECT playlist_comment.*, user.display_name AS user_display_name FROM playlist_comment"+
+				" JOIN user ON user.account = playlist_comment.user_account"+
+				" WHERE playlist_comment.parent_id = ? AND user.is_ban = ?"+
+				" ORDER BY playlist_comment.created_at, playlist_comment.id",
+			root.ID, false,
+		); err != nil {
+			return nil, false, fmt.Errorf("error Select playlist_comment by parent_id=%d: %w", root.ID, err)
+		}
+		comment := toComment(&root)
+		comment.Replies = make([]Comment, 0, len(replies))
+		for _, reply := range replies {
+			comment.Replies = append(comment.Replies, toComment(&reply))
+		}
+		comments = append(comments, comment)
+	}
+	return comments, hasNext, nil
+}
+
+// URLで指定されたコメントを取得する
+// nilを返した場合はエラーレスポンスを書き込み済みなので、errorをそのままハンドラから返す
+func getCommentFromParam(c echo.Context, conn connOrTx) (*PlaylistCommentRow, error) {
+	commentULID := c.Param("commentUlid")
+	if commentULID == "" {
+		return nil, errorResponse(c, 404, "bad comment ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", commentULID); matched {
+		return nil, errorResponse(c, 404, "bad comment ulid")
+	}
+	comment, err := getCommentByULID(c.Request().Context(), conn, commentULID)
+	if err != nil {
+		c.Logger().Errorf("error getCommentByULID: %s", err)
+		return nil, errorResponse(c, 500, "internal server error")
+	}
+	if comment == nil {
+		return nil, errorResponse(c, 404, "comment not found")
+	}
+	return comment, nil
+}
+
+func commentResponse(c echo.Context, conn connOrTx, commentID int) error {
+	row, err := getCommentWithUserByID(c.Request().Context(), conn, commentID)
+	if err != nil {
+		c.Logger().Errorf("error getCommentWithUserByID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := CommentResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Comment: toComment(row),
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	return nil
+}
+
+// GET /api/playlist/:playlistUlid/comments
+
+func apiPlaylistCommentsHandler(c echo.Context) error {
+	// ログインは不要
+	playlistULID := c.Param("playlistUlid")
+	if playlistULID == "" {
+		return errorResponse(c, 400, "bad playlist ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", playlistULID); matched {
+		return errorResponse(c, 400, "bad playlist ulid")
+	}
+	page, ok := getPageFromParam(c)
+	if !ok {
+		return errorResponse(c, 400, "invalid page")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	playlist, err := getPlaylistByULID(ctx, conn, playlistULID)
+	if err != nil {
+		c.Logger().Errorf("error getPlaylistByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if playlist == nil {
+		return errorResponse(c, 404, "playlist not found")
+	}
+	commentable, err := isCommentablePlaylist(ctx, conn, playlist)
+	if err != nil {
+		c.Logger().Errorf("error isCommentablePlaylist: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !commentable {
+		return errorResponse(c, 404, "playlist not found")
+	}
+
+	comments, hasNext, err := getCommentThreads(ctx, conn, playlist.ID, page)
+	if err != nil {
+		c.Logger().Errorf("error getCommentThreads: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	commentCount, err := getCommentsCountByPlaylistID(ctx, conn, playlist.ID)
+	if err != nil {
+		c.Logger().Errorf("error getCommentsCountByPlaylistID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := GetCommentsResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Comments:     comments,
+		CommentCount: commentCount,
+		Page:         page,
+		HasNext:      hasNext,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/playlist/:playlistUlid/comment
+
+func apiPlaylistCommentAddHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	playlistULID := c.Param("playlistUlid")
+	if playlistULID == "" {
+		return errorResponse(c, 404, "bad playlist ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", playlistULID); matched {
+		return errorResponse(c, 404, "bad playlist ulid")
+	}
+	var req AddCommentRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AddCommentRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if err := validateCommentBody(req.Body); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	playlist, err := getPlaylistByULID(ctx, conn, playlistULID)
+	if err != nil {
+		c.Logger().Errorf("error getPlaylistByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if playlist == nil {
+		return errorResponse(c, 404, "playlist not found")
+	}
+	commentable, err := isCommentablePlaylist(ctx, conn, playlist)
+	if err != nil {
+		c.Logger().Errorf("error isCommentablePlaylist: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !commentable {
+		return errorResponse(c, 404, "playlist not found")
+	}
+
+	parentID := 0
+	if req.ParentULID != "" {
+		parent, err := getCommentByULID(ctx, conn, req.ParentULID)
+		if err != nil {
+			c.Logger().Errorf("error getCommentByULID: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		if parent == nil || parent.PlaylistID != playlist.ID {
+			return errorResponse(c, 400, "parent comment not found")
+		}
+		// 返信への返信は同じスレッドに付ける
+		parentID = parent.ID
+		if parent.ParentID != 0 {
+			parentID = parent.ParentID
+		}
+	}
+
+	createdTimestamp := time.Now()
+	commentULID, err := ulid.New(ulid.Timestamp(createdTimestamp), entropy)
+	if err != nil {
+		c.Logger().Errorf("error ulid.New: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	res, err := conn.ExecContext(
+		ctx,
+		"INSERT INTO playlist_comment (`ulid`, `playlist_id`, `parent_id`, `user_account`, `body`, `created_at`, `updated_at`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		commentULID.String(), playlist.ID, parentID, user.Account, req.Body, createdTimestamp, createdTimestamp,
+	)
+	if err != nil {
+		c.Logger().Errorf(
+			"error Insert playlist_comment by ulid=%s, playlist_id=%d, parent_id=%d, user_account=%s: %s",
+			commentULID, playlist.ID, parentID, user.Account, err,
+		)
+		return errorResponse(c, 500, "internal server error")
+	}
+	commentID, err := res.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("error LastInsertId: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return commentResponse(c, conn, int(commentID))
+}
+
+// POST /api/comment/:commentUlid/update
+
+func apiCommentUpdateHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	var req UpdateCommentRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to UpdateCommentRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if err := validateCommentBody(req.Body); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	comment, err := getCommentFromParam(c, conn)
+	if comment == nil {
+		return err
+	}
+	// 編集できるのは投稿者のみ
+	if comment.UserAccount != user.Account {
+		return errorResponse(c, 403, "not comment author")
+	}
+	updatedTimestamp := time.Now()
+	if updatedTimestamp.Sub(comment.CreatedAt) > commentEditableDuration {
+		return errorResponse(c, 403, "comment is no longer editable")
+	}
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"UPDATE playlist_comment SET `body` = ?, `updated_at` = ? WHERE `id` = ?",
+		req.Body, updatedTimestamp, comment.ID,
+	); err != nil {
+		c.Logger().Errorf("error Update playlist_comment by id=%d: %s", comment.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return commentResponse(c, conn, comment.ID)
+}
+
+// POST /api/comment/:commentUlid/delete
+
+func apiCommentDeleteHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	comment, err := getCommentFromParam(c, conn)
+	if comment == nil {
+		return err
+	}
+	// 削除できるのは投稿者とプレイリストの作成者
+	if comment.UserAccount != user.Account {
+		playlist, err := getPlaylistByID(ctx, conn, comment.PlaylistID)
+		if err != nil {
+			c.Logger().Errorf("error getPlaylistByID: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		if playlist == nil || playlist.UserAccount != user.Account {
+			return errorResponse(c, 403, "not comment author or playlist owner")
+		}
+	}
+
+	// スレッドの先頭のコメントなら返信も削除する
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM playlist_comment WHERE `id` = ? OR `parent_id` = ?",
+		comment.ID, comment.ID,
+	); err != nil {
+		c.Logger().Errorf("error Delete playlist_comment by id=%d: %s", comment.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := BasicResponse{
+		Result: true,
+		Status: 200,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequiresCSRFToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		route         string
+		sessionCookie bool
+		authorization string
+		want          bool
+	}{
+		{name: "post with session", method: http.MethodPost, route: "/api/playlist/:playlistUlid/comment", sessionCookie: true, want: true},
+		{name: "admin api", method: http.MethodPost, route: "/api/admin/playlist/moderate", sessionCookie: true, want: true},
+		{name: "get", method: http.MethodGet, route: "/api/playlists", sessionCookie: true, want: false},
+		{name: "head", method: http.MethodHead, route: "/api/playlists", sessionCookie: true, want: false},
+		{name: "options", method: http.MethodOptions, route: "/api/token/add", sessionCookie: true, want: false},
+		{name: "login", method: http.MethodPost, route: "/api/login", sessionCookie: true, want: false},
+		{name: "signup", method: http.MethodPost, route: "/api/signup", sessionCookie: true, want: false},
+		{name: "bench initialize", method: http.MethodPost, route: "/initialize", sessionCookie: true, want: false},
+		{name: "bench playlist add", method: http.MethodPost, route: "/api/playlist/add", sessionCookie: true, want: false},
+		{name: "bench playlist update", method: http.MethodPost, route: "/api/playlist/:playlistUlid/update", sessionCookie: true, want: false},
+		{name: "bench favorite", method: http.MethodPost, route: "/api/playlist/:playlistUlid/favorite", sessionCookie: true, want: false},
+		{name: "bench ban", method: http.MethodPost, route: "/api/admin/user/ban", sessionCookie: true, want: false},
+		{name: "bearer token", method: http.MethodPost, route: "/api/token/add", sessionCookie: true, authorization: "Bearer l80_xxx", want: false},
+		{name: "basic auth", method: http.MethodPost, route: "/api/token/add", sessionCookie: true, authorization: "Basic eDp4", want: true},
+		{name: "no session", method: http.MethodPost, route: "/api/token/add", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.sessionCookie {
+				req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session"})
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if got := requiresCSRFToken(req, tt.route); got != tt.want {
+				t.Errorf("requiresCSRFToken = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsValidCSRFToken(t *testing.T) {
+	tests := []struct {
+		name         string
+		sessionToken string
+		headerToken  string
+		want         bool
+	}{
+		{name: "match", sessionToken: "token", headerToken: "token", want: true},
+		{name: "mismatch", sessionToken: "token", headerToken: "other", want: false},
+		{name: "prefix", sessionToken: "token", headerToken: "tok", want: false},
+		{name: "no header", sessionToken: "token", want: false},
+		{name: "no session token", headerToken: "token", want: false},
+		{name: "both empty", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isValidCSRFToken(tt.sessionToken, tt.headerToken); got != tt.want {
+				t.Errorf("isValidCSRFToken(%q, %q) = %t, want %t", tt.sessionToken, tt.headerToken, got, tt.want)
+			}
+		})
+	}
+}
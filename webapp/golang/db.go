@@ -19,6 +19,15 @@ type SongRow struct {
 	Album       string `db:"album"`
 	TrackNumber int    `db:"track_number"`
 	IsPublic    bool   `db:"is_public"`
+	Duration    int    `db:"duration"`
+	Genre       string `db:"genre"`
+	ReleaseYear int    `db:"release_year"`
+}
+
+// artist を JOIN して取得したsong
+type SongWithArtistRow struct {
+	SongRow
+	ArtistName string `db:"artist_name"`
 }
 
 type ArtistRow struct {
@@ -28,19 +37,26 @@ type ArtistRow struct {
 }
 
 type PlaylistRow struct {
-	ID          int       `db:"id"`
-	ULID        string    `db:"ulid"`
-	Name        string    `db:"name"`
-	UserAccount string    `db:"user_account"`
-	IsPublic    bool      `db:"is_public"`
-	CreatedAt   time.Time `db:"created_at"`
-	UpdatedAt   time.Time `db:"updated_at"`
+	ID               int       `db:"id"`
+	ULID             string    `db:"ulid"`
+	Name             string    `db:"name"`
+	Description      string    `db:"description"`
+	UserAccount      string    `db:"user_account"`
+	IsPublic         bool      `db:"is_public"`
+	IsUnlisted       bool      `db:"is_unlisted"`
+	ShareToken       string    `db:"share_token"`
+	IsHidden         bool      `db:"is_hidden"`
+	IsLocked         bool      `db:"is_locked"`
+	ModerationReason string    `db:"moderation_reason"`
+	CreatedAt        time.Time `db:"created_at"`
+	UpdatedAt        time.Time `db:"updated_at"`
 }
 
 type PlaylistSongRow struct {
-	PlaylistID int `db:"playlist_id"`
-	SortOrder  int `db:"sort_order"`
-	SongID     int `db:"song_id"`
+	PlaylistID int       `db:"playlist_id"`
+	SortOrder  int       `db:"sort_order"`
+	SongID     int       `db:"song_id"`
+	CreatedAt  time.Time `db:"created_at"`
 }
 
 type PlaylistFavoriteRow struct {
@@ -49,3 +65,112 @@ type PlaylistFavoriteRow struct {
 	FavoriteUserAccount string    `db:"favorite_user_account"`
 	CreatedAt           time.Time `db:"created_at"`
 }
+
+type ReportRow struct {
+	ID              int       `db:"id"`
+	TargetType      string    `db:"target_type"`
+	TargetID        string    `db:"target_id"`
+	ReporterAccount string    `db:"reporter_account"`
+	Category        string    `db:"category"`
+	Comment         string    `db:"comment"`
+	ResolutionID    int       `db:"resolution_id"`
+	CreatedAt       time.Time `db:"created_at"`
+	// 未対応の通報の重複を防ぐための生成カラム
+	OpenReporterAccount *string `db:"open_reporter_account"`
+}
+
+type ReportResolutionRow struct {
+	ID           int       `db:"id"`
+	TargetType   string    `db:"target_type"`
+	TargetID     string    `db:"target_id"`
+	Action       string    `db:"action"`
+	Note         string    `db:"note"`
+	AdminAccount string    `db:"admin_account"`
+	ReportCount  int       `db:"report_count"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+type PlaylistSmartRuleRow struct {
+	PlaylistID int       `db:"playlist_id"`
+	Rules      string    `db:"rules"`
+	CreatedAt  time.Time `db:"created_at"`
+	UpdatedAt  time.Time `db:"updated_at"`
+}
+
+type PlaylistCommentRow struct {
+	ID          int       `db:"id"`
+	ULID        string    `db:"ulid"`
+	PlaylistID  int       `db:"playlist_id"`
+	ParentID    int       `db:"parent_id"`
+	UserAccount string    `db:"user_account"`
+	Body        string    `db:"body"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+type PlaylistCommentWithUserRow struct {
+	PlaylistCommentRow
+	UserDisplayName string `db:"user_display_name"`
+}
+
+type PlayEventRow struct {
+	ID          int       `db:"id"`
+	UserAccount string    `db:"user_account"`
+	SongID      int       `db:"song_id"`
+	PlaylistID  int       `db:"playlist_id"`
+	PlayedAt    time.Time `db:"played_at"`
+}
+
+type WebhookRow struct {
+	ID          int       `db:"id"`
+	ULID        string    `db:"ulid"`
+	UserAccount string    `db:"user_account"`
+	URL         string    `db:"url"`
+	Secret      string    `db:"secret"`
+	Events      string    `db:"events"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type WebhookDeliveryRow struct {
+	ID             int       `db:"id"`
+	ULID           string    `db:"ulid"`
+	WebhookID      int       `db:"webhook_id"`
+	Event          string    `db:"event"`
+	Payload        string    `db:"payload"`
+	Status         string    `db:"status"`
+	AttemptCount   int       `db:"attempt_count"`
+	NextAttemptAt  time.Time `db:"next_attempt_at"`
+	LastStatusCode int       `db:"last_status_code"`
+	LastError      string    `db:"last_error"`
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+type AccessTokenRow struct {
+	ID          int        `db:"id"`
+	ULID        string     `db:"ulid"`
+	UserAccount string     `db:"user_account"`
+	Name        string     `db:"name"`
+	TokenHash   string     `db:"token_hash"`
+	TokenPrefix string     `db:"token_prefix"`
+	Scopes      string     `db:"scopes"`
+	LastUsedAt  *time.Time `db:"last_used_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+}
+
+type UserSessionRow struct {
+	SessionID   int       `db:"session_id"`
+	ULID        string    `db:"ulid"`
+	UserAccount string    `db:"user_account"`
+	UserAgent   string    `db:"user_agent"`
+	IPAddress   string    `db:"ip_address"`
+	CreatedAt   time.Time `db:"created_at"`
+	LastSeenAt  time.Time `db:"last_seen_at"`
+}
+
+type AccountDeletionRow struct {
+	UserAccount string     `db:"user_account"`
+	RequestedAt time.Time  `db:"requested_at"`
+	ScheduledAt time.Time  `db:"scheduled_at"`
+	DeletedAt   *time.Time `db:"deleted_at"`
+}
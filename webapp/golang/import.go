@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// カタログの一括取り込み
+//
+//	./isucon import [-format json|csv] [-dry-run] [-batch-size 500] FILE
+//
+// bench の songs.json と同じ形式のJSON、または同じキーをヘッダに持つCSVを読み込み、
+// artist と song を upsert する
+
+// ulid, title, artist 以外は省略でき、既存の曲を更新するときは指定された項目だけ変える
+// CSVでは空のセルを省略として扱う
+type catalogImportRow struct {
+	ULID        string  `json:"ulid"`
+	Title       string  `json:"title"`
+	ArtistName  string  `json:"artist_name"`
+	ArtistID    int     `json:"artist_id"`
+	Album       *string `json:"album"`
+	TrackNumber *int    `json:"track_number"`
+	IsPublic    *bool   `json:"is_public"`
+	Duration    *int    `json:"duration"`
+	Genre       *string `json:"genre"`
+	ReleaseYear *int    `json:"release_year"`
+
+	line int
+	// CSVの値の変換エラー validate で行の不正として扱う
+	parseErr error
+}
+
+type catalogImportStats struct {
+	ArtistCreated int
+	ArtistUpdated int
+	SongCreated   int
+	SongUpdated   int
+	SongUnchanged int
+	Errors        int
+}
+
+type catalogImporter struct {
+	db     *sqlx.DB
+	dryRun bool
+	out    io.Writer
+	stats  catalogImportStats
+
+	artistsByID   map[int]*ArtistRow
+	artistsByName map[string]*ArtistRow
+	// dry-run で作成したことにしたartistの仮ID
+	dryRunArtistID int
+}
+
+func runImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "input format: json or csv (default: by file extension)")
+	dryRun := fs.Bool("dry-run", false, "print what would change without writing to the database")
+	batchSize := fs.Int("batch-size", 500, "number of rows per transaction")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [options] FILE\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("FILE is required")
+	}
+	if *batchSize < 1 {
+		return fmt.Errorf("invalid batch-size=%d", *batchSize)
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var rows []*catalogImportRow
+	switch *format {
+	case "json":
+		rows, err = readCatalogImportJSON(f)
+	case "csv":
+		rows, err = readCatalogImportCSV(f)
+	default:
+		return fmt.Errorf("unknown format=%s", *format)
+	}
+	if err != nil {
+		return fmt.Errorf("error read %s: %w", path, err)
+	}
+
+	dbx, err := connectDB()
+	if err != nil {
+		return fmt.Errorf("failed to connect db: %w", err)
+	}
+	defer dbx.Close()
+
+	im := &catalogImporter{
+		db:            dbx,
+		dryRun:        *dryRun,
+		out:           os.Stdout,
+		artistsByID:   map[int]*ArtistRow{},
+		artistsByName: map[string]*ArtistRow{},
+	}
+	if err := im.run(context.Background(), rows, *batchSize); err != nil {
+		return err
+	}
+
+	s := im.stats
+	fmt.Fprintf(
+		im.out,
+		"artist: created=%d updated=%d, song: created=%d updated=%d unchanged=%d, errors=%d\n",
+		s.ArtistCreated, s.ArtistUpdated, s.SongCreated, s.SongUpdated, s.SongUnchanged, s.Errors,
+	)
+	if im.dryRun {
+		fmt.Fprintln(im.out, "dry-run: no changes were written")
+	}
+	return nil
+}
+
+func readCatalogImportJSON(r io.Reader) ([]*catalogImportRow, error) {
+	var rows []*catalogImportRow
+	if err := json.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, fmt.Errorf("failed to decode json: %w", err)
+	}
+	// JSONでは配列の何番目かを行番号とする
+	for i, row := range rows {
+		if row == nil {
+			return nil, fmt.Errorf("row %d: null", i+1)
+		}
+		row.line = i + 1
+	}
+	return rows, nil
+}
+
+func readCatalogImportCSV(r io.Reader) ([]*catalogImportRow, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"ulid", "title"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("csv header must have %s", name)
+		}
+	}
+	_, hasArtistName := columns["artist_name"]
+	_, hasArtistID := columns["artist_id"]
+	if !hasArtistName && !hasArtistID {
+		return nil, errors.New("csv header must have artist_name or artist_id")
+	}
+
+	var rows []*catalogImportRow
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read csv: %w", err)
+		}
+		get := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := &catalogImportRow{
+			ULID:       get("ulid"),
+			Title:      get("title"),
+			ArtistName: get("artist_name"),
+			line:       line,
+		}
+		if v := get("album"); v != "" {
+			row.Album = &v
+		}
+		if v := get("genre"); v != "" {
+			row.Genre = &v
+		}
+		// 数値の変換エラーは負の値にして、validate で行の不正として扱う
+		if v := get("artist_id"); v != "" {
+			if row.ArtistID, err = strconv.Atoi(v); err != nil {
+				row.ArtistID = -1
+			}
+		}
+		for name, dest := range map[string]**int{
+			"track_number": &row.TrackNumber,
+			"duration":     &row.Duration,
+			"release_year": &row.ReleaseYear,
+		} {
+			if v := get(name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					n = -1
+				}
+				*dest = &n
+			}
+		}
+		if v := get("is_public"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				row.parseErr = fmt.Errorf("invalid is_public=%s", v)
+			} else {
+				row.IsPublic = &b
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (row *catalogImportRow) validate() error {
+	if row.parseErr != nil {
+		return row.parseErr
+	}
+	if row.ULID != "" {
+		if _, err := ulid.ParseStrict(row.ULID); err != nil {
+			return errors.New("invalid ulid")
+		}
+	}
+	if err := validateSongTitle(row.Title); err != nil {
+		return err
+	}
+	if row.Album != nil {
+		if err := validateSongAlbum(*row.Album); err != nil {
+			return err
+		}
+	}
+	if row.TrackNumber != nil {
+		if err := validateSongTrackNumber(*row.TrackNumber); err != nil {
+			return err
+		}
+	}
+	if row.Duration != nil {
+		if err := validateSongDuration(*row.Duration); err != nil {
+			return err
+		}
+	}
+	if row.Genre != nil {
+		if err := validateSongGenre(*row.Genre); err != nil {
+			return err
+		}
+	}
+	if row.ReleaseYear != nil {
+		if err := validateSongReleaseYear(*row.ReleaseYear); err != nil {
+			return err
+		}
+	}
+	if row.ArtistID < 0 {
+		return errors.New("invalid artist_id")
+	}
+	if row.ArtistName == "" && row.ArtistID == 0 {
+		return errors.New("artist_name or artist_id is required")
+	}
+	if row.ArtistName != "" {
+		if err := validateArtistName(row.ArtistName); err != nil {
+			return errors.New("invalid artist_name")
+		}
+	}
+	return nil
+}
+
+func (im *catalogImporter) rowError(row *catalogImportRow, err error) {
+	im.stats.Errors++
+	fmt.Fprintf(im.out, "row %d: error: %s\n", row.line, err)
+}
+
+func (im *catalogImporter) run(ctx context.Context, rows []*catalogImportRow, batchSize int) error {
+	// 不正な行、ファイル内で重複したulidの行は取り込まない
+	valid := make([]*catalogImportRow, 0, len(rows))
+	seen := make(map[string]int, len(rows))
+	for _, row := range rows {
+		if err := row.validate(); err != nil {
+			im.rowError(row, err)
+			continue
+		}
+		if row.ULID != "" {
+			if line, ok := seen[row.ULID]; ok {
+				im.rowError(row, fmt.Errorf("duplicated ulid=%s (row %d)", row.ULID, line))
+				continue
+			}
+			seen[row.ULID] = row.line
+		}
+		valid = append(valid, row)
+	}
+
+	for start := 0; start < len(valid); start += batchSize {
+		end := start + batchSize
+		if len(valid) < end {
+			end = len(valid)
+		}
+		if err := im.importBatch(ctx, valid[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *catalogImporter) importBatch(ctx context.Context, rows []*catalogImportRow) error {
+	// dry-run では書き込まないのでトランザクションは使わない
+	if im.dryRun {
+		for _, row := range rows {
+			if err := im.importRow(ctx, im.db, row); err != nil {
+				im.rowError(row, err)
+			}
+		}
+		return nil
+	}
+
+	tx, err := im.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error db.BeginTxx: %w", err)
+	}
+	stats := im.stats
+	for _, row := range rows {
+		if err := im.importRow(ctx, tx, row); err != nil {
+			// バッチごと取り消すので、キャッシュも捨てて数え直す
+			tx.Rollback()
+			im.artistsByID = map[int]*ArtistRow{}
+			im.artistsByName = map[string]*ArtistRow{}
+			im.stats = stats
+			im.stats.Errors += len(rows)
+			fmt.Fprintf(
+				im.out,
+				"row %d: error: %s (rows %d-%d are rolled back)\n",
+				row.line, err, rows[0].line, rows[len(rows)-1].line,
+			)
+			return nil
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	return nil
+}
+
+func (im *catalogImporter) cacheArtist(artist *ArtistRow) {
+	im.artistsByID[artist.ID] = artist
+	im.artistsByName[artist.Name] = artist
+}
+
+func (im *catalogImporter) findArtist(ctx context.Context, db connOrTx, row *catalogImportRow) (*ArtistRow, error) {
+	if row.ArtistID != 0 {
+		if artist, ok := im.artistsByID[row.ArtistID]; ok {
+			return artist, nil
+		}
+		artist, err := getArtistByID(ctx, db, row.ArtistID)
+		if err != nil {
+			return nil, err
+		}
+		if artist != nil {
+			im.cacheArtist(artist)
+			return artist, nil
+		}
+	}
+	if row.ArtistName == "" {
+		return nil, fmt.Errorf("artist not found. artist_id=%d", row.ArtistID)
+	}
+	if artist, ok := im.artistsByName[row.ArtistName]; ok {
+		return artist, nil
+	}
+	var artists []ArtistRow
+	if err := db.SelectContext(
+		ctx,
+		&artists,
+		"SELECT * FROM artist WHERE `name` = ? ORDER BY id LIMIT 1",
+		row.ArtistName,
+	); err != nil {
+		return nil, fmt.Errorf("error Select artist by name=%s: %w", row.ArtistName, err)
+	}
+	if len(artists) == 0 {
+		return nil, nil
+	}
+	im.cacheArtist(&artists[0])
+	return &artists[0], nil
+}
+
+func (im *catalogImporter) upsertArtist(ctx context.Context, db connOrTx, row *catalogImportRow) (*ArtistRow, error) {
+	artist, err := im.findArtist(ctx, db, row)
+	if err != nil {
+		return nil, err
+	}
+
+	if artist == nil {
+		fmt.Fprintf(im.out, "row %d: create artist name=%s\n", row.line, row.ArtistName)
+		im.stats.ArtistCreated++
+		if im.dryRun {
+			im.dryRunArtistID--
+			artist = &ArtistRow{ID: im.dryRunArtistID, Name: row.ArtistName}
+		} else {
+			artist, err = insertArtist(ctx, db, row.ArtistName, time.Now())
+			if err != nil {
+				return nil, err
+			}
+		}
+		im.cacheArtist(artist)
+		return artist, nil
+	}
+
+	// artist_id で見つかったartistの名前が違えば更新する
+	if row.ArtistName != "" && artist.Name != row.ArtistName {
+		fmt.Fprintf(
+			im.out,
+			"row %d: update artist ulid=%s name: %s -> %s\n",
+			row.line, artist.ULID, artist.Name, row.ArtistName,
+		)
+		im.stats.ArtistUpdated++
+		if !im.dryRun {
+			if _, err := db.ExecContext(
+				ctx,
+				"UPDATE artist SET `name` = ? WHERE `id` = ?",
+				row.ArtistName, artist.ID,
+			); err != nil {
+				return nil, fmt.Errorf("error Update artist by name=%s, id=%d: %w", row.ArtistName, artist.ID, err)
+			}
+		}
+		delete(im.artistsByName, artist.Name)
+		updated := *artist
+		updated.Name = row.ArtistName
+		im.cacheArtist(&updated)
+		artist = &updated
+	}
+	return artist, nil
+}
+
+// 指定された項目だけを曲に反映する
+func (row *catalogImportRow) apply(song *SongRow, artist *ArtistRow) {
+	song.Title = row.Title
+	song.ArtistID = artist.ID
+	if row.Album != nil {
+		song.Album = *row.Album
+	}
+	if row.TrackNumber != nil {
+		song.TrackNumber = *row.TrackNumber
+	}
+	if row.IsPublic != nil {
+		song.IsPublic = *row.IsPublic
+	}
+	if row.Duration != nil {
+		song.Duration = *row.Duration
+	}
+	if row.Genre != nil {
+		song.Genre = *row.Genre
+	}
+	if row.ReleaseYear != nil {
+		song.ReleaseYear = *row.ReleaseYear
+	}
+}
+
+func (im *catalogImporter) importRow(ctx context.Context, db connOrTx, row *catalogImportRow) error {
+	artist, err := im.upsertArtist(ctx, db, row)
+	if err != nil {
+		return err
+	}
+
+	var song *SongRow
+	if row.ULID != "" {
+		song, err = getSongByULID(ctx, db, row.ULID)
+		if err != nil {
+			return err
+		}
+	}
+	if song == nil {
+		// 省略された項目は空、公開にする
+		next := SongRow{ULID: row.ULID, IsPublic: true}
+		row.apply(&next, artist)
+		fmt.Fprintf(im.out, "row %d: create song ulid=%s title=%s\n", row.line, row.ULID, row.Title)
+		im.stats.SongCreated++
+		if im.dryRun {
+			return nil
+		}
+		return insertSong(ctx, db, &next, time.Now())
+	}
+
+	// 省略された項目は今の値のままにする
+	next := *song
+	row.apply(&next, artist)
+	var changes []string
+	if song.Title != next.Title {
+		changes = append(changes, fmt.Sprintf("title: %s -> %s", song.Title, next.Title))
+	}
+	if song.ArtistID != next.ArtistID {
+		changes = append(changes, fmt.Sprintf("artist_id: %d -> %d", song.ArtistID, next.ArtistID))
+	}
+	if song.Album != next.Album {
+		changes = append(changes, fmt.Sprintf("album: %s -> %s", song.Album, next.Album))
+	}
+	if song.TrackNumber != next.TrackNumber {
+		changes = append(changes, fmt.Sprintf("track_number: %d -> %d", song.TrackNumber, next.TrackNumber))
+	}
+	if song.IsPublic != next.IsPublic {
+		changes = append(changes, fmt.Sprintf("is_public: %t -> %t", song.IsPublic, next.IsPublic))
+	}
+	if song.Duration != next.Duration {
+		changes = append(changes, fmt.Sprintf("duration: %d -> %d", song.Duration, next.Duration))
+	}
+	if song.Genre != next.Genre {
+		changes = append(changes, fmt.Sprintf("genre: %s -> %s", song.Genre, next.Genre))
+	}
+	if song.ReleaseYear != next.ReleaseYear {
+		changes = append(changes, fmt.Sprintf("release_year: %d -> %d", song.ReleaseYear, next.ReleaseYear))
+	}
+	if len(changes) == 0 {
+		im.stats.SongUnchanged++
+		return nil
+	}
+	fmt.Fprintf(im.out, "row %d: update song ulid=%s %s\n", row.line, song.ULID, strings.Join(changes, ", "))
+	im.stats.SongUpdated++
+	if im.dryRun {
+		return nil
+	}
+	return updateSong(ctx, db, &next)
+}
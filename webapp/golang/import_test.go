@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadCatalogImportCSV(t *testing.T) {
+	tests := []struct {
+		name       string
+		csv        string
+		wantErr    bool
+		wantRowErr bool
+		check      func(t *testing.T, row *catalogImportRow)
+	}{
+		{
+			name: "bench columns",
+			csv:  "ulid,title,artist_name,artist_id\n01G3F4J5K6M7N8P9Q0R1S2T3V4,Song,Artist,3\n",
+			check: func(t *testing.T, row *catalogImportRow) {
+				if row.Title != "Song" || row.ArtistName != "Artist" || row.ArtistID != 3 {
+					t.Errorf("row = %+v", row)
+				}
+				if row.Album != nil || row.TrackNumber != nil || row.IsPublic != nil || row.Duration != nil || row.Genre != nil || row.ReleaseYear != nil {
+					t.Errorf("omitted columns are set: %+v", row)
+				}
+			},
+		},
+		{
+			name: "all columns",
+			csv:  "ulid,title,artist_name,album,track_number,is_public,duration,genre,release_year\n,Song,Artist,Album,2,false,180,rock,1999\n",
+			check: func(t *testing.T, row *catalogImportRow) {
+				if row.Album == nil || *row.Album != "Album" || row.TrackNumber == nil || *row.TrackNumber != 2 ||
+					row.IsPublic == nil || *row.IsPublic || row.Duration == nil || *row.Duration != 180 ||
+					row.Genre == nil || *row.Genre != "rock" || row.ReleaseYear == nil || *row.ReleaseYear != 1999 {
+					t.Errorf("row = %+v", row)
+				}
+			},
+		},
+		{
+			name: "empty cells are omitted",
+			csv:  "ulid,title,artist_name,album,is_public,duration\n,Song,Artist,,,\n",
+			check: func(t *testing.T, row *catalogImportRow) {
+				if row.Album != nil || row.IsPublic != nil || row.Duration != nil {
+					t.Errorf("empty cells are set: %+v", row)
+				}
+			},
+		},
+		{name: "invalid is_public", csv: "ulid,title,artist_name,is_public\n,Song,Artist,maybe\n", wantRowErr: true},
+		{name: "invalid number", csv: "ulid,title,artist_name,duration\n,Song,Artist,3:00\n", wantRowErr: true},
+		{name: "no ulid column", csv: "title,artist_name\nSong,Artist\n", wantErr: true},
+		{name: "no title column", csv: "ulid,artist_name\n,Artist\n", wantErr: true},
+		{name: "no artist column", csv: "ulid,title\n,Song\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := readCatalogImportCSV(strings.NewReader(tt.csv))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("readCatalogImportCSV returns no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readCatalogImportCSV returns error: %s", err)
+			}
+			if len(rows) != 1 {
+				t.Fatalf("readCatalogImportCSV returns %d rows, want 1", len(rows))
+			}
+			err = rows[0].validate()
+			if tt.wantRowErr {
+				if err == nil {
+					t.Errorf("validate returns no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validate returns error: %s", err)
+			}
+			tt.check(t, rows[0])
+		})
+	}
+}
+
+func TestCatalogImportRowApply(t *testing.T) {
+	song := SongRow{
+		ID:          1,
+		ULID:        "01G3F4J5K6M7N8P9Q0R1S2T3V4",
+		Title:       "Old",
+		ArtistID:    1,
+		Album:       "Album",
+		TrackNumber: 3,
+		IsPublic:    false,
+		Duration:    200,
+		Genre:       "jazz",
+		ReleaseYear: 1980,
+	}
+	genre := "fusion"
+	row := &catalogImportRow{Title: "New", Genre: &genre}
+	row.apply(&song, &ArtistRow{ID: 2})
+
+	want := SongRow{
+		ID:          1,
+		ULID:        "01G3F4J5K6M7N8P9Q0R1S2T3V4",
+		Title:       "New",
+		ArtistID:    2,
+		Album:       "Album",
+		TrackNumber: 3,
+		IsPublic:    false,
+		Duration:    200,
+		Genre:       "fusion",
+		ReleaseYear: 1980,
+	}
+	if song != want {
+		t.Errorf("apply = %+v, want %+v", song, want)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 曲単位のいいね
+// いいねした曲は「いいねした曲」という仮想的なプレイリストとして見れる
+
+// いいねした曲のプレイリストのULIDと名前 DBには存在しない
+const (
+	likedSongsPlaylistULID = "liked"
+	likedSongsPlaylistName = "いいねした曲"
+)
+
+func getLikesCountBySongID(ctx context.Context, db connOrTx, songID int) (int, error) {
+	var count int
+	if err := db.GetContext(
+		ctx,
+		&count,
+		"SELECT COUNT(*) FROM song_like WHERE song_id = ?",
+		songID,
+	); err != nil {
+		return 0, fmt.Errorf("error Get count of song_like by song_id=%d: %w", songID, err)
+	}
+	return count, nil
+}
+
+func isLikedBy(ctx context.Context, db connOrTx, userAccount string, songID int) (bool, error) {
+	var count int
+	if err := db.GetContext(
+		ctx,
+		&count,
+		"SELECT COUNT(*) FROM song_like WHERE user_account = ? AND song_id = ?",
+		userAccount, songID,
+	); err != nil {
+		return false, fmt.Errorf(
+			"error Get count of song_like by user_account=%s, song_id=%d: %w",
+			userAccount, songID, err,
+		)
+	}
+	return count > 0, nil
+}
+
+func getSongDetail(ctx context.Context, db connOrTx, song *SongRow, viewerUserAccount string) (*SongDetail, error) {
+	artist, err := getArtistByID(ctx, db, song.ArtistID)
+	if err != nil {
+		return nil, fmt.Errorf("error getArtistByID: %w", err)
+	}
+	if artist == nil {
+		return nil, fmt.Errorf("artist not found: id=%d", song.ArtistID)
+	}
+	likeCount, err := getLikesCountBySongID(ctx, db, song.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error getLikesCountBySongID: %w", err)
+	}
+	var isLiked bool
+	if viewerUserAccount != anonUserAccount {
+		isLiked, err = isLikedBy(ctx, db, viewerUserAccount, song.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error isLikedBy: %w", err)
+		}
+	}
+	return &SongDetail{
+		Song:      toSong(song, artist),
+		LikeCount: likeCount,
+		IsLiked:   isLiked,
+	}, nil
+}
+
+// いいねした順(新しい順)に、いいねした曲のプレイリストを組み立てる
+func getLikedSongsPlaylistDetail(ctx context.Context, db connOrTx, user *UserRow) (*PlaylistDetail, error) {
+	var rows []struct {
+		SongWithArtistRow
+		LikedAt time.Time `db:"liked_at"`
+	}
+	if err := db.SelectContext(
+		ctx,
+		&rows,
+		"SELECT song.*, artist.name AS artist_name, song_like.created_at AS liked_at FROM song_like"+
+			" JOIN song ON song.id = song_like.song_id JOIN artist ON artist.id = song.artist_id"+
+			" WHERE song_like.user_account = ? ORDER BY song_like.created_at DESC, song_like.song_id DESC",
+		user.Account,
+	); err != nil {
+		return nil, fmt.Errorf("error Select song_like by user_account=%s: %w", user.Account, err)
+	}
+
+	songs := make([]Song, 0, len(rows))
+	songCount := 0
+	duration := 0
+	for _, row := range rows {
+		// 非公開になった曲は is_public=false として見せ、曲数には含めない
+		if row.IsPublic {
+			songCount++
+			duration += row.Duration
+		}
+		songs = append(songs, toSong(&row.SongRow, &ArtistRow{Name: row.ArtistName}))
+	}
+	// 作成日時は最初にいいねした日時、更新日時は最後にいいねした日時とする
+	createdAt := user.CreatedAt
+	updatedAt := user.CreatedAt
+	if len(rows) > 0 {
+		createdAt = rows[len(rows)-1].LikedAt
+		updatedAt = rows[0].LikedAt
+	}
+
+	return &PlaylistDetail{
+		Playlist: &Playlist{
+			ULID:            likedSongsPlaylistULID,
+			Name:            likedSongsPlaylistName,
+			UserDisplayName: user.DisplayName,
+			UserAccount:     user.Account,
+			SongCount:       songCount,
+			Duration:        duration,
+			IsPublic:        false,
+			Tags:            []string{},
+			CreatedAt:       createdAt,
+			UpdatedAt:       updatedAt,
+		},
+		Songs:         songs,
+		TotalDuration: duration,
+	}, nil
+}
+
+// GET /api/song/:songUlid
+
+func apiSongHandler(c echo.Context) error {
+	// ログインは不要
+	userAccount, err := getViewerUserAccount(c)
+	if err != nil {
+		c.Logger().Errorf("error getViewerUserAccount: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	songULID := c.Param("songUlid")
+	if songULID == "" {
+		return errorResponse(c, 400, "bad song ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", songULID); matched {
+		return errorResponse(c, 400, "bad song ulid")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	song, err := getSongByULID(ctx, conn, songULID)
+	if err != nil {
+		c.Logger().Errorf("error getSongByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	// 非公開の曲は見れない
+	if song == nil || !song.IsPublic {
+		return errorResponse(c, 404, "song not found")
+	}
+
+	return songDetailResponse(c, conn, song, userAccount)
+}
+
+func songDetailResponse(c echo.Context, conn connOrTx, song *SongRow, userAccount string) error {
+	songDetail, err := getSongDetail(c.Request().Context(), conn, song, userAccount)
+	if err != nil {
+		c.Logger().Errorf("error getSongDetail: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := SingleSongResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Song: *songDetail,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	return nil
+}
+
+// POST /api/song/:songUlid/like
+
+func apiSongLikeHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	songULID := c.Param("songUlid")
+	var req LikeSongRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind to LikeSongRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if songULID == "" {
+		return errorResponse(c, 404, "bad song ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", songULID); matched {
+		return errorResponse(c, 404, "bad song ulid")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	song, err := getSongByULID(ctx, conn, songULID)
+	if err != nil {
+		c.Logger().Errorf("error getSongByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if song == nil {
+		return errorResponse(c, 404, "song not found")
+	}
+
+	if req.IsLiked {
+		// 非公開の曲には新しくいいねできない
+		if !song.IsPublic {
+			return errorResponse(c, 404, "song not found")
+		}
+		if _, err := conn.ExecContext(
+			ctx,
+			"INSERT IGNORE INTO song_like (`song_id`, `user_account`, `created_at`) VALUES (?, ?, ?)",
+			song.ID, user.Account, time.Now(),
+		); err != nil {
+			c.Logger().Errorf(
+				"error Insert song_like by song_id=%d, user_account=%s: %s",
+				song.ID, user.Account, err,
+			)
+			return errorResponse(c, 500, "internal server error")
+		}
+	} else {
+		if _, err := conn.ExecContext(
+			ctx,
+			"DELETE FROM song_like WHERE `song_id` = ? AND `user_account` = ?",
+			song.ID, user.Account,
+		); err != nil {
+			c.Logger().Errorf(
+				"error Delete song_like by song_id=%d, user_account=%s: %s",
+				song.ID, user.Account, err,
+			)
+			return errorResponse(c, 500, "internal server error")
+		}
+	}
+
+	return songDetailResponse(c, conn, song, user.Account)
+}
+
+// GET /api/liked_songs
+
+func apiLikedSongsHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	playlistDetail, err := getLikedSongsPlaylistDetail(ctx, conn, user)
+	if err != nil {
+		c.Logger().Errorf("error getLikedSongsPlaylistDetail: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := SinglePlaylistResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Playlist: *playlistDetail,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
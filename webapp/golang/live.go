@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Server-Sent Events によるプレイリストの更新通知
+// プロセス内のハブで購読者に配り、受け取りが追いつかない購読者は切断する
+// 複数台構成では同じプロセスで起きた更新しか届かない
+
+const (
+	liveEventFavoriteCount   = "favorite_count"
+	liveEventPlaylistUpdated = "playlist_updated"
+	liveEventPlaylistRemoved = "playlist_removed"
+	liveEventPlaylistDeleted = "playlist_deleted"
+
+	// 新着プレイリスト一覧の購読先
+	liveTopicRecent = "recent"
+
+	// 購読者ごとに溜めておけるイベント数 溢れたら切断する
+	liveSubscriberBufferSize = 16
+	// 接続を保つためのコメントを送る間隔
+	liveHeartbeatInterval = 30 * time.Second
+)
+
+func livePlaylistTopic(playlistULID string) string {
+	return "playlist:" + playlistULID
+}
+
+type liveSubscriber struct {
+	topic string
+	// 購読したユーザー ログインしていなければ空
+	userAccount string
+	ch          chan []byte
+}
+
+type liveHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[*liveSubscriber]struct{}
+}
+
+var live = &liveHub{
+	subscribers: make(map[string]map[*liveSubscriber]struct{}),
+}
+
+func (h *liveHub) subscribe(topic string, userAccount string) *liveSubscriber {
+	sub := &liveSubscriber{topic: topic, userAccount: userAccount, ch: make(chan []byte, liveSubscriberBufferSize)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[topic]; !ok {
+		h.subscribers[topic] = make(map[*liveSubscriber]struct{})
+	}
+	h.subscribers[topic][sub] = struct{}{}
+	return sub
+}
+
+// 購読をやめる 既に切断されていれば何もしない
+func (h *liveHub) unsubscribe(sub *liveSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(sub)
+}
+
+func (h *liveHub) removeLocked(sub *liveSubscriber) {
+	subs, ok := h.subscribers[sub.topic]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	close(sub.ch)
+	if len(subs) == 0 {
+		delete(h.subscribers, sub.topic)
+	}
+}
+
+func (h *liveHub) hasSubscribers(topic string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return 0 < len(h.subscribers[topic])
+}
+
+// イベントを配る 待たずに送れない購読者は切断する
+func (h *liveHub) publish(topic string, event string, data interface{}) error {
+	return h.publishExcept(topic, "", event, data)
+}
+
+// exceptUserAccount のユーザー以外にイベントを配る 空なら全員に配る
+func (h *liveHub) publishExcept(topic string, exceptUserAccount string, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error json.Marshal %s event: %w", event, err)
+	}
+	message := []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, payload))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers[topic] {
+		if exceptUserAccount != "" && sub.userAccount == exceptUserAccount {
+			continue
+		}
+		select {
+		case sub.ch <- message:
+		default:
+			h.removeLocked(sub)
+		}
+	}
+	return nil
+}
+
+// 購読者を全て切断する 見れなくなったプレイリストの購読を打ち切るのに使う
+func (h *liveHub) closeTopic(topic string) {
+	h.closeTopicExcept(topic, "")
+}
+
+// exceptUserAccount のユーザー以外の購読者を切断する 空なら全員を切断する
+func (h *liveHub) closeTopicExcept(topic string, exceptUserAccount string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers[topic] {
+		if exceptUserAccount != "" && sub.userAccount == exceptUserAccount {
+			continue
+		}
+		h.removeLocked(sub)
+	}
+}
+
+func (h *liveHub) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, subs := range h.subscribers {
+		for sub := range subs {
+			h.removeLocked(sub)
+		}
+	}
+}
+
+// 更新によって、購読を始めたときに見れていた人が見れなくなったかどうか
+func isPlaylistAudienceNarrowed(before *PlaylistRow, after *PlaylistRow) bool {
+	if after.IsHidden || (!after.IsPublic && !after.IsUnlisted) {
+		return true
+	}
+	if after.IsPublic {
+		return false
+	}
+	// 限定公開は、公開からの変更かtokenが変わったときに以前のリンクの人が見れなくなる
+	return before.IsPublic || before.ShareToken != after.ShareToken
+}
+
+// プレイリストの変更を購読者に通知する before は変更前の状態
+func publishPlaylistChanged(ctx context.Context, db connOrTx, before *PlaylistRow) error {
+	// 誰も購読していなければ何も作らない
+	topic := livePlaylistTopic(before.ULID)
+	if !live.hasSubscribers(topic) && !live.hasSubscribers(liveTopicRecent) {
+		return nil
+	}
+	after, err := getPlaylistByID(ctx, db, before.ID)
+	if err != nil {
+		return fmt.Errorf("error getPlaylistByID: %w", err)
+	}
+	if after == nil {
+		return publishPlaylistDeleted(before)
+	}
+	removed := PlaylistLiveEvent{PlaylistULID: after.ULID}
+
+	// 見れなくなった人は切断する 作成者には引き続き届ける
+	narrowed := isPlaylistAudienceNarrowed(before, after)
+	if narrowed {
+		if err := live.publishExcept(topic, after.UserAccount, liveEventPlaylistRemoved, removed); err != nil {
+			return err
+		}
+		live.closeTopicExcept(topic, after.UserAccount)
+	}
+
+	onRecent := !narrowed && after.IsPublic && live.hasSubscribers(liveTopicRecent)
+	var detail *PlaylistDetail
+	if live.hasSubscribers(topic) || onRecent {
+		// 誰から見ても同じ内容になるよう、ログインしていないユーザーから見た状態を配る
+		// 非表示にされたものは作成者にしか届かないので、作成者から見た状態にする
+		var viewer *string
+		if after.IsHidden {
+			viewer = &after.UserAccount
+		}
+		detail, err = getPlaylistDetailByPlaylistULID(ctx, db, after.ULID, viewer)
+		if err != nil {
+			return fmt.Errorf("error getPlaylistDetailByPlaylistULID: %w", err)
+		}
+		if detail == nil {
+			// 作成者がbanされているなど、誰も見れない
+			if err := live.publish(topic, liveEventPlaylistRemoved, removed); err != nil {
+				return err
+			}
+			live.closeTopic(topic)
+		} else if err := live.publish(topic, liveEventPlaylistUpdated, detail); err != nil {
+			return err
+		}
+	}
+
+	if onRecent && detail != nil {
+		return live.publish(liveTopicRecent, liveEventPlaylistUpdated, detail.Playlist)
+	}
+	if before.IsPublic && (narrowed || !after.IsPublic || detail == nil) {
+		return live.publish(liveTopicRecent, liveEventPlaylistRemoved, removed)
+	}
+	return nil
+}
+
+func publishPlaylistDeleted(playlist *PlaylistRow) error {
+	event := PlaylistLiveEvent{PlaylistULID: playlist.ULID}
+	topic := livePlaylistTopic(playlist.ULID)
+	if err := live.publish(topic, liveEventPlaylistDeleted, event); err != nil {
+		return err
+	}
+	live.closeTopic(topic)
+	// 非公開だったものは新着一覧に載っていないので知らせない
+	if playlist.IsPublic && !playlist.IsHidden {
+		return live.publish(liveTopicRecent, liveEventPlaylistDeleted, event)
+	}
+	return nil
+}
+
+func publishFavoriteCount(ctx context.Context, db connOrTx, playlist *PlaylistRow) error {
+	onRecent := playlist.IsPublic && !playlist.IsHidden
+	if !live.hasSubscribers(livePlaylistTopic(playlist.ULID)) && !(onRecent && live.hasSubscribers(liveTopicRecent)) {
+		return nil
+	}
+	favoriteCount, err := getFavoritesCountByPlaylistID(ctx, db, playlist.ID)
+	if err != nil {
+		return fmt.Errorf("error getFavoritesCountByPlaylistID: %w", err)
+	}
+	event := PlaylistFavoriteCountEvent{PlaylistULID: playlist.ULID, FavoriteCount: favoriteCount}
+	if err := live.publish(livePlaylistTopic(playlist.ULID), liveEventFavoriteCount, event); err != nil {
+		return err
+	}
+	if onRecent {
+		return live.publish(liveTopicRecent, liveEventFavoriteCount, event)
+	}
+	return nil
+}
+
+// 購読が切断されるかクライアントが切断するまでイベントを書き出す
+func streamLiveEvents(c echo.Context, topic string, userAccount string) error {
+	sub := live.subscribe(topic, userAccount)
+	defer live.unsubscribe(sub)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	// nginxでバッファリングさせない
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	if _, err := res.Write([]byte(": connected\n\n")); err != nil {
+		return nil
+	}
+	res.Flush()
+
+	ticker := time.NewTicker(liveHeartbeatInterval)
+	defer ticker.Stop()
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case message, ok := <-sub.ch:
+			if !ok {
+				// 追いつけなかったか、見れなくなったので切断された
+				return nil
+			}
+			if _, err := res.Write(message); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-ticker.C:
+			if _, err := res.Write([]byte(": ping\n\n")); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
+
+// GET /api/playlist/:playlistUlid/events
+
+func apiPlaylistEventsHandler(c echo.Context) error {
+	// ログインは不要
+	userAccount, err := getViewerUserAccount(c)
+	if err != nil {
+		c.Logger().Errorf("error getViewerUserAccount: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	playlistULID := c.Param("playlistUlid")
+	if playlistULID == "" {
+		return errorResponse(c, 400, "bad playlist ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", playlistULID); matched {
+		return errorResponse(c, 400, "bad playlist ulid")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	playlist, err := getPlaylistByULID(ctx, conn, playlistULID)
+	// 購読している間DBの接続を掴まないよう、ここで返す
+	conn.Close()
+	if err != nil {
+		c.Logger().Errorf("error getPlaylistByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if playlist == nil {
+		return errorResponse(c, 404, "playlist not found")
+	}
+	// 詳細を見れないプレイリストは購読できない
+	if !canViewPlaylist(playlist, userAccount, c.QueryParam("share_token")) ||
+		(playlist.UserAccount != userAccount && playlist.IsHidden) {
+		return errorResponse(c, 404, "playlist not found")
+	}
+
+	return streamLiveEvents(c, livePlaylistTopic(playlist.ULID), userAccount)
+}
+
+// GET /api/recent_playlists/events
+
+func apiRecentPlaylistsEventsHandler(c echo.Context) error {
+	// ログインは不要 公開中のプレイリストのイベントのみ流れる
+	return streamLiveEvents(c, liveTopicRecent, "")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ログインの総当たり対策
+// パスワードが違った回数だけを、アカウントごととIPアドレスごとに数え、一定回数を超えたら指数的に長くなる間ロックする
+// プロセス内で数えるので、再起動や複数台構成では数え直しになる
+
+const (
+	// これを超えて失敗するとロックする
+	loginAccountFailureThreshold = 5
+	// ベンチマーカーやNATのように1つのIPアドレスから多くのユーザーがログインすることがあるので多めにする
+	loginIPFailureThreshold = 100
+	// 最初のロックの長さ 失敗するたびに倍になる
+	loginLockoutBase = 30 * time.Second
+	loginLockoutMax  = 15 * time.Minute
+	// 最後の失敗からこれだけ経ったら数え直す
+	loginFailureWindow = 15 * time.Minute
+	// 古い記録を掃除する間隔
+	loginThrottleSweepInterval = time.Minute
+)
+
+func loginAccountKey(account string) string {
+	return "account:" + account
+}
+
+func loginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+type loginFailure struct {
+	count        int
+	lastFailedAt time.Time
+	lockedUntil  time.Time
+}
+
+type loginThrottle struct {
+	mu          sync.Mutex
+	failures    map[string]*loginFailure
+	lastSweepAt time.Time
+}
+
+var loginThrottler = &loginThrottle{
+	failures: make(map[string]*loginFailure),
+}
+
+// ロック中なら解除までの時間を返す
+func (t *loginThrottle) lockedFor(now time.Time, keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		f, ok := t.failures[key]
+		if !ok {
+			continue
+		}
+		if d := f.lockedUntil.Sub(now); wait < d {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// 失敗を記録する 閾値を超えていればロックする
+func (t *loginThrottle) recordFailure(now time.Time, key string, threshold int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweepLocked(now)
+
+	f, ok := t.failures[key]
+	if !ok || loginFailureWindow < now.Sub(f.lastFailedAt) {
+		f = &loginFailure{}
+		t.failures[key] = f
+	}
+	f.count++
+	f.lastFailedAt = now
+	if f.count <= threshold {
+		return
+	}
+	lockout := loginLockoutMax
+	// 倍にし続けると溢れるので、上限を超える回数なら計算しない
+	if over := f.count - threshold - 1; over < 16 {
+		if d := loginLockoutBase << over; d < lockout {
+			lockout = d
+		}
+	}
+	f.lockedUntil = now.Add(lockout)
+}
+
+func (t *loginThrottle) clear(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.failures[key]
+	delete(t.failures, key)
+	return ok
+}
+
+// ロックが明けて数え直しになった記録を消す
+func (t *loginThrottle) sweepLocked(now time.Time) {
+	if now.Sub(t.lastSweepAt) < loginThrottleSweepInterval {
+		return
+	}
+	t.lastSweepAt = now
+	for key, f := range t.failures {
+		if loginFailureWindow < now.Sub(f.lastFailedAt) && f.lockedUntil.Before(now) {
+			delete(t.failures, key)
+		}
+	}
+}
+
+func (t *loginThrottle) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures = make(map[string]*loginFailure)
+	t.lastSweepAt = time.Time{}
+}
+
+// アカウントかIPアドレスがロック中なら解除までの時間を返す
+func getLoginLockout(c echo.Context, userAccount string) time.Duration {
+	return loginThrottler.lockedFor(time.Now(), loginAccountKey(userAccount), loginIPKey(c.RealIP()))
+}
+
+// Retry-Afterは秒単位なので切り上げる
+func setRetryAfter(c echo.Context, wait time.Duration) {
+	retryAfter := int((wait + time.Second - 1) / time.Second)
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+}
+
+func recordLoginFailure(c echo.Context, userAccount string) {
+	now := time.Now()
+	loginThrottler.recordFailure(now, loginAccountKey(userAccount), loginAccountFailureThreshold)
+	loginThrottler.recordFailure(now, loginIPKey(c.RealIP()), loginIPFailureThreshold)
+}
+
+// ログインに成功したらアカウントの失敗回数を消す
+// IPアドレスの失敗回数は消さない 自分のアカウントでログインして数え直させる抜け道になる
+func recordLoginSuccess(userAccount string) {
+	loginThrottler.clear(loginAccountKey(userAccount))
+}
+
+// POST /api/admin/login_lockouts/clear
+
+func apiAdminLoginLockoutsClearHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	// 管理者userであることを確認,でなければ403
+	if !isAdminUser(user.Account) {
+		return errorResponse(c, 403, "not admin user")
+	}
+
+	var req AdminLoginLockoutsClearRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AdminLoginLockoutsClearRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if req.UserAccount == "" && req.IPAddress == "" {
+		return errorResponse(c, 400, "user_account or ip_address is required")
+	}
+
+	cleared := 0
+	if req.UserAccount != "" && loginThrottler.clear(loginAccountKey(req.UserAccount)) {
+		cleared++
+	}
+	if req.IPAddress != "" && loginThrottler.clear(loginIPKey(req.IPAddress)) {
+		cleared++
+	}
+
+	body := AdminLoginLockoutsClearResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Cleared: cleared,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleLockout(t *testing.T) {
+	const threshold = 3
+	tests := []struct {
+		name     string
+		failures int
+		want     time.Duration
+	}{
+		{name: "under threshold", failures: threshold - 1, want: 0},
+		{name: "at threshold", failures: threshold, want: 0},
+		{name: "first lockout", failures: threshold + 1, want: loginLockoutBase},
+		{name: "doubled", failures: threshold + 2, want: 2 * loginLockoutBase},
+		{name: "doubled twice", failures: threshold + 3, want: 4 * loginLockoutBase},
+		{name: "capped", failures: threshold + 10, want: loginLockoutMax},
+		{name: "capped without overflow", failures: threshold + 100, want: loginLockoutMax},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttle := &loginThrottle{failures: make(map[string]*loginFailure)}
+			now := time.Date(2022, 5, 13, 9, 0, 0, 0, time.UTC)
+			for i := 0; i < tt.failures; i++ {
+				throttle.recordFailure(now, "key", threshold)
+			}
+			if got := throttle.lockedFor(now, "key"); got != tt.want {
+				t.Errorf("lockedFor after %d failures = %s, want %s", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginThrottleWindow(t *testing.T) {
+	throttle := &loginThrottle{failures: make(map[string]*loginFailure)}
+	now := time.Date(2022, 5, 13, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < loginAccountFailureThreshold; i++ {
+		throttle.recordFailure(now, "key", loginAccountFailureThreshold)
+	}
+	// 間が空いたら数え直すので、次の失敗ではロックしない
+	later := now.Add(loginFailureWindow + time.Second)
+	throttle.recordFailure(later, "key", loginAccountFailureThreshold)
+	if got := throttle.lockedFor(later, "key"); got != 0 {
+		t.Errorf("lockedFor after window = %s, want 0", got)
+	}
+}
+
+func TestLoginThrottleKeys(t *testing.T) {
+	throttle := &loginThrottle{failures: make(map[string]*loginFailure)}
+	now := time.Date(2022, 5, 13, 9, 0, 0, 0, time.UTC)
+	account := loginAccountKey("tsukue")
+	ip := loginIPKey("192.0.2.1")
+	for i := 0; i <= loginAccountFailureThreshold; i++ {
+		throttle.recordFailure(now, account, loginAccountFailureThreshold)
+		throttle.recordFailure(now, ip, loginIPFailureThreshold)
+	}
+
+	tests := []struct {
+		name string
+		keys []string
+		want time.Duration
+	}{
+		{name: "account", keys: []string{account}, want: loginLockoutBase},
+		{name: "ip under threshold", keys: []string{ip}, want: 0},
+		{name: "account or ip", keys: []string{account, ip}, want: loginLockoutBase},
+		{name: "other account", keys: []string{loginAccountKey("isucon")}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := throttle.lockedFor(now, tt.keys...); got != tt.want {
+				t.Errorf("lockedFor(%v) = %s, want %s", tt.keys, got, tt.want)
+			}
+		})
+	}
+
+	if got := throttle.lockedFor(now.Add(loginLockoutBase), account); got != 0 {
+		t.Errorf("lockedFor after lockout = %s, want 0", got)
+	}
+	if !throttle.clear(account) {
+		t.Errorf("clear(%s) = false, want true", account)
+	}
+	if throttle.clear(account) {
+		t.Errorf("clear(%s) twice = true, want false", account)
+	}
+}
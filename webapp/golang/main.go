@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"time"
 	"unicode/utf8"
 
@@ -27,7 +28,11 @@ import (
 const (
 	publicPath        = "./public"
 	sessionCookieName = "listen80_session_golang"
+	sessionTableName  = "sessions_golang"
+	sessionMaxAge     = 86400
 	anonUserAccount   = "__"
+	// ページ分けするAPIで指定できる最大のページ番号 OFFSETが大きくなりすぎないようにする
+	maxPage = 100
 )
 
 var (
@@ -75,13 +80,33 @@ func cacheControllPrivate(next echo.HandlerFunc) echo.HandlerFunc {
 }
 
 func main() {
+	// サブコマンド
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImportCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "import failed: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "session-keys" {
+		if err := runSessionKeysCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "session-keys failed: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	e := echo.New()
 	e.Debug = true
 	e.Logger.SetLevel(log.DEBUG)
+	// 接続元のIPアドレスは、nginxが X-Real-IP に入れたものを使う
+	// 信頼するのはループバック、プライベートなど内部のアドレスから来たヘッダーだけで、利用者が送った X-Forwarded-For は見ない
+	e.IPExtractor = echo.ExtractIPFromRealIPHeader()
 
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	e.Use(cacheControllPrivate)
+	e.Use(csrfProtection)
 
 	e.Renderer = tr
 	e.Static("/assets", publicPath+"/assets")
@@ -96,14 +121,67 @@ func main() {
 	e.POST("/api/login", apiLoginHandler)
 	e.POST("/api/logout", apiLogoutHandler)
 	e.GET("/api/recent_playlists", apiRecentPlaylistsHandler)
+	e.GET("/api/recent_playlists/events", apiRecentPlaylistsEventsHandler)
 	e.GET("/api/popular_playlists", apiPopularPlaylistsHandler)
 	e.GET("/api/playlists", apiPlaylistsHandler)
+	e.GET("/api/playlists/search", apiPlaylistSearchHandler)
 	e.GET("/api/playlist/:playlistUlid", apiPlaylistHandler)
+	e.GET("/api/songs", apiSongsHandler)
+	e.GET("/api/song/:songUlid", apiSongHandler)
+	e.POST("/api/song/:songUlid/like", apiSongLikeHandler)
+	e.GET("/api/liked_songs", apiLikedSongsHandler)
+	e.POST("/api/play", apiPlayHandler)
+	e.GET("/api/history", apiHistoryHandler)
+	e.GET("/api/tags", apiTagsHandler)
+	e.GET("/api/charts/songs", apiSongChartHandler)
+	e.GET("/api/charts/artists", apiArtistChartHandler)
+	e.GET("/api/tags/:tag/playlists", apiTagPlaylistsHandler)
+	e.GET("/api/playlist/:playlistUlid/export", apiPlaylistExportHandler)
 	e.POST("/api/playlist/add", apiPlaylistAddHandler)
+	e.POST("/api/playlist/import", apiPlaylistImportHandler)
 	e.POST("/api/playlist/:playlistUlid/update", apiPlaylistUpdateHandler)
 	e.POST("/api/playlist/:playlistUlid/delete", apiPlaylistDeleteHandler)
 	e.POST("/api/playlist/:playlistUlid/favorite", apiPlaylistFavoriteHandler)
+	e.POST("/api/playlist/:playlistUlid/smart", apiPlaylistSmartHandler)
+	e.POST("/api/playlist/:playlistUlid/snapshot", apiPlaylistSnapshotHandler)
+	e.POST("/api/playlist/:playlistUlid/share_token/rotate", apiPlaylistShareTokenRotateHandler)
+	e.GET("/api/playlist/:playlistUlid/comments", apiPlaylistCommentsHandler)
+	e.GET("/api/playlist/:playlistUlid/events", apiPlaylistEventsHandler)
+	e.GET("/api/playlist/:playlistUlid/similar", apiPlaylistSimilarHandler)
+	e.GET("/api/playlist/:playlistUlid/also_favorited", apiPlaylistAlsoFavoritedHandler)
+	e.POST("/api/playlist/:playlistUlid/comment", apiPlaylistCommentAddHandler)
+	e.POST("/api/comment/:commentUlid/update", apiCommentUpdateHandler)
+	e.POST("/api/comment/:commentUlid/delete", apiCommentDeleteHandler)
 	e.POST("/api/admin/user/ban", apiAdminUserBanHandler)
+	e.POST("/api/admin/login_lockouts/clear", apiAdminLoginLockoutsClearHandler)
+	e.POST("/api/admin/playlist/moderate", apiAdminPlaylistModerateHandler)
+	e.POST("/api/admin/song/visibility", apiAdminSongVisibilityHandler)
+	e.POST("/api/admin/artist/add", apiAdminArtistAddHandler)
+	e.POST("/api/admin/artist/merge", apiAdminArtistMergeHandler)
+	e.POST("/api/admin/artist/:artistUlid/update", apiAdminArtistUpdateHandler)
+	e.POST("/api/admin/song/add", apiAdminSongAddHandler)
+	e.POST("/api/admin/song/:songUlid/update", apiAdminSongUpdateHandler)
+	e.GET("/api/sessions", apiSessionsHandler)
+	e.POST("/api/session/:sessionUlid/revoke", apiSessionRevokeHandler)
+	e.POST("/api/sessions/revoke_others", apiSessionsRevokeOthersHandler)
+	e.POST("/api/account/password", apiAccountPasswordHandler)
+	e.POST("/api/account/profile", apiAccountProfileHandler)
+	e.GET("/api/account/export", apiAccountExportHandler)
+	e.GET("/api/account/deletion", apiAccountDeletionHandler)
+	e.POST("/api/account/delete", apiAccountDeleteHandler)
+	e.POST("/api/account/delete/cancel", apiAccountDeleteCancelHandler)
+	e.GET("/api/tokens", apiAccessTokensHandler)
+	e.POST("/api/token/add", apiAccessTokenAddHandler)
+	e.POST("/api/token/:tokenUlid/revoke", apiAccessTokenRevokeHandler)
+	e.GET("/api/webhooks", apiWebhooksHandler)
+	e.POST("/api/webhook/add", apiWebhookAddHandler)
+	e.POST("/api/webhook/:webhookUlid/delete", apiWebhookDeleteHandler)
+	e.POST("/api/webhook/:webhookUlid/ping", apiWebhookPingHandler)
+	e.GET("/api/webhook/:webhookUlid/deliveries", apiWebhookDeliveriesHandler)
+	e.POST("/api/report", apiReportHandler)
+	e.GET("/api/admin/reports", apiAdminReportsHandler)
+	e.POST("/api/admin/reports/resolve", apiAdminReportsResolveHandler)
+	e.GET("/api/admin/reports/history", apiAdminReportsHistoryHandler)
 
 	e.POST("/initialize", initializeHandler)
 
@@ -116,11 +194,24 @@ func main() {
 	db.SetMaxOpenConns(10)
 	defer db.Close()
 
-	sessionStore, err = mysqlstore.NewMySQLStoreFromConnection(db.DB, "sessions_golang", "/", 86400, []byte("powawa"))
+	go runPlayEventFlusher(e.Logger)
+	go runRecommendationRefresher(e.Logger)
+	go runChartAggregator(e.Logger)
+	loadWebhookConfig()
+	go runWebhookDispatcher(e.Logger)
+	go runAccountDeletionWorker(e.Logger)
+
+	sessionKeys, err := loadSessionKeys()
+	if err != nil {
+		e.Logger.Fatalf("invalid ISUCON_SESSION_KEYS: %v", err)
+		return
+	}
+	sessionStore, err = mysqlstore.NewMySQLStoreFromConnection(db.DB, sessionTableName, "/", sessionMaxAge, sessionKeys...)
 	if err != nil {
 		e.Logger.Fatalf("failed to initialize session store: %v", err)
 		return
 	}
+	go runUserSessionBackfill(e.Logger)
 
 	port := getEnv("SERVER_APP_PORT", "3000")
 	e.Logger.Infof("starting listen80 server on : %s ...", port)
@@ -133,6 +224,7 @@ func getSession(r *http.Request) (*sessions.Session, error) {
 	if err != nil {
 		return nil, err
 	}
+	setSessionCookieOptions(session)
 	return session, nil
 }
 
@@ -141,9 +233,17 @@ func newSession(r *http.Request) (*sessions.Session, error) {
 	if err != nil {
 		return nil, err
 	}
+	setSessionCookieOptions(session)
 	return session, nil
 }
 
+// mysqlstoreはSameSiteをセッションに引き継がないので、セッションごとに設定する
+// 他のサイトからのPOSTなどにはcookieを付けさせない
+func setSessionCookieOptions(session *sessions.Session) {
+	session.Options.HttpOnly = true
+	session.Options.SameSite = http.SameSiteLaxMode
+}
+
 func errorResponse(c echo.Context, code int, message string) error {
 	c.Logger().Debugf("error: status=%d, message=%s", code, message)
 
@@ -152,7 +252,8 @@ func errorResponse(c echo.Context, code int, message string) error {
 		Status: code,
 		Error:  &message,
 	}
-	if code == 401 {
+	// Bearer tokenで認証しようとしたときはcookieのセッションを消さない
+	if _, bearer := getBearerToken(c.Request()); code == 401 && !bearer {
 		sess, err := getSession(c.Request())
 		if err != nil {
 			return fmt.Errorf("error getSession at errorResponse: %w", err)
@@ -168,7 +269,24 @@ func errorResponse(c echo.Context, code int, message string) error {
 	return nil
 }
 
+// クエリパラメータ page を読む 省略時は1 1からmaxPageまでの整数でなければfalse
+func getPageFromParam(c echo.Context) (int, bool) {
+	p := c.QueryParam("page")
+	if p == "" {
+		return 1, true
+	}
+	page, err := strconv.Atoi(p)
+	if err != nil || page < 1 || maxPage < page {
+		return 0, false
+	}
+	return page, true
+}
+
 func validateSession(c echo.Context) (*UserRow, bool, error) {
+	// Bearer tokenが渡されたらcookieは見ない
+	if token, ok := getBearerToken(c.Request()); ok {
+		return validateAccessToken(c, token)
+	}
 	sess, err := getSession(c.Request())
 	if err != nil {
 		return nil, false, fmt.Errorf("error getSession: %w", err)
@@ -194,10 +312,39 @@ func validateSession(c echo.Context) (*UserRow, bool, error) {
 	if user.IsBan {
 		return nil, false, nil
 	}
+	if err := refreshUserSession(c, sess, user.Account); err != nil {
+		return nil, false, fmt.Errorf("error refreshUserSession: %w", err)
+	}
 
 	return &user, true, nil
 }
 
+// signup, login, アカウント設定で共通の入力チェック
+
+func isValidUserAccount(userAccount string) bool {
+	if userAccount == "" || len(userAccount) < 4 || 191 < len(userAccount) {
+		return false
+	}
+	if matched, _ := regexp.MatchString(`[^a-zA-Z0-9\-_]`, userAccount); matched {
+		return false
+	}
+	return true
+}
+
+func isValidPassword(password string) bool {
+	if password == "" || len(password) < 8 || 64 < len(password) {
+		return false
+	}
+	if matched, _ := regexp.MatchString(`[^a-zA-Z0-9\-_]`, password); matched {
+		return false
+	}
+	return true
+}
+
+func isValidDisplayName(displayName string) bool {
+	return displayName != "" && 2 <= utf8.RuneCountInString(displayName) && utf8.RuneCountInString(displayName) <= 24
+}
+
 func generatePasswordHash(password string) (string, error) {
 	hashed, err := bcrypt.GenerateFromPassword([]byte(password), 11)
 	if err != nil {
@@ -366,52 +513,69 @@ func getFavoritesCountByPlaylistID(ctx context.Context, db connOrTx, playlistID
 	return count, nil
 }
 
-func getSongsCountByPlaylistID(ctx context.Context, db connOrTx, playlistID int) (int, error) {
-	var count int
+// 曲数と合計再生時間(秒)を一度に集計する 非公開の曲は数えない
+// スマートプレイリストは getSmartPlaylistSongsCountsAndDurations で集計する
+func getSongsCountAndDurationByPlaylistID(ctx context.Context, db connOrTx, playlistID int) (int, int, error) {
+	var result struct {
+		Count    int `db:"cnt"`
+		Duration int `db:"duration"`
+	}
 	if err := db.GetContext(
 		ctx,
-		&count,
-		"SELECT COUNT(*) AS cnt FROM playlist_song where playlist_id = ?",
-		playlistID,
+		&result,
+		"SELECT COUNT(*) AS cnt, COALESCE(SUM(song.duration), 0) AS duration FROM playlist_song JOIN song ON song.id = playlist_song.song_id where playlist_song.playlist_id = ? AND song.is_public = ?",
+		playlistID, true,
 	); err != nil {
-		return 0, fmt.Errorf(
+		return 0, 0, fmt.Errorf(
 			"error Get count of playlist_song by playlist_id=%d: %w",
 			playlistID, err,
 		)
 	}
-	return count, nil
+	return result.Count, result.Duration, nil
 }
 
-func getRecentPlaylistSummaries(ctx context.Context, db connOrTx, userAccount string) ([]Playlist, error) {
-	var allPlaylists []PlaylistRow
-	if err := db.SelectContext(
-		ctx,
-		&allPlaylists,
-		"SELECT * FROM playlist where is_public = ? ORDER BY created_at DESC",
-		true,
-	); err != nil {
-		return nil, fmt.Errorf(
-			"error Select playlist by is_public=true: %w",
-			err,
-		)
+// 一覧に載せるプレイリストと、その作成者
+type playlistSummarySource struct {
+	playlist *PlaylistRow
+	user     *UserRow
+}
+
+// 一覧用の情報を組み立てる
+// スマートプレイリストの条件と曲数、タグ、コメント数は1ページ分をまとめて読む
+func buildPlaylistSummaries(ctx context.Context, db connOrTx, sources []playlistSummarySource, userAccount string) ([]Playlist, error) {
+	playlistIDs := make([]int, 0, len(sources))
+	for _, source := range sources {
+		playlistIDs = append(playlistIDs, source.playlist.ID)
 	}
-	if len(allPlaylists) == 0 {
-		return nil, nil
+	rulesByPlaylistID, err := getSmartPlaylistRulesByPlaylistIDs(ctx, db, playlistIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error getSmartPlaylistRulesByPlaylistIDs: %w", err)
 	}
-
-	playlists := make([]Playlist, 0, len(allPlaylists))
-	for _, playlist := range allPlaylists {
-		user, err := getUserByAccount(ctx, db, playlist.UserAccount)
-		if err != nil {
-			return nil, fmt.Errorf("error getUserByAccount: %w", err)
-		}
-		if user == nil || user.IsBan {
-			continue
-		}
-
-		songCount, err := getSongsCountByPlaylistID(ctx, db, playlist.ID)
-		if err != nil {
-			return nil, fmt.Errorf("error getSongsCountByPlaylistID: %w", err)
+	smartSongsCounts, err := getSmartPlaylistSongsCountsAndDurations(ctx, db, rulesByPlaylistID)
+	if err != nil {
+		return nil, fmt.Errorf("error getSmartPlaylistSongsCountsAndDurations: %w", err)
+	}
+	tagsByPlaylistID, err := getPlaylistTagsByPlaylistIDs(ctx, db, playlistIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error getPlaylistTagsByPlaylistIDs: %w", err)
+	}
+	commentCounts, err := getCommentsCountsByPlaylistIDs(ctx, db, playlistIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error getCommentsCountsByPlaylistIDs: %w", err)
+	}
+
+	playlists := make([]Playlist, 0, len(sources))
+	for _, source := range sources {
+		playlist := source.playlist
+		var songCount, duration int
+		if _, ok := rulesByPlaylistID[playlist.ID]; ok {
+			songCount = smartSongsCounts[playlist.ID].Count
+			duration = smartSongsCounts[playlist.ID].Duration
+		} else {
+			songCount, duration, err = getSongsCountAndDurationByPlaylistID(ctx, db, playlist.ID)
+			if err != nil {
+				return nil, fmt.Errorf("error getSongsCountAndDurationByPlaylistID: %w", err)
+			}
 		}
 		favoriteCount, err := getFavoritesCountByPlaylistID(ctx, db, playlist.ID)
 		if err != nil {
@@ -420,7 +584,7 @@ func getRecentPlaylistSummaries(ctx context.Context, db connOrTx, userAccount st
 
 		var isFavorited bool
 		if userAccount != anonUserAccount {
-			var err error
+			// 認証済みの場合はfavを取得
 			isFavorited, err = isFavoritedBy(ctx, db, userAccount, playlist.ID)
 			if err != nil {
 				return nil, fmt.Errorf("error isFavoritedBy: %w", err)
@@ -430,20 +594,56 @@ func getRecentPlaylistSummaries(ctx context.Context, db connOrTx, userAccount st
 		playlists = append(playlists, Playlist{
 			ULID:            playlist.ULID,
 			Name:            playlist.Name,
-			UserDisplayName: user.DisplayName,
-			UserAccount:     user.Account,
+			UserDisplayName: source.user.DisplayName,
+			UserAccount:     source.user.Account,
 			SongCount:       songCount,
+			Duration:        duration,
 			FavoriteCount:   favoriteCount,
 			IsFavorited:     isFavorited,
 			IsPublic:        playlist.IsPublic,
+			Tags:            tagsByPlaylistID[playlist.ID],
+			CommentCount:    commentCounts[playlist.ID],
 			CreatedAt:       playlist.CreatedAt,
 			UpdatedAt:       playlist.UpdatedAt,
 		})
-		if len(playlists) >= 100 {
+	}
+	return playlists, nil
+}
+
+func getRecentPlaylistSummaries(ctx context.Context, db connOrTx, userAccount string) ([]Playlist, error) {
+	var allPlaylists []PlaylistRow
+	if err := db.SelectContext(
+		ctx,
+		&allPlaylists,
+		"SELECT * FROM playlist where is_public = ? AND is_hidden = ? ORDER BY created_at DESC",
+		true, false,
+	); err != nil {
+		return nil, fmt.Errorf(
+			"error Select playlist by is_public=true: %w",
+			err,
+		)
+	}
+	if len(allPlaylists) == 0 {
+		return nil, nil
+	}
+
+	sources := make([]playlistSummarySource, 0, 100)
+	for i := range allPlaylists {
+		playlist := &allPlaylists[i]
+		user, err := getUserByAccount(ctx, db, playlist.UserAccount)
+		if err != nil {
+			return nil, fmt.Errorf("error getUserByAccount: %w", err)
+		}
+		if user == nil || user.IsBan {
+			continue
+		}
+
+		sources = append(sources, playlistSummarySource{playlist: playlist, user: user})
+		if len(sources) >= 100 {
 			break
 		}
 	}
-	return playlists, nil
+	return buildPlaylistSummaries(ctx, db, sources, userAccount)
 }
 
 func getPopularPlaylistSummaries(ctx context.Context, db connOrTx, userAccount string) ([]Playlist, error) {
@@ -465,14 +665,14 @@ func getPopularPlaylistSummaries(ctx context.Context, db connOrTx, userAccount s
 	if len(popular) == 0 {
 		return nil, nil
 	}
-	playlists := make([]Playlist, 0, len(popular))
+	sources := make([]playlistSummarySource, 0, 100)
 	for _, p := range popular {
 		playlist, err := getPlaylistByID(ctx, db, p.PlaylistID)
 		if err != nil {
 			return nil, fmt.Errorf("error getPlaylistByID: %w", err)
 		}
-		// 非公開プレイリストは除外
-		if playlist == nil || !playlist.IsPublic {
+		// 非公開、管理者によって非表示にされたプレイリストは除外
+		if playlist == nil || !playlist.IsPublic || playlist.IsHidden {
 			continue
 		}
 
@@ -485,42 +685,12 @@ func getPopularPlaylistSummaries(ctx context.Context, db connOrTx, userAccount s
 			continue
 		}
 
-		songCount, err := getSongsCountByPlaylistID(ctx, db, playlist.ID)
-		if err != nil {
-			return nil, fmt.Errorf("error getSongsCountByPlaylistID: %w", err)
-		}
-		favoriteCount, err := getFavoritesCountByPlaylistID(ctx, db, playlist.ID)
-		if err != nil {
-			return nil, fmt.Errorf("error getFavoritesCountByPlaylistID: %w", err)
-		}
-
-		var isFavorited bool
-		if userAccount != anonUserAccount {
-			// 認証済みの場合はfavを取得
-			var err error
-			isFavorited, err = isFavoritedBy(ctx, db, userAccount, playlist.ID)
-			if err != nil {
-				return nil, fmt.Errorf("error isFavoritedBy: %w", err)
-			}
-		}
-
-		playlists = append(playlists, Playlist{
-			ULID:            playlist.ULID,
-			Name:            playlist.Name,
-			UserDisplayName: user.DisplayName,
-			UserAccount:     user.Account,
-			SongCount:       songCount,
-			FavoriteCount:   favoriteCount,
-			IsFavorited:     isFavorited,
-			IsPublic:        playlist.IsPublic,
-			CreatedAt:       playlist.CreatedAt,
-			UpdatedAt:       playlist.UpdatedAt,
-		})
-		if len(playlists) >= 100 {
+		sources = append(sources, playlistSummarySource{playlist: playlist, user: user})
+		if len(sources) >= 100 {
 			break
 		}
 	}
-	return playlists, nil
+	return buildPlaylistSummaries(ctx, db, sources, userAccount)
 }
 
 func getCreatedPlaylistSummariesByUserAccount(ctx context.Context, db connOrTx, userAccount string) ([]Playlist, error) {
@@ -548,32 +718,20 @@ func getCreatedPlaylistSummariesByUserAccount(ctx context.Context, db connOrTx,
 		return nil, nil
 	}
 
-	results := make([]Playlist, 0, len(playlists))
-	for _, row := range playlists {
-		songCount, err := getSongsCountByPlaylistID(ctx, db, row.ID)
-		if err != nil {
-			return nil, fmt.Errorf("error getSongsCountByPlaylistID: %w", err)
-		}
-		favoriteCount, err := getFavoritesCountByPlaylistID(ctx, db, row.ID)
-		if err != nil {
-			return nil, fmt.Errorf("error getFavoritesCountByPlaylistID: err=%w", err)
-		}
-		isFavorited, err := isFavoritedBy(ctx, db, userAccount, row.ID)
-		if err != nil {
-			return nil, fmt.Errorf("error isFavoritedBy: %w", err)
-		}
-		results = append(results, Playlist{
-			ULID:            row.ULID,
-			Name:            row.Name,
-			UserDisplayName: user.DisplayName,
-			UserAccount:     user.Account,
-			SongCount:       songCount,
-			FavoriteCount:   favoriteCount,
-			IsFavorited:     isFavorited,
-			IsPublic:        row.IsPublic,
-			CreatedAt:       row.CreatedAt,
-			UpdatedAt:       row.UpdatedAt,
-		})
+	sources := make([]playlistSummarySource, 0, len(playlists))
+	for i := range playlists {
+		sources = append(sources, playlistSummarySource{playlist: &playlists[i], user: user})
+	}
+	results, err := buildPlaylistSummaries(ctx, db, sources, userAccount)
+	if err != nil {
+		return nil, err
+	}
+	// 作成者自身の一覧なので、限定公開やモデレーションの状態も返す
+	for i := range results {
+		row := &playlists[i]
+		results[i].IsUnlisted = row.IsUnlisted
+		results[i].ShareToken = getPlaylistShareToken(row, userAccount)
+		results[i].Moderation = getPlaylistModeration(row, userAccount)
 	}
 
 	return results, nil
@@ -593,14 +751,14 @@ func getFavoritedPlaylistSummariesByUserAccount(ctx context.Context, db connOrTx
 		)
 	}
 
-	playlists := make([]Playlist, 0, 100)
+	sources := make([]playlistSummarySource, 0, 100)
 	for _, fav := range playlistFavorites {
 		playlist, err := getPlaylistByID(ctx, db, fav.PlaylistID)
 		if err != nil {
 			return nil, fmt.Errorf("error getPlaylistByID: %w", err)
 		}
-		// 非公開は除外する
-		if playlist == nil || !playlist.IsPublic {
+		// 非公開、管理者によって非表示にされたものは除外する
+		if playlist == nil || !playlist.IsPublic || playlist.IsHidden {
 			continue
 		}
 		user, err := getUserByAccount(ctx, db, playlist.UserAccount)
@@ -613,36 +771,33 @@ func getFavoritedPlaylistSummariesByUserAccount(ctx context.Context, db connOrTx
 			return nil, nil
 		}
 
-		songCount, err := getSongsCountByPlaylistID(ctx, db, playlist.ID)
-		if err != nil {
-			return nil, fmt.Errorf("error getSongsCountByPlaylistID: %w", err)
+		sources = append(sources, playlistSummarySource{playlist: playlist, user: user})
+		if len(sources) >= 100 {
+			break
 		}
-		favoriteCount, err := getFavoritesCountByPlaylistID(ctx, db, playlist.ID)
+	}
+
+	return buildPlaylistSummaries(ctx, db, sources, userAccount)
+}
+
+// 公開中のプレイリストの一覧用の情報を返す 作成者がbanされているものは除き、最大limit件まで返す
+func getPublicPlaylistSummaries(ctx context.Context, db connOrTx, rows []PlaylistRow, userAccount string, limit int) ([]Playlist, error) {
+	sources := make([]playlistSummarySource, 0, limit)
+	for i := range rows {
+		playlist := &rows[i]
+		user, err := getUserByAccount(ctx, db, playlist.UserAccount)
 		if err != nil {
-			return nil, fmt.Errorf("error getFavoritesCountByPlaylistID: err=%w", err)
+			return nil, fmt.Errorf("error getUserByAccount: %w", err)
 		}
-		isFavorited, err := isFavoritedBy(ctx, db, userAccount, playlist.ID)
-		if err != nil {
-			return nil, fmt.Errorf("error isFavoritedBy: %w", err)
+		if user == nil || user.IsBan {
+			continue
 		}
-		playlists = append(playlists, Playlist{
-			ULID:            playlist.ULID,
-			Name:            playlist.Name,
-			UserDisplayName: user.DisplayName,
-			UserAccount:     user.Account,
-			SongCount:       songCount,
-			FavoriteCount:   favoriteCount,
-			IsFavorited:     isFavorited,
-			IsPublic:        playlist.IsPublic,
-			CreatedAt:       playlist.CreatedAt,
-			UpdatedAt:       playlist.UpdatedAt,
-		})
-		if len(playlists) >= 100 {
+		sources = append(sources, playlistSummarySource{playlist: playlist, user: user})
+		if len(sources) >= limit {
 			break
 		}
 	}
-
-	return playlists, nil
+	return buildPlaylistSummaries(ctx, db, sources, userAccount)
 }
 
 func getPlaylistDetailByPlaylistULID(ctx context.Context, db connOrTx, playlistULID string, viewerUserAccount *string) (*PlaylistDetail, error) {
@@ -653,6 +808,14 @@ func getPlaylistDetailByPlaylistULID(ctx context.Context, db connOrTx, playlistU
 	if playlist == nil {
 		return nil, nil
 	}
+	// 管理者によって非表示にされたプレイリストは作成者しか見れない
+	var viewer string
+	if viewerUserAccount != nil {
+		viewer = *viewerUserAccount
+	}
+	if playlist.IsHidden && playlist.UserAccount != viewer {
+		return nil, nil
+	}
 
 	user, err := getUserByAccount(ctx, db, playlist.UserAccount)
 	if err != nil {
@@ -675,6 +838,19 @@ func getPlaylistDetailByPlaylistULID(ctx context.Context, db connOrTx, playlistU
 		}
 	}
 
+	// スマートプレイリストは条件を評価して曲を決める
+	rules, err := getSmartPlaylistRules(ctx, db, playlist.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error getSmartPlaylistRules: %w", err)
+	}
+	var smartSongs []SongWithArtistRow
+	if rules != nil {
+		smartSongs, err = getSmartPlaylistSongs(ctx, db, rules)
+		if err != nil {
+			return nil, fmt.Errorf("error getSmartPlaylistSongs: %w", err)
+		}
+	}
+
 	var resPlaylistSongs []PlaylistSongRow
 	if err := db.SelectContext(
 		ctx,
@@ -688,7 +864,14 @@ func getPlaylistDetailByPlaylistULID(ctx context.Context, db connOrTx, playlistU
 		)
 	}
 
-	songs := make([]Song, 0, len(resPlaylistSongs))
+	songs := make([]Song, 0, len(resPlaylistSongs)+len(smartSongs))
+	songCount := 0
+	duration := 0
+	for _, row := range smartSongs {
+		songs = append(songs, toSong(&row.SongRow, &ArtistRow{Name: row.ArtistName}))
+		songCount++
+		duration += row.Duration
+	}
 	for _, row := range resPlaylistSongs {
 		var song SongRow
 		if err := db.GetContext(
@@ -699,6 +882,14 @@ func getPlaylistDetailByPlaylistULID(ctx context.Context, db connOrTx, playlistU
 		); err != nil {
 			return nil, fmt.Errorf("error Get song by id=%d: %w", row.SongID, err)
 		}
+		// 非公開の曲は作成者にだけ is_public=false として見せる
+		if !song.IsPublic && playlist.UserAccount != viewer {
+			continue
+		}
+		if song.IsPublic {
+			songCount++
+			duration += song.Duration
+		}
 
 		var artist ArtistRow
 		if err := db.GetContext(
@@ -710,14 +901,20 @@ func getPlaylistDetailByPlaylistULID(ctx context.Context, db connOrTx, playlistU
 			return nil, fmt.Errorf("error Get artist by id=%d: %w", song.ArtistID, err)
 		}
 
-		songs = append(songs, Song{
-			ULID:        song.ULID,
-			Title:       song.Title,
-			Artist:      artist.Name,
-			Album:       song.Album,
-			TrackNumber: song.TrackNumber,
-			IsPublic:    song.IsPublic,
-		})
+		songs = append(songs, toSong(&song, &artist))
+	}
+
+	tags, err := getPlaylistTags(ctx, db, playlist.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error getPlaylistTags: %w", err)
+	}
+	playCount, err := getPlayCountByPlaylistID(ctx, db, playlist.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error getPlayCountByPlaylistID: %w", err)
+	}
+	commentCount, err := getCommentsCountByPlaylistID(ctx, db, playlist.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error getCommentsCountByPlaylistID: %w", err)
 	}
 
 	return &PlaylistDetail{
@@ -726,14 +923,24 @@ func getPlaylistDetailByPlaylistULID(ctx context.Context, db connOrTx, playlistU
 			Name:            playlist.Name,
 			UserDisplayName: user.DisplayName,
 			UserAccount:     user.Account,
-			SongCount:       len(songs),
+			SongCount:       songCount,
+			Duration:        duration,
 			FavoriteCount:   favoriteCount,
 			IsFavorited:     isFavorited,
 			IsPublic:        playlist.IsPublic,
+			IsUnlisted:      playlist.IsUnlisted,
+			ShareToken:      getPlaylistShareToken(playlist, viewer),
+			Tags:            tags,
+			CommentCount:    commentCount,
 			CreatedAt:       playlist.CreatedAt,
 			UpdatedAt:       playlist.UpdatedAt,
+			Moderation:      getPlaylistModeration(playlist, viewer),
 		},
-		Songs: songs,
+		Songs:         songs,
+		TotalDuration: duration,
+		SmartRules:    rules,
+		Description:   playlist.Description,
+		PlayCount:     playCount,
 	}, nil
 }
 
@@ -776,11 +983,12 @@ func getUserByAccount(ctx context.Context, db connOrTx, account string) (*UserRo
 	return &result, nil
 }
 
-func insertPlaylistSong(ctx context.Context, db connOrTx, playlistID, sortOrder, songID int) error {
+// createdAt はプレイリストに曲を追加した日時 並べ替えなどで入れ直すときは元の日時を渡す
+func insertPlaylistSong(ctx context.Context, db connOrTx, playlistID, sortOrder, songID int, createdAt time.Time) error {
 	if _, err := db.ExecContext(
 		ctx,
-		"INSERT INTO playlist_song (`playlist_id`, `sort_order`, `song_id`) VALUES (?, ?, ?)",
-		playlistID, sortOrder, songID,
+		"INSERT INTO playlist_song (`playlist_id`, `sort_order`, `song_id`, `created_at`) VALUES (?, ?, ?, ?)",
+		playlistID, sortOrder, songID, createdAt,
 	); err != nil {
 		return fmt.Errorf(
 			"error Insert playlist_song by playlist_id=%d, sort_order=%d, song_id=%d: %w",
@@ -790,6 +998,7 @@ func insertPlaylistSong(ctx context.Context, db connOrTx, playlistID, sortOrder,
 	return nil
 }
 
+// playlist_favorite_count も合わせて更新するので、トランザクションの中で呼ぶ
 func insertPlaylistFavorite(ctx context.Context, db connOrTx, playlistID int, favoriteUserAccount string, createdAt time.Time) error {
 	if _, err := db.ExecContext(
 		ctx,
@@ -801,6 +1010,61 @@ func insertPlaylistFavorite(ctx context.Context, db connOrTx, playlistID int, fa
 			playlistID, favoriteUserAccount, createdAt, err,
 		)
 	}
+	if _, err := db.ExecContext(
+		ctx,
+		"INSERT INTO playlist_favorite_count (`playlist_id`, `favorite_count`) VALUES (?, 1)"+
+			" ON DUPLICATE KEY UPDATE `favorite_count` = `favorite_count` + 1",
+		playlistID,
+	); err != nil {
+		return fmt.Errorf("error Insert playlist_favorite_count by playlist_id=%d: %w", playlistID, err)
+	}
+	return nil
+}
+
+// playlist_favorite_count も合わせて更新するので、トランザクションの中で呼ぶ
+func deletePlaylistFavorite(ctx context.Context, db connOrTx, playlistID int, favoriteUserAccount string) error {
+	result, err := db.ExecContext(
+		ctx,
+		"DELETE FROM playlist_favorite WHERE `playlist_id` = ? AND `favorite_user_account` = ?",
+		playlistID, favoriteUserAccount,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"error Delete playlist_favorite by playlist_id=%d, favorite_user_account=%s: %w",
+			playlistID, favoriteUserAccount, err,
+		)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error RowsAffected: %w", err)
+	}
+	if deleted == 0 {
+		return nil
+	}
+	if _, err := db.ExecContext(
+		ctx,
+		"UPDATE playlist_favorite_count SET `favorite_count` = `favorite_count` - ? WHERE `playlist_id` = ?",
+		deleted, playlistID,
+	); err != nil {
+		return fmt.Errorf("error Update playlist_favorite_count by playlist_id=%d: %w", playlistID, err)
+	}
+	return nil
+}
+
+func updateUserIsBan(ctx context.Context, db connOrTx, account string, isBan bool) error {
+	if _, err := db.ExecContext(
+		ctx,
+		"UPDATE user SET `is_ban` = ?  WHERE `account` = ?",
+		isBan, account,
+	); err != nil {
+		return fmt.Errorf("error Update user by is_ban=%t, account=%s: %w", isBan, account, err)
+	}
+	// banしたユーザーはすぐにログアウトさせる
+	if isBan {
+		if err := revokeUserSessions(ctx, db, account); err != nil {
+			return fmt.Errorf("error revokeUserSessions: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -817,19 +1081,13 @@ func apiSignupHandler(c echo.Context) error {
 	displayName := signupRequest.DisplayName
 
 	// validation
-	if userAccount == "" || len(userAccount) < 4 || 191 < len(userAccount) {
-		return errorResponse(c, 400, "bad user_account")
-	}
-	if matched, _ := regexp.MatchString(`[^a-zA-Z0-9\-_]`, userAccount); matched {
+	if !isValidUserAccount(userAccount) {
 		return errorResponse(c, 400, "bad user_account")
 	}
-	if password == "" || len(password) < 8 || 64 < len(password) {
-		return errorResponse(c, 400, "bad password")
-	}
-	if matched, _ := regexp.MatchString(`[^a-zA-Z0-9\-_]`, password); matched {
+	if !isValidPassword(password) {
 		return errorResponse(c, 400, "bad password")
 	}
-	if displayName == "" || utf8.RuneCountInString(displayName) < 2 || 24 < utf8.RuneCountInString(displayName) {
+	if !isValidDisplayName(displayName) {
 		return errorResponse(c, 400, "bad display_name")
 	}
 
@@ -874,10 +1132,18 @@ func apiSignupHandler(c echo.Context) error {
 		return errorResponse(c, 500, "failed to signup")
 	}
 	sess.Values["user_account"] = userAccount
+	if err := issueCSRFToken(c, sess); err != nil {
+		c.Logger().Errorf("error issueCSRFToken: %s", err)
+		return errorResponse(c, 500, "failed to signup")
+	}
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
 		c.Logger().Errorf("error Save to session: %s", err)
 		return errorResponse(c, 500, "failed to signup")
 	}
+	if err := touchUserSession(c, conn, sess, userAccount); err != nil {
+		c.Logger().Errorf("error touchUserSession: %s", err)
+		return errorResponse(c, 500, "failed to signup")
+	}
 
 	body := BasicResponse{
 		Result: true,
@@ -903,16 +1169,10 @@ func apiLoginHandler(c echo.Context) error {
 	password := loginRequest.Password
 
 	// validation
-	if userAccount == "" || len(userAccount) < 4 || 191 < len(userAccount) {
-		return errorResponse(c, 400, "bad user_account")
-	}
-	if matched, _ := regexp.MatchString(`[^a-zA-Z0-9\-_]`, userAccount); matched {
+	if !isValidUserAccount(userAccount) {
 		return errorResponse(c, 400, "bad user_account")
 	}
-	if password == "" || len(password) < 8 || 64 < len(password) {
-		return errorResponse(c, 400, "bad password")
-	}
-	if matched, _ := regexp.MatchString(`[^a-zA-Z0-9\-_]`, password); matched {
+	if !isValidPassword(password) {
 		return errorResponse(c, 400, "bad password")
 	}
 
@@ -931,9 +1191,14 @@ func apiLoginHandler(c echo.Context) error {
 		return errorResponse(c, 500, "failed to login (server error)")
 	}
 	if user == nil || user.IsBan {
-		// ユーザがいないかbanされている
+		// ユーザがいないかbanされている パスワードの総当たりではないので失敗には数えない
 		return errorResponse(c, 401, "failed to login (no such user)")
 	}
+	// 失敗が続いているアカウントかIPアドレスなら、パスワードを確かめずに断る
+	if wait := getLoginLockout(c, userAccount); 0 < wait {
+		setRetryAfter(c, wait)
+		return errorResponse(c, http.StatusTooManyRequests, "too many login attempts")
+	}
 
 	matched, err := comparePasswordHash(password, user.PasswordHash)
 	if err != nil {
@@ -942,8 +1207,10 @@ func apiLoginHandler(c echo.Context) error {
 	}
 	if !matched {
 		// wrong password
+		recordLoginFailure(c, userAccount)
 		return errorResponse(c, 401, "failed to login (wrong password)")
 	}
+	recordLoginSuccess(userAccount)
 
 	now := time.Now()
 	if _, err := conn.ExecContext(
@@ -961,10 +1228,18 @@ func apiLoginHandler(c echo.Context) error {
 		return errorResponse(c, 500, "failed to login (server error)")
 	}
 	sess.Values["user_account"] = userAccount
+	if err := issueCSRFToken(c, sess); err != nil {
+		c.Logger().Errorf("error issueCSRFToken: %s", err)
+		return errorResponse(c, 500, "failed to login (server error)")
+	}
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
 		c.Logger().Errorf("error Save to session: %s", err)
 		return errorResponse(c, 500, "failed to login (server error)")
 	}
+	if err := touchUserSession(c, conn, sess, userAccount); err != nil {
+		c.Logger().Errorf("error touchUserSession: %s", err)
+		return errorResponse(c, 500, "failed to login (server error)")
+	}
 
 	body := BasicResponse{
 		Result: true,
@@ -986,11 +1261,16 @@ func apiLogoutHandler(c echo.Context) error {
 		c.Logger().Errorf("error getSession:  %s", err)
 		return errorResponse(c, 500, "failed to logout (server error)")
 	}
+	if err := revokeCurrentSession(c.Request().Context(), db, sess); err != nil {
+		c.Logger().Errorf("error revokeCurrentSession:  %s", err)
+		return errorResponse(c, 500, "failed to logout (server error)")
+	}
 	sess.Options.MaxAge = -1
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
 		c.Logger().Errorf("error Save session:  %s", err)
 		return errorResponse(c, 500, "failed to logout (server error)")
 	}
+	clearCSRFCookie(c)
 
 	body := BasicResponse{
 		Result: true,
@@ -1007,16 +1287,11 @@ func apiLogoutHandler(c echo.Context) error {
 // GET /api/recent_playlists
 
 func apiRecentPlaylistsHandler(c echo.Context) error {
-	sess, err := getSession(c.Request())
+	userAccount, err := getViewerUserAccount(c)
 	if err != nil {
-		c.Logger().Errorf("error getSession:  %s", err)
+		c.Logger().Errorf("error getViewerUserAccount: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
-	userAccount := anonUserAccount
-	_account, ok := sess.Values["user_account"]
-	if ok {
-		userAccount = _account.(string)
-	}
 
 	ctx := c.Request().Context()
 	conn, err := db.Connx(ctx)
@@ -1050,16 +1325,11 @@ func apiRecentPlaylistsHandler(c echo.Context) error {
 // GET /api/popular_playlists
 
 func apiPopularPlaylistsHandler(c echo.Context) error {
-	sess, err := getSession(c.Request())
+	userAccount, err := getViewerUserAccount(c)
 	if err != nil {
-		c.Logger().Errorf("error getSession:  %s", err)
+		c.Logger().Errorf("error getViewerUserAccount: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
-	userAccount := anonUserAccount
-	_account, ok := sess.Values["user_account"]
-	if ok {
-		userAccount = _account.(string)
-	}
 
 	ctx := c.Request().Context()
 	conn, err := db.Connx(ctx)
@@ -1101,21 +1371,15 @@ func apiPopularPlaylistsHandler(c echo.Context) error {
 // GET /api/playlists
 
 func apiPlaylistsHandler(c echo.Context) error {
-	_, valid, err := validateSession(c)
+	user, ok, err := validateSession(c)
 	if err != nil {
 		c.Logger().Errorf("error validateSession: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
-	if !valid {
+	if !ok || user == nil {
 		return errorResponse(c, 401, "login required")
 	}
-	sess, err := getSession(c.Request())
-	if err != nil {
-		c.Logger().Errorf("error getSession:  %s", err)
-		return errorResponse(c, 500, "internal server error")
-	}
-	_account := sess.Values["user_account"]
-	userAccount := _account.(string)
+	userAccount := user.Account
 
 	ctx := c.Request().Context()
 	conn, err := db.Connx(ctx)
@@ -1159,16 +1423,11 @@ func apiPlaylistsHandler(c echo.Context) error {
 
 func apiPlaylistHandler(c echo.Context) error {
 	// ログインは不要
-	sess, err := getSession(c.Request())
+	userAccount, err := getViewerUserAccount(c)
 	if err != nil {
-		c.Logger().Errorf("error getSession:  %s", err)
+		c.Logger().Errorf("error getViewerUserAccount: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
-	userAccount := anonUserAccount
-	_account, ok := sess.Values["user_account"]
-	if ok {
-		userAccount = _account.(string)
-	}
 	playlistULID := c.Param("playlistUlid")
 
 	// validation
@@ -1197,7 +1456,8 @@ func apiPlaylistHandler(c echo.Context) error {
 	}
 
 	// 作成者が自分ではない、privateなプレイリストは見れない
-	if playlist.UserAccount != userAccount && !playlist.IsPublic {
+	// 限定公開ならshare_tokenが一致すれば見れる
+	if !canViewPlaylist(playlist, userAccount, c.QueryParam("share_token")) {
 		return errorResponse(c, 404, "playlist not found")
 	}
 
@@ -1228,12 +1488,12 @@ func apiPlaylistHandler(c echo.Context) error {
 // POST /api/playlist/add
 
 func apiPlaylistAddHandler(c echo.Context) error {
-	_, valid, err := validateSession(c)
+	user, ok, err := validateSession(c)
 	if err != nil {
 		c.Logger().Errorf("error validateSession: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
-	if !valid {
+	if !ok || user == nil {
 		return errorResponse(c, 401, "login required")
 	}
 
@@ -1246,14 +1506,16 @@ func apiPlaylistAddHandler(c echo.Context) error {
 	if name == "" || utf8.RuneCountInString(name) < 2 || 191 < utf8.RuneCountInString(name) {
 		return errorResponse(c, 400, "invalid name")
 	}
-
-	sess, err := getSession(c.Request())
+	if err := validateDescription(addPlaylistRequest.Description); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+	description := sanitizeDescription(addPlaylistRequest.Description)
+	tags, err := normalizeTags(addPlaylistRequest.Tags)
 	if err != nil {
-		c.Logger().Errorf("error getSession: %s", err)
-		return errorResponse(c, 500, "internal server error")
+		return errorResponse(c, 400, err.Error())
 	}
-	_account := sess.Values["user_account"]
-	userAccount := _account.(string)
+
+	userAccount := user.Account
 	createTimestamp := time.Now()
 	playlistULID, err := ulid.New(ulid.Timestamp(createTimestamp), entropy)
 	if err != nil {
@@ -1269,17 +1531,41 @@ func apiPlaylistAddHandler(c echo.Context) error {
 	}
 	defer conn.Close()
 
-	if _, err := conn.ExecContext(
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Errorf("error conn.BeginTxx: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	res, err := tx.ExecContext(
 		ctx,
-		"INSERT INTO playlist (`ulid`, `name`, `user_account`, `is_public`, `created_at`, `updated_at`) VALUES (?, ?, ?, ?, ?, ?)",
-		playlistULID.String(), name, userAccount, false, createTimestamp, createTimestamp, // 作成時は非公開
-	); err != nil {
+		"INSERT INTO playlist (`ulid`, `name`, `description`, `user_account`, `is_public`, `created_at`, `updated_at`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		playlistULID.String(), name, description, userAccount, false, createTimestamp, createTimestamp, // 作成時は非公開
+	)
+	if err != nil {
+		tx.Rollback()
 		c.Logger().Errorf(
 			"error Insert playlist by ulid=%s, name=%s, user_account=%s, is_public=%t, created_at=%s, updated_at=%s: %s",
 			playlistULID, name, userAccount, false, createTimestamp, createTimestamp,
 		)
 		return errorResponse(c, 500, "internal server error")
 	}
+	if len(tags) > 0 {
+		playlistID, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			c.Logger().Errorf("error LastInsertId: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		if err := replacePlaylistTags(ctx, tx, int(playlistID), tags, createTimestamp); err != nil {
+			tx.Rollback()
+			c.Logger().Errorf("error replacePlaylistTags: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("error tx.Commit: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
 
 	body := AddPlaylistResponse{
 		BasicResponse: BasicResponse{
@@ -1299,21 +1585,15 @@ func apiPlaylistAddHandler(c echo.Context) error {
 // POST /api/playlist/update
 
 func apiPlaylistUpdateHandler(c echo.Context) error {
-	_, valid, err := validateSession(c)
+	user, ok, err := validateSession(c)
 	if err != nil {
 		c.Logger().Errorf("error validateSession: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
-	if !valid {
+	if !ok || user == nil {
 		return errorResponse(c, 401, "login required")
 	}
-	sess, err := getSession(c.Request())
-	if err != nil {
-		c.Logger().Errorf("error getSession: %s", err)
-		return errorResponse(c, 500, "internal server error")
-	}
-	_account := sess.Values["user_account"]
-	userAccount := _account.(string)
+	userAccount := user.Account
 
 	ctx := c.Request().Context()
 	conn, err := db.Connx(ctx)
@@ -1345,6 +1625,11 @@ func apiPlaylistUpdateHandler(c echo.Context) error {
 	name := updatePlaylistRequest.Name
 	songULIDs := updatePlaylistRequest.SongULIDs
 	isPublic := updatePlaylistRequest.IsPublic
+	// 指定されなければ今の状態のままにする 公開にしたときは限定公開ではなくなる
+	isUnlisted := playlist.IsUnlisted && !isPublic
+	if updatePlaylistRequest.IsUnlisted != nil {
+		isUnlisted = *updatePlaylistRequest.IsUnlisted
+	}
 	// validation
 	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", playlistULID); matched {
 		return errorResponse(c, 404, "bad playlist ulid")
@@ -1369,6 +1654,52 @@ func apiPlaylistUpdateHandler(c echo.Context) error {
 	if len(songULIDsSet) != len(songULIDs) {
 		return errorResponse(c, 400, "invalid song_ulids")
 	}
+	description := playlist.Description
+	if updatePlaylistRequest.Description != nil {
+		if err := validateDescription(*updatePlaylistRequest.Description); err != nil {
+			return errorResponse(c, 400, err.Error())
+		}
+		description = sanitizeDescription(*updatePlaylistRequest.Description)
+	}
+	var tags []string
+	if updatePlaylistRequest.Tags != nil {
+		tags, err = normalizeTags(updatePlaylistRequest.Tags)
+		if err != nil {
+			return errorResponse(c, 400, err.Error())
+		}
+	}
+	// 公開と限定公開は同時に指定できない
+	if isPublic && isUnlisted {
+		return errorResponse(c, 400, "is_public and is_unlisted can not be both true")
+	}
+	// 管理者の措置が解除されるまでは公開、限定公開に戻せない
+	if playlist.IsLocked && ((isPublic && !playlist.IsPublic) || (isUnlisted && !playlist.IsUnlisted)) {
+		return errorResponse(c, 403, "playlist is locked by moderation")
+	}
+	// スマートプレイリストの曲は条件で決まるので指定できない
+	if len(songULIDs) > 0 {
+		rules, err := getSmartPlaylistRules(ctx, conn, playlist.ID)
+		if err != nil {
+			c.Logger().Errorf("error getSmartPlaylistRules: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		if rules != nil {
+			return errorResponse(c, 400, "songs of smart playlist can not be updated")
+		}
+	}
+
+	// 限定公開にしたときにshare_tokenを発行し、やめたときは無効にする
+	shareToken := ""
+	if isUnlisted {
+		shareToken = playlist.ShareToken
+		if shareToken == "" {
+			shareToken, err = generateShareToken()
+			if err != nil {
+				c.Logger().Errorf("error generateShareToken: %s", err)
+				return errorResponse(c, 500, "internal server error")
+			}
+		}
+	}
 
 	updatedTimestamp := time.Now()
 
@@ -1378,20 +1709,49 @@ func apiPlaylistUpdateHandler(c echo.Context) error {
 		return errorResponse(c, 500, "internal server error")
 	}
 
-	// name, is_publicの更新
+	// 非公開になった曲は、すでに入っている場合のみ残せる
+	// 残した曲は追加した日時も引き継ぐ
+	var currentSongs []PlaylistSongRow
+	if err := tx.SelectContext(
+		ctx,
+		&currentSongs,
+		"SELECT * FROM playlist_song WHERE playlist_id = ?",
+		playlist.ID,
+	); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf(
+			"error Select playlist_song by playlist_id=%d: %s",
+			playlist.ID, err,
+		)
+		return errorResponse(c, 500, "internal server error")
+	}
+	currentSongAddedAt := make(map[int]time.Time, len(currentSongs))
+	for _, row := range currentSongs {
+		currentSongAddedAt[row.SongID] = row.CreatedAt
+	}
+
+	// name, description, is_public, is_unlistedの更新
 	if _, err := tx.ExecContext(
 		ctx,
-		"UPDATE playlist SET name = ?, is_public = ?, `updated_at` = ? WHERE `ulid` = ?",
-		name, isPublic, updatedTimestamp, playlist.ULID,
+		"UPDATE playlist SET name = ?, description = ?, is_public = ?, is_unlisted = ?, share_token = ?, `updated_at` = ? WHERE `ulid` = ?",
+		name, description, isPublic, isUnlisted, shareToken, updatedTimestamp, playlist.ULID,
 	); err != nil {
 		tx.Rollback()
 		c.Logger().Errorf(
-			"error Update playlist by name=%s, is_public=%t, updated_at=%s, ulid=%s: %s",
-			name, isPublic, updatedTimestamp, playlist.ULID, err,
+			"error Update playlist by name=%s, is_public=%t, is_unlisted=%t, updated_at=%s, ulid=%s: %s",
+			name, isPublic, isUnlisted, updatedTimestamp, playlist.ULID, err,
 		)
 		return errorResponse(c, 500, "internal server error")
 	}
 
+	if tags != nil {
+		if err := replacePlaylistTags(ctx, tx, playlist.ID, tags, updatedTimestamp); err != nil {
+			tx.Rollback()
+			c.Logger().Errorf("error replacePlaylistTags: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+	}
+
 	// songsを削除→新しいものを入れる
 	if _, err := tx.ExecContext(
 		ctx,
@@ -1417,8 +1777,16 @@ func apiPlaylistUpdateHandler(c echo.Context) error {
 			tx.Rollback()
 			return errorResponse(c, 400, fmt.Sprintf("song not found. ulid: %s", songULID))
 		}
+		addedAt, ok := currentSongAddedAt[song.ID]
+		if !ok && !song.IsPublic {
+			tx.Rollback()
+			return errorResponse(c, 400, fmt.Sprintf("song is not public. ulid: %s", songULID))
+		}
+		if !ok {
+			addedAt = updatedTimestamp
+		}
 
-		if err := insertPlaylistSong(ctx, tx, playlist.ID, i+1, song.ID); err != nil {
+		if err := insertPlaylistSong(ctx, tx, playlist.ID, i+1, song.ID, addedAt); err != nil {
 			tx.Rollback()
 			c.Logger().Errorf("error insertPlaylistSong: %s", err)
 			return errorResponse(c, 500, "internal server error")
@@ -1429,6 +1797,13 @@ func apiPlaylistUpdateHandler(c echo.Context) error {
 		c.Logger().Errorf("error tx.Commit: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
+	// 更新は済んでいるので、通知に失敗してもエラーにはしない
+	if err := publishPlaylistChanged(ctx, conn, playlist); err != nil {
+		c.Logger().Errorf("error publishPlaylistChanged: %s", err)
+	}
+	if err := enqueuePlaylistChangedWebhooks(ctx, conn, playlist); err != nil {
+		c.Logger().Errorf("error enqueuePlaylistChangedWebhooks: %s", err)
+	}
 
 	playlistDetails, err := getPlaylistDetailByPlaylistULID(ctx, conn, playlist.ULID, &userAccount)
 	if err != nil {
@@ -1454,24 +1829,38 @@ func apiPlaylistUpdateHandler(c echo.Context) error {
 	return nil
 }
 
+// プレイリストとそれに付いたものを消す 途中で失敗したときに一部だけ残らないよう、トランザクションの中で呼ぶ
+func deletePlaylist(ctx context.Context, db connOrTx, playlist *PlaylistRow) error {
+	queries := []string{
+		"DELETE FROM playlist_song WHERE playlist_id = ?",
+		"DELETE FROM playlist_favorite WHERE playlist_id = ?",
+		"DELETE FROM playlist_smart_rule WHERE playlist_id = ?",
+		"DELETE FROM playlist_tag WHERE playlist_id = ?",
+		"DELETE FROM playlist_comment WHERE playlist_id = ?",
+		"DELETE FROM playlist_play_count WHERE playlist_id = ?",
+		"DELETE FROM playlist_favorite_count WHERE playlist_id = ?",
+		"DELETE FROM playlist WHERE id = ?",
+	}
+	for _, query := range queries {
+		if _, err := db.ExecContext(ctx, query, playlist.ID); err != nil {
+			return fmt.Errorf("error %s by id=%d: %w", query, playlist.ID, err)
+		}
+	}
+	return nil
+}
+
 // POST /api/playlist/delete
 
 func apiPlaylistDeleteHandler(c echo.Context) error {
-	_, valid, err := validateSession(c)
+	user, ok, err := validateSession(c)
 	if err != nil {
 		c.Logger().Errorf("error validateSession: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
-	if !valid {
+	if !ok || user == nil {
 		return errorResponse(c, 401, "login required")
 	}
-	sess, err := getSession(c.Request())
-	if err != nil {
-		c.Logger().Errorf("error getSession:  %s", err)
-		return errorResponse(c, 500, "internal server error")
-	}
-	_account := sess.Values["user_account"]
-	userAccount := _account.(string)
+	userAccount := user.Account
 
 	playlistULID := c.Param("playlistUlid")
 	// validation
@@ -1503,30 +1892,26 @@ func apiPlaylistDeleteHandler(c echo.Context) error {
 		return errorResponse(c, 400, "do not delete other users playlist")
 	}
 
-	if _, err := conn.ExecContext(
-		ctx,
-		"DELETE FROM playlist WHERE `ulid` = ?",
-		playlist.ULID,
-	); err != nil {
-		c.Logger().Errorf("error Delete playlist by ulid=%s: %s", playlist.ULID, err)
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Errorf("error conn.BeginTxx: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
-	if _, err := conn.ExecContext(
-		ctx,
-		"DELETE FROM playlist_song WHERE playlist_id = ?",
-		playlist.ID,
-	); err != nil {
-		c.Logger().Errorf("error Delete playlist_song by id=%s: %s", playlist.ID, err)
+	if err := deletePlaylist(ctx, tx, playlist); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error deletePlaylist: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
-	if _, err := conn.ExecContext(
-		ctx,
-		"DELETE FROM playlist_favorite WHERE playlist_id = ?",
-		playlist.ID,
-	); err != nil {
-		c.Logger().Errorf("error Delete playlist_favorite by id=%s: %s", playlist.ID, err)
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("error tx.Commit: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
+	if err := publishPlaylistDeleted(playlist); err != nil {
+		c.Logger().Errorf("error publishPlaylistDeleted: %s", err)
+	}
+	if err := enqueueWebhookEvent(ctx, conn, playlist.UserAccount, webhookEventPlaylistDeleted, toWebhookPlaylistData(playlist)); err != nil {
+		c.Logger().Errorf("error enqueueWebhookEvent: %s", err)
+	}
 
 	body := BasicResponse{
 		Result: true,
@@ -1551,13 +1936,7 @@ func apiPlaylistFavoriteHandler(c echo.Context) error {
 	if !ok || user == nil {
 		return errorResponse(c, 401, "login required")
 	}
-	sess, err := getSession(c.Request())
-	if err != nil {
-		c.Logger().Errorf("error getSession:  %s", err)
-		return errorResponse(c, 500, "internal server error")
-	}
-	_account := sess.Values["user_account"]
-	userAccount := _account.(string)
+	userAccount := user.Account
 
 	playlistULID := c.Param("playlistUlid")
 	var favoritePlaylistRequest FavoritePlaylistRequest
@@ -1589,9 +1968,9 @@ func apiPlaylistFavoriteHandler(c echo.Context) error {
 	if playlist == nil {
 		return errorResponse(c, 404, "playlist not found")
 	}
-	// 操作対象のプレイリストが他のユーザーの場合、banされているかプレイリストがprivateならばnot found
+	// 操作対象のプレイリストが他のユーザーの場合、banされているかプレイリストがprivateか非表示ならばnot found
 	if playlist.UserAccount != user.Account {
-		if user.IsBan || !playlist.IsPublic {
+		if user.IsBan || !playlist.IsPublic || playlist.IsHidden {
 			return errorResponse(c, 404, "playlist not found")
 		}
 	}
@@ -1607,24 +1986,46 @@ func apiPlaylistFavoriteHandler(c echo.Context) error {
 			return errorResponse(c, 500, "internal server error")
 		}
 		if playlistFavorite == nil {
-			if err := insertPlaylistFavorite(ctx, conn, playlist.ID, userAccount, createdTimestamp); err != nil {
+			tx, err := conn.BeginTxx(ctx, nil)
+			if err != nil {
+				c.Logger().Errorf("error conn.BeginTxx: %s", err)
+				return errorResponse(c, 500, "internal server error")
+			}
+			if err := insertPlaylistFavorite(ctx, tx, playlist.ID, userAccount, createdTimestamp); err != nil {
+				tx.Rollback()
 				c.Logger().Errorf("error insertPlaylistFavorite: %s", err)
 				return errorResponse(c, 500, "internal server error")
 			}
+			if err := tx.Commit(); err != nil {
+				c.Logger().Errorf("error tx.Commit: %s", err)
+				return errorResponse(c, 500, "internal server error")
+			}
+			// 自分のプレイリストへのお気に入りは通知しない
+			if playlist.UserAccount != userAccount {
+				if err := enqueuePlaylistFavoritedWebhooks(ctx, conn, playlist, userAccount); err != nil {
+					c.Logger().Errorf("error enqueuePlaylistFavoritedWebhooks: %s", err)
+				}
+			}
 		}
 	} else {
 		// delete
-		if _, err := conn.ExecContext(
-			ctx,
-			"DELETE FROM playlist_favorite WHERE `playlist_id` = ? AND `favorite_user_account` = ?",
-			playlist.ID, userAccount,
-		); err != nil {
-			c.Logger().Errorf(
-				"error Delete playlist_favorite by playlist_id=%d, favorite_user_account=%s: %s",
-				playlist.ID, userAccount, err,
-			)
+		tx, err := conn.BeginTxx(ctx, nil)
+		if err != nil {
+			c.Logger().Errorf("error conn.BeginTxx: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		if err := deletePlaylistFavorite(ctx, tx, playlist.ID, userAccount); err != nil {
+			tx.Rollback()
+			c.Logger().Errorf("error deletePlaylistFavorite: %s", err)
 			return errorResponse(c, 500, "internal server error")
 		}
+		if err := tx.Commit(); err != nil {
+			c.Logger().Errorf("error tx.Commit: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+	}
+	if err := publishFavoriteCount(ctx, conn, playlist); err != nil {
+		c.Logger().Errorf("error publishFavoriteCount: %s", err)
 	}
 
 	playlistDetail, err := getPlaylistDetailByPlaylistULID(ctx, conn, playlist.ULID, &userAccount)
@@ -1683,12 +2084,8 @@ func apiAdminUserBanHandler(c echo.Context) error {
 	}
 	defer conn.Close()
 
-	if _, err := conn.ExecContext(
-		ctx,
-		"UPDATE user SET `is_ban` = ?  WHERE `account` = ?",
-		isBan, userAccount,
-	); err != nil {
-		c.Logger().Errorf("error Update user by is_ban=%t, account=%s: %s", isBan, userAccount, err)
+	if err := updateUserIsBan(ctx, conn, userAccount, isBan); err != nil {
+		c.Logger().Errorf("error updateUserIsBan: %s", err)
 		return errorResponse(c, 500, "internal server error")
 	}
 	updatedUser, err := getUserByAccount(ctx, conn, userAccount)
@@ -1722,6 +2119,43 @@ func isAdminUser(account string) bool {
 	return account == "adminuser"
 }
 
+// 追加機能が書き換えたり消したりした初期データを、seed_* テーブルの控えから元に戻す
+// 初期データより後に作られた行は initializeHandler で消す
+var restoreSeedQueries = []string{
+	// 退会で消えた初期データのプレイリストとお気に入り 退会の記録を消す前に戻す
+	"INSERT INTO playlist (`id`, `ulid`, `name`, `user_account`, `is_public`, `created_at`, `updated_at`)" +
+		" SELECT `id`, `ulid`, `name`, `user_account`, `is_public`, `created_at`, `updated_at` FROM seed_playlist" +
+		" WHERE user_account IN (SELECT user_account FROM account_deletion WHERE deleted_at IS NOT NULL) AND id NOT IN (SELECT id FROM playlist)",
+	"INSERT IGNORE INTO playlist_song (`playlist_id`, `sort_order`, `song_id`, `created_at`)" +
+		" SELECT `playlist_id`, `sort_order`, `song_id`, `created_at` FROM seed_playlist_song" +
+		" WHERE playlist_id IN (SELECT id FROM seed_playlist WHERE user_account IN (SELECT user_account FROM account_deletion WHERE deleted_at IS NOT NULL))",
+	"INSERT IGNORE INTO playlist_favorite (`id`, `playlist_id`, `favorite_user_account`, `created_at`)" +
+		" SELECT `id`, `playlist_id`, `favorite_user_account`, `created_at` FROM seed_playlist_favorite" +
+		" WHERE favorite_user_account IN (SELECT user_account FROM account_deletion WHERE deleted_at IS NOT NULL)" +
+		" OR playlist_id IN (SELECT id FROM seed_playlist WHERE user_account IN (SELECT user_account FROM account_deletion WHERE deleted_at IS NOT NULL))",
+	// パスワード変更、プロフィール変更、退会での匿名化
+	"UPDATE user AS u JOIN seed_user AS s ON u.account = s.account" +
+		" SET u.display_name = s.display_name, u.password_hash = s.password_hash, u.is_ban = s.is_ban" +
+		" WHERE (u.display_name, u.password_hash, u.is_ban) <> (s.display_name, s.password_hash, s.is_ban)",
+	// 管理者のカタログ編集とアーティストの統合
+	"INSERT INTO artist (`id`, `ulid`, `name`) SELECT `id`, `ulid`, `name` FROM seed_artist WHERE id NOT IN (SELECT id FROM artist)",
+	"UPDATE artist AS a JOIN seed_artist AS s ON a.id = s.id SET a.name = s.name WHERE a.name <> s.name",
+	"DELETE FROM artist WHERE id NOT IN (SELECT id FROM seed_artist)",
+	"DELETE FROM song WHERE id NOT IN (SELECT id FROM seed_song)",
+	"UPDATE song AS s JOIN seed_song AS o ON s.id = o.id" +
+		" SET s.title = o.title, s.artist_id = o.artist_id, s.album = o.album, s.track_number = o.track_number," +
+		" s.is_public = o.is_public, s.duration = o.duration, s.genre = o.genre, s.release_year = o.release_year" +
+		" WHERE (s.title, s.artist_id, s.album, s.track_number, s.is_public, s.duration, s.genre, s.release_year)" +
+		" <> (o.title, o.artist_id, o.album, o.track_number, o.is_public, o.duration, o.genre, o.release_year)",
+	"DELETE FROM playlist_song WHERE song_id NOT IN (SELECT id FROM song)",
+	// 管理者の措置、限定公開、説明文
+	"UPDATE playlist AS p JOIN seed_playlist AS s ON p.id = s.id" +
+		" SET p.is_public = s.is_public, p.is_hidden = 0, p.is_locked = 0, p.moderation_reason = ''," +
+		" p.is_unlisted = 0, p.share_token = '', p.description = ''" +
+		" WHERE p.is_public <> s.is_public OR p.is_hidden OR p.is_locked OR p.moderation_reason <> ''" +
+		" OR p.is_unlisted OR p.share_token <> '' OR p.description <> ''",
+}
+
 // 競技に必要なAPI
 // DBの初期化処理
 // auto generated dump data 20220424_0851 size prod
@@ -1735,6 +2169,13 @@ func initializeHandler(c echo.Context) error {
 	}
 	defer conn.Close()
 
+	for _, query := range restoreSeedQueries {
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			c.Logger().Errorf("error: initialize %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+	}
+
 	if _, err := conn.ExecContext(
 		ctx,
 		"DELETE FROM user WHERE ? < `created_at`",
@@ -1770,6 +2211,151 @@ func initializeHandler(c echo.Context) error {
 		return errorResponse(c, 500, "internal server error")
 	}
 
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM playlist_smart_rule WHERE playlist_id NOT IN (SELECT id FROM playlist) OR ? < created_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM playlist_tag WHERE playlist_id NOT IN (SELECT id FROM playlist) OR ? < created_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM playlist_comment WHERE playlist_id NOT IN (SELECT id FROM playlist) OR ? < created_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM song_like WHERE user_account NOT IN (SELECT account FROM user) OR ? < created_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM webhook WHERE user_account NOT IN (SELECT account FROM user) OR ? < created_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM webhook_delivery WHERE webhook_id NOT IN (SELECT id FROM webhook) OR ? < created_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM access_token WHERE user_account NOT IN (SELECT account FROM user) OR ? < created_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM account_deletion WHERE user_account NOT IN (SELECT account FROM user) OR ? < requested_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM user_session WHERE user_account NOT IN (SELECT account FROM user) OR ? < created_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	// お気に入りの数は残ったお気に入りから数え直す
+	if _, err := conn.ExecContext(ctx, "DELETE FROM playlist_favorite_count"); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if _, err := conn.ExecContext(
+		ctx,
+		"INSERT INTO playlist_favorite_count (`playlist_id`, `favorite_count`)"+
+			" SELECT playlist_id, COUNT(*) FROM playlist_favorite GROUP BY playlist_id",
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	recommendations.reset()
+	charts.reset()
+	loginThrottler.reset()
+	userSessionActivity.reset()
+	live.reset()
+
+	// 書き込み待ちの再生イベントは捨て、再生回数は残ったイベントから数え直す
+	// 書き込み中のものが終わるのを待ち、数え直すまで次の書き込みを始めさせない
+	playEvents.flushMu.Lock()
+	defer playEvents.flushMu.Unlock()
+	playEvents.reset()
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM play_event WHERE ? < played_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if _, err := conn.ExecContext(ctx, "DELETE FROM playlist_play_count"); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if _, err := conn.ExecContext(
+		ctx,
+		"INSERT INTO playlist_play_count (`playlist_id`, `play_count`)"+
+			" SELECT playlist_id, COUNT(*) FROM play_event WHERE playlist_id IN (SELECT id FROM playlist) GROUP BY playlist_id",
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM report WHERE ? < created_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM report_resolution WHERE ? < created_at",
+		lastCreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error: initialize %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
 	body := BasicResponse{
 		Result: true,
 		Status: 200,
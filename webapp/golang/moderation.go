@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 管理者によるプレイリスト単位の措置
+const (
+	// 非公開にして、作成者が公開に戻せないようにする
+	moderationActionUnpublish = "unpublish"
+	// 作成者以外から見えないようにする
+	moderationActionHide = "hide"
+	// 措置を解除する
+	moderationActionClear = "clear"
+)
+
+// 作成者本人にだけ措置の状態を返す
+func getPlaylistModeration(playlist *PlaylistRow, viewerUserAccount string) *PlaylistModeration {
+	if playlist.UserAccount != viewerUserAccount {
+		return nil
+	}
+	if !playlist.IsLocked && !playlist.IsHidden {
+		return nil
+	}
+	return &PlaylistModeration{
+		IsHidden: playlist.IsHidden,
+		IsLocked: playlist.IsLocked,
+		Reason:   playlist.ModerationReason,
+	}
+}
+
+func moderatePlaylist(ctx context.Context, db connOrTx, playlistID int, action string, reason string) error {
+	var query string
+	var args []interface{}
+	switch action {
+	case moderationActionUnpublish:
+		// 限定公開のリンクも無効にする
+		query = "UPDATE playlist SET `is_public` = ?, `is_unlisted` = ?, `share_token` = ?, `is_locked` = ?, `moderation_reason` = ? WHERE `id` = ?"
+		args = []interface{}{false, false, "", true, reason, playlistID}
+	case moderationActionHide:
+		query = "UPDATE playlist SET `is_hidden` = ?, `is_locked` = ?, `moderation_reason` = ? WHERE `id` = ?"
+		args = []interface{}{true, true, reason, playlistID}
+	case moderationActionClear:
+		query = "UPDATE playlist SET `is_hidden` = ?, `is_locked` = ?, `moderation_reason` = ? WHERE `id` = ?"
+		args = []interface{}{false, false, "", playlistID}
+	default:
+		return fmt.Errorf("unknown moderation action=%s", action)
+	}
+	if _, err := db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf(
+			"error Update playlist moderation by id=%d, action=%s, reason=%s: %w",
+			playlistID, action, reason, err,
+		)
+	}
+	return nil
+}
+
+// POST /api/admin/playlist/moderate
+
+func apiAdminPlaylistModerateHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	// 管理者userであることを確認,でなければ403
+	if !isAdminUser(user.Account) {
+		return errorResponse(c, 403, "not admin user")
+	}
+
+	var req AdminPlaylistModerateRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AdminPlaylistModerateRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	// validation
+	if req.PlaylistULID == "" {
+		return errorResponse(c, 400, "bad playlist ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", req.PlaylistULID); matched {
+		return errorResponse(c, 400, "bad playlist ulid")
+	}
+	switch req.Action {
+	case moderationActionUnpublish, moderationActionHide:
+		// 作成者に理由を表示するので必須
+		if req.Reason == "" || 191 < utf8.RuneCountInString(req.Reason) {
+			return errorResponse(c, 400, "invalid reason")
+		}
+	case moderationActionClear:
+	default:
+		return errorResponse(c, 400, "invalid action")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	playlist, err := getPlaylistByULID(ctx, conn, req.PlaylistULID)
+	if err != nil {
+		c.Logger().Errorf("error getPlaylistByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if playlist == nil {
+		return errorResponse(c, 400, "playlist not found")
+	}
+
+	if err := moderatePlaylist(ctx, conn, playlist.ID, req.Action, req.Reason); err != nil {
+		c.Logger().Errorf("error moderatePlaylist: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	updatedPlaylist, err := getPlaylistByID(ctx, conn, playlist.ID)
+	if err != nil {
+		c.Logger().Errorf("error getPlaylistByID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if updatedPlaylist == nil {
+		return errorResponse(c, 400, "playlist not found")
+	}
+	if err := publishPlaylistChanged(ctx, conn, playlist); err != nil {
+		c.Logger().Errorf("error publishPlaylistChanged: %s", err)
+	}
+
+	body := AdminPlaylistModerateResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		PlaylistULID: updatedPlaylist.ULID,
+		IsPublic:     updatedPlaylist.IsPublic,
+		Moderation: PlaylistModeration{
+			IsHidden: updatedPlaylist.IsHidden,
+			IsLocked: updatedPlaylist.IsLocked,
+			Reason:   updatedPlaylist.ModerationReason,
+		},
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestGetPageFromParam(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		want   int
+		wantOK bool
+	}{
+		{name: "omitted", query: "", want: 1, wantOK: true},
+		{name: "first", query: "?page=1", want: 1, wantOK: true},
+		{name: "last", query: "?page=100", want: 100, wantOK: true},
+		{name: "zero", query: "?page=0", wantOK: false},
+		{name: "negative", query: "?page=-1", wantOK: false},
+		{name: "too large", query: "?page=101", wantOK: false},
+		{name: "overflow", query: "?page=99999999999999999999", wantOK: false},
+		{name: "not a number", query: "?page=a", wantOK: false},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+tt.query, nil)
+			c := e.NewContext(req, httptest.NewRecorder())
+			got, ok := getPageFromParam(c)
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Errorf("getPageFromParam = (%d, %t), want (%d, %t)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
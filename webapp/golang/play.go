@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 再生イベントの記録
+// リクエストごとにMySQLへ書き込まず、メモリに溜めてまとめて書き込む
+// まだ書き込んでいないイベントも再生履歴と再生回数に含める
+
+const (
+	// 溜めたイベントを書き込む間隔
+	playEventFlushInterval = time.Second
+	// これだけ溜まったら間隔を待たずに書き込む
+	playEventFlushSize = 1000
+	// 書き込みに失敗し続けた場合に、メモリに残しておく最大数 超えたら古いものから捨てる
+	playEventMaxPending = 100000
+	// 再生履歴で返す最大数
+	playHistoryMaxLimit = 100
+)
+
+type pendingPlayEvent struct {
+	PlayEventRow
+	PlaylistULID string
+}
+
+type playEventBuffer struct {
+	mu sync.Mutex
+	// 書き込みの開始から終了まで持つ /initialize は書き込み中のものが終わるのを待つ
+	flushMu sync.Mutex
+	// コミットと書き込み中のイベントの削除の間は書き込み側が持ち、読む側はMySQLとメモリの両方を読む間持つ
+	// コミット済みのイベントをMySQLとメモリの両方から数えないようにする
+	commitMu sync.RWMutex
+	// 書き込み待ち
+	pending []pendingPlayEvent
+	// 書き込み中
+	inflight []pendingPlayEvent
+	// 書き込み待ちと書き込み中のイベントの、プレイリストごとの数
+	playCounts map[int]int
+	flushCh    chan struct{}
+}
+
+var playEvents = &playEventBuffer{
+	playCounts: make(map[int]int),
+	flushCh:    make(chan struct{}, 1),
+}
+
+func (b *playEventBuffer) uncountLocked(events []pendingPlayEvent) {
+	for _, ev := range events {
+		if ev.PlaylistID == 0 {
+			continue
+		}
+		if b.playCounts[ev.PlaylistID] <= 1 {
+			delete(b.playCounts, ev.PlaylistID)
+		} else {
+			b.playCounts[ev.PlaylistID]--
+		}
+	}
+}
+
+func (b *playEventBuffer) add(ev pendingPlayEvent) {
+	b.mu.Lock()
+	b.pending = append(b.pending, ev)
+	if ev.PlaylistID != 0 {
+		b.playCounts[ev.PlaylistID]++
+	}
+	full := len(b.pending) >= playEventFlushSize
+	b.mu.Unlock()
+	if full {
+		select {
+		case b.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 書き込み待ちのイベントを書き込み中にして返す
+func (b *playEventBuffer) take() []pendingPlayEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inflight = b.pending
+	b.pending = nil
+	return b.inflight
+}
+
+// 書き込みが終わったら書き込み中のイベントを消す 失敗したら書き込み待ちに戻す
+func (b *playEventBuffer) done(succeeded bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if succeeded {
+		b.uncountLocked(b.inflight)
+	} else {
+		b.pending = append(b.inflight, b.pending...)
+		if over := len(b.pending) - playEventMaxPending; over > 0 {
+			b.uncountLocked(b.pending[:over])
+			b.pending = b.pending[over:]
+		}
+	}
+	b.inflight = nil
+}
+
+func (b *playEventBuffer) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = nil
+	b.inflight = nil
+	b.playCounts = make(map[int]int)
+}
+
+// まだ書き込まれていない、指定したユーザーのイベントを新しい順に返す
+func (b *playEventBuffer) pendingByUserAccount(userAccount string) []pendingPlayEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []pendingPlayEvent
+	for _, list := range [][]pendingPlayEvent{b.pending, b.inflight} {
+		for i := len(list) - 1; i >= 0; i-- {
+			if list[i].UserAccount == userAccount {
+				events = append(events, list[i])
+			}
+		}
+	}
+	return events
+}
+
+func (b *playEventBuffer) pendingCountByPlaylistID(playlistID int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.playCounts[playlistID]
+}
+
+// 溜まったイベントを定期的に書き込む main から goroutine で起動する
+func runPlayEventFlusher(logger echo.Logger) {
+	ticker := time.NewTicker(playEventFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-playEvents.flushCh:
+		}
+		if err := flushPlayEvents(context.Background()); err != nil {
+			logger.Errorf("error flushPlayEvents: %s", err)
+		}
+	}
+}
+
+func flushPlayEvents(ctx context.Context) error {
+	playEvents.flushMu.Lock()
+	defer playEvents.flushMu.Unlock()
+
+	events := playEvents.take()
+	if len(events) == 0 {
+		playEvents.done(true)
+		return nil
+	}
+	if err := writePlayEvents(ctx, events); err != nil {
+		playEvents.done(false)
+		return err
+	}
+	return nil
+}
+
+// イベントを書き込み、コミットできたら書き込み中のイベントを消す
+func writePlayEvents(ctx context.Context, events []pendingPlayEvent) error {
+	rows := make([]PlayEventRow, 0, len(events))
+	playCounts := make(map[int]int)
+	for _, ev := range events {
+		rows = append(rows, ev.PlayEventRow)
+		if ev.PlaylistID != 0 {
+			playCounts[ev.PlaylistID]++
+		}
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error db.BeginTxx: %w", err)
+	}
+	// プレースホルダの数が多くなりすぎないよう分けて書き込む
+	for start := 0; start < len(rows); start += playEventFlushSize {
+		end := start + playEventFlushSize
+		if len(rows) < end {
+			end = len(rows)
+		}
+		if _, err := tx.NamedExecContext(
+			ctx,
+			"INSERT INTO play_event (`user_account`, `song_id`, `playlist_id`, `played_at`)"+
+				" VALUES (:user_account, :song_id, :playlist_id, :played_at)",
+			rows[start:end],
+		); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error Insert play_event count=%d: %w", end-start, err)
+		}
+	}
+	for playlistID, count := range playCounts {
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO playlist_play_count (`playlist_id`, `play_count`) VALUES (?, ?)"+
+				" ON DUPLICATE KEY UPDATE `play_count` = `play_count` + VALUES(`play_count`)",
+			playlistID, count,
+		); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error Insert playlist_play_count by playlist_id=%d: %w", playlistID, err)
+		}
+	}
+	playEvents.commitMu.Lock()
+	defer playEvents.commitMu.Unlock()
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	playEvents.done(true)
+	return nil
+}
+
+// 書き込み待ちのイベントを含めた再生回数
+func getPlayCountByPlaylistID(ctx context.Context, db connOrTx, playlistID int) (int, error) {
+	playEvents.commitMu.RLock()
+	defer playEvents.commitMu.RUnlock()
+	var counts []int
+	if err := db.SelectContext(
+		ctx,
+		&counts,
+		"SELECT play_count FROM playlist_play_count WHERE playlist_id = ?",
+		playlistID,
+	); err != nil {
+		return 0, fmt.Errorf("error Select playlist_play_count by playlist_id=%d: %w", playlistID, err)
+	}
+	count := playEvents.pendingCountByPlaylistID(playlistID)
+	for _, c := range counts {
+		count += c
+	}
+	return count, nil
+}
+
+func getSongWithArtistByID(ctx context.Context, db connOrTx, songID int) (*SongWithArtistRow, error) {
+	var row SongWithArtistRow
+	if err := db.GetContext(
+		ctx,
+		&row,
+		"SELECT song.*, artist.name AS artist_name FROM song JOIN artist ON artist.id = song.artist_id WHERE song.id = ?",
+		songID,
+	); err != nil {
+		return nil, fmt.Errorf("error Get song by id=%d: %w", songID, err)
+	}
+	return &row, nil
+}
+
+// 書き込み待ちのイベントを含めて、新しい順に再生履歴を返す
+func getPlayHistory(ctx context.Context, db connOrTx, userAccount string, limit int) ([]PlayHistory, error) {
+	playEvents.commitMu.RLock()
+	defer playEvents.commitMu.RUnlock()
+	histories := make([]PlayHistory, 0, limit)
+	for _, ev := range playEvents.pendingByUserAccount(userAccount) {
+		if len(histories) >= limit {
+			return histories, nil
+		}
+		song, err := getSongWithArtistByID(ctx, db, ev.SongID)
+		if err != nil {
+			return nil, fmt.Errorf("error getSongWithArtistByID: %w", err)
+		}
+		histories = append(histories, PlayHistory{
+			Song:         toSong(&song.SongRow, &ArtistRow{Name: song.ArtistName}),
+			PlaylistULID: ev.PlaylistULID,
+			PlayedAt:     ev.PlayedAt,
+		})
+	}
+
+	var rows []struct {
+		SongWithArtistRow
+		PlaylistULID string    `db:"playlist_ulid"`
+		PlayedAt     time.Time `db:"played_at"`
+	}
+	if err := db.SelectContext(
+		ctx,
+		&rows,
+		"SELECT song.*, artist.name AS artist_name, COALESCE(playlist.ulid, '') AS playlist_ulid, play_event.played_at"+
+			" FROM play_event JOIN song ON song.id = play_event.song_id JOIN artist ON artist.id = song.artist_id"+
+			" LEFT JOIN playlist ON playlist.id = play_event.playlist_id"+
+			" WHERE play_event.user_account = ? ORDER BY play_event.played_at DESC, play_event.id DESC LIMIT ?",
+		userAccount, limit-len(histories),
+	); err != nil {
+		return nil, fmt.Errorf("error Select play_event by user_account=%s: %w", userAccount, err)
+	}
+	for _, row := range rows {
+		histories = append(histories, PlayHistory{
+			Song:         toSong(&row.SongRow, &ArtistRow{Name: row.ArtistName}),
+			PlaylistULID: row.PlaylistULID,
+			PlayedAt:     row.PlayedAt,
+		})
+	}
+	return histories, nil
+}
+
+// POST /api/play
+
+func apiPlayHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	var req PlayRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to PlayRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if req.SongULID == "" {
+		return errorResponse(c, 400, "song_ulid is required")
+	}
+	for _, u := range []string{req.SongULID, req.PlaylistULID} {
+		if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", u); matched {
+			return errorResponse(c, 400, "bad ulid")
+		}
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	song, err := getSongByULID(ctx, conn, req.SongULID)
+	if err != nil {
+		c.Logger().Errorf("error getSongByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if song == nil || !song.IsPublic {
+		return errorResponse(c, 404, "song not found")
+	}
+	playlistID := 0
+	if req.PlaylistULID != "" {
+		playlist, err := getPlaylistByULID(ctx, conn, req.PlaylistULID)
+		if err != nil {
+			c.Logger().Errorf("error getPlaylistByULID: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		// 詳細を見れないプレイリストでは再生できない
+		if playlist == nil || !canViewPlaylist(playlist, user.Account, req.ShareToken) ||
+			(playlist.UserAccount != user.Account && playlist.IsHidden) {
+			return errorResponse(c, 404, "playlist not found")
+		}
+		playlistID = playlist.ID
+	}
+
+	playEvents.add(pendingPlayEvent{
+		PlayEventRow: PlayEventRow{
+			UserAccount: user.Account,
+			SongID:      song.ID,
+			PlaylistID:  playlistID,
+			PlayedAt:    time.Now(),
+		},
+		PlaylistULID: req.PlaylistULID,
+	})
+
+	body := BasicResponse{
+		Result: true,
+		Status: 200,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// GET /api/history
+
+func apiHistoryHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	limit := playHistoryMaxLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || playHistoryMaxLimit < n {
+			return errorResponse(c, 400, "invalid limit")
+		}
+		limit = n
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	histories, err := getPlayHistory(ctx, conn, user.Account, limit)
+	if err != nil {
+		c.Logger().Errorf("error getPlayHistory: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := GetHistoryResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Histories: histories,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+// プレイリストのインポート・エクスポート
+// M3U, XSPF の location には曲を特定できるよう songLocationPrefix + ULID を入れる
+
+const (
+	songLocationPrefix = "listen80:song:"
+	// インポートするファイルの最大サイズ
+	playlistImportMaxContentLength = 1 << 20
+)
+
+type xspfPlaylist struct {
+	XMLName   xml.Name    `xml:"playlist"`
+	Version   string      `xml:"version,attr"`
+	Xmlns     string      `xml:"xmlns,attr"`
+	Title     string      `xml:"title"`
+	Creator   string      `xml:"creator,omitempty"`
+	TrackList []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location   string `xml:"location,omitempty"`
+	Identifier string `xml:"identifier,omitempty"`
+	Title      string `xml:"title"`
+	Creator    string `xml:"creator"`
+	Album      string `xml:"album,omitempty"`
+	TrackNum   int    `xml:"trackNum,omitempty"`
+	// ミリ秒
+	Duration int `xml:"duration,omitempty"`
+}
+
+// インポートするファイルの1曲分
+type playlistImportEntry struct {
+	Line   int
+	Text   string
+	ULID   string
+	Title  string
+	Artist string
+}
+
+// 曲順どおりにプレイリストの曲を取得する
+func getOrderedPlaylistSongs(ctx context.Context, db connOrTx, playlistID int) ([]SongWithArtistRow, error) {
+	var rows []SongWithArtistRow
+	if err := db.SelectContext(
+		ctx,
+		&rows,
+		"SELECT song.*, artist.name AS artist_name FROM playlist_song"+
+			" JOIN song ON song.id = playlist_song.song_id JOIN artist ON artist.id = song.artist_id"+
+			" WHERE playlist_song.playlist_id = ? ORDER BY playlist_song.sort_order",
+		playlistID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select playlist_song by playlist_id=%d: %w", playlistID, err)
+	}
+	return rows, nil
+}
+
+// エクスポートする曲 スマートプレイリストは今の条件に合う曲になる
+func getPlaylistExportSongs(ctx context.Context, db connOrTx, playlist *PlaylistRow) ([]Song, error) {
+	rules, err := getSmartPlaylistRules(ctx, db, playlist.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error getSmartPlaylistRules: %w", err)
+	}
+	var rows []SongWithArtistRow
+	if rules != nil {
+		rows, err = getSmartPlaylistSongs(ctx, db, rules)
+	} else {
+		rows, err = getOrderedPlaylistSongs(ctx, db, playlist.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error get playlist songs: %w", err)
+	}
+	songs := make([]Song, 0, len(rows))
+	for _, row := range rows {
+		// 非公開の曲は含めない
+		if !row.IsPublic {
+			continue
+		}
+		songs = append(songs, toSong(&row.SongRow, &ArtistRow{Name: row.ArtistName}))
+	}
+	return songs, nil
+}
+
+func songLocation(songULID string) string {
+	return songLocationPrefix + songULID
+}
+
+func songULIDFromLocation(location string) string {
+	location = strings.TrimSpace(location)
+	if !strings.HasPrefix(location, songLocationPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(location, songLocationPrefix)
+}
+
+func exportM3U(name string, songs []Song) []byte {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%s\n", name)
+	for _, song := range songs {
+		duration := song.Duration
+		if duration == 0 {
+			// 長さ不明
+			duration = -1
+		}
+		fmt.Fprintf(&b, "#EXTINF:%d,%s - %s\n", duration, song.Artist, song.Title)
+		if song.Album != "" {
+			fmt.Fprintf(&b, "#EXTALB:%s\n", song.Album)
+		}
+		b.WriteString(songLocation(song.ULID) + "\n")
+	}
+	return []byte(b.String())
+}
+
+func exportXSPF(name, creator string, songs []Song) ([]byte, error) {
+	p := xspfPlaylist{
+		Version:   "1",
+		Xmlns:     "http://xspf.org/ns/0/",
+		Title:     name,
+		Creator:   creator,
+		TrackList: make([]xspfTrack, 0, len(songs)),
+	}
+	for _, song := range songs {
+		p.TrackList = append(p.TrackList, xspfTrack{
+			Location:   songLocation(song.ULID),
+			Identifier: songLocation(song.ULID),
+			Title:      song.Title,
+			Creator:    song.Artist,
+			Album:      song.Album,
+			TrackNum:   song.TrackNumber,
+			Duration:   song.Duration * 1000,
+		})
+	}
+	out, err := xml.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error xml.Marshal: %w", err)
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+func parseM3U(content string) (string, []playlistImportEntry, error) {
+	var name string
+	var entries []playlistImportEntry
+	var info *playlistImportEntry
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	// 1行が既定の上限(64KB)より長くても、取り込める大きさまでは読む
+	scanner.Buffer(make([]byte, 0, 64*1024), playlistImportMaxContentLength+1)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || text == "#EXTM3U":
+		case strings.HasPrefix(text, "#PLAYLIST:"):
+			name = strings.TrimSpace(strings.TrimPrefix(text, "#PLAYLIST:"))
+		case strings.HasPrefix(text, "#EXTINF:"):
+			// #EXTINF:長さ,アーティスト - 曲名
+			info = &playlistImportEntry{Line: line, Text: text}
+			if i := strings.Index(text, ","); i >= 0 {
+				title := text[i+1:]
+				if j := strings.Index(title, " - "); j >= 0 {
+					info.Artist = strings.TrimSpace(title[:j])
+					title = title[j+3:]
+				}
+				info.Title = strings.TrimSpace(title)
+			}
+		case strings.HasPrefix(text, "#"):
+		default:
+			entry := playlistImportEntry{Line: line, Text: text}
+			if info != nil {
+				entry = *info
+				entry.Text = info.Text + " " + text
+			}
+			entry.ULID = songULIDFromLocation(text)
+			entries = append(entries, entry)
+			info = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	return name, entries, nil
+}
+
+func parseXSPF(content string) (string, []playlistImportEntry, error) {
+	var p xspfPlaylist
+	if err := xml.Unmarshal([]byte(content), &p); err != nil {
+		return "", nil, err
+	}
+	entries := make([]playlistImportEntry, 0, len(p.TrackList))
+	for i, track := range p.TrackList {
+		songULID := songULIDFromLocation(track.Identifier)
+		if songULID == "" {
+			songULID = songULIDFromLocation(track.Location)
+		}
+		entries = append(entries, playlistImportEntry{
+			Line:   i + 1,
+			Text:   fmt.Sprintf("%s - %s", track.Creator, track.Title),
+			ULID:   songULID,
+			Title:  strings.TrimSpace(track.Title),
+			Artist: strings.TrimSpace(track.Creator),
+		})
+	}
+	return strings.TrimSpace(p.Title), entries, nil
+}
+
+func parsePlaylistExportJSON(content string) (string, []playlistImportEntry, error) {
+	var p PlaylistExport
+	if err := json.Unmarshal([]byte(content), &p); err != nil {
+		return "", nil, err
+	}
+	entries := make([]playlistImportEntry, 0, len(p.Songs))
+	for i, song := range p.Songs {
+		entries = append(entries, playlistImportEntry{
+			Line:   i + 1,
+			Text:   fmt.Sprintf("%s - %s", song.Artist, song.Title),
+			ULID:   song.ULID,
+			Title:  strings.TrimSpace(song.Title),
+			Artist: strings.TrimSpace(song.Artist),
+		})
+	}
+	return strings.TrimSpace(p.Name), entries, nil
+}
+
+// ULID、なければ曲名とアーティスト名で公開中の曲を探す
+func matchImportEntry(ctx context.Context, db connOrTx, entry playlistImportEntry) (*SongRow, error) {
+	if entry.ULID != "" {
+		song, err := getSongByULID(ctx, db, entry.ULID)
+		if err != nil {
+			return nil, err
+		}
+		if song != nil && song.IsPublic {
+			return song, nil
+		}
+	}
+	if entry.Title == "" || entry.Artist == "" {
+		return nil, nil
+	}
+	var song SongRow
+	if err := db.GetContext(
+		ctx,
+		&song,
+		"SELECT song.* FROM song JOIN artist ON artist.id = song.artist_id"+
+			" WHERE song.title = ? AND artist.name = ? AND song.is_public = ? ORDER BY song.id LIMIT 1",
+		entry.Title, entry.Artist, true,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error Get song by title=%s, artist=%s: %w", entry.Title, entry.Artist, err)
+	}
+	return &song, nil
+}
+
+// GET /api/playlist/:playlistUlid/export
+
+func apiPlaylistExportHandler(c echo.Context) error {
+	// ログインは不要
+	userAccount, err := getViewerUserAccount(c)
+	if err != nil {
+		c.Logger().Errorf("error getViewerUserAccount: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	playlistULID := c.Param("playlistUlid")
+	if playlistULID == "" {
+		return errorResponse(c, 400, "bad playlist ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", playlistULID); matched {
+		return errorResponse(c, 400, "bad playlist ulid")
+	}
+	format := c.QueryParam("format")
+	switch format {
+	case "":
+		format = "json"
+	case "m3u", "xspf", "json":
+	default:
+		return errorResponse(c, 400, "invalid format")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	playlist, err := getPlaylistByULID(ctx, conn, playlistULID)
+	if err != nil {
+		c.Logger().Errorf("error getPlaylistByULID:  %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if playlist == nil {
+		return errorResponse(c, 404, "playlist not found")
+	}
+	// 詳細と同じく、作成者が自分ではない、privateか非表示のプレイリストは見れない
+	if !canViewPlaylist(playlist, userAccount, c.QueryParam("share_token")) ||
+		(playlist.UserAccount != userAccount && playlist.IsHidden) {
+		return errorResponse(c, 404, "playlist not found")
+	}
+	owner, err := getUserByAccount(ctx, conn, playlist.UserAccount)
+	if err != nil {
+		c.Logger().Errorf("error getUserByAccount: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if owner == nil || owner.IsBan {
+		return errorResponse(c, 404, "playlist not found")
+	}
+
+	songs, err := getPlaylistExportSongs(ctx, conn, playlist)
+	if err != nil {
+		c.Logger().Errorf("error getPlaylistExportSongs: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	var body []byte
+	var contentType string
+	switch format {
+	case "m3u":
+		body = exportM3U(playlist.Name, songs)
+		contentType = "audio/x-mpegurl; charset=UTF-8"
+	case "xspf":
+		body, err = exportXSPF(playlist.Name, owner.DisplayName, songs)
+		if err != nil {
+			c.Logger().Errorf("error exportXSPF: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		contentType = "application/xspf+xml; charset=UTF-8"
+	case "json":
+		body, err = json.Marshal(PlaylistExport{
+			ULID:            playlist.ULID,
+			Name:            playlist.Name,
+			UserDisplayName: owner.DisplayName,
+			Songs:           songs,
+		})
+		if err != nil {
+			c.Logger().Errorf("error json.Marshal: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		contentType = echo.MIMEApplicationJSONCharsetUTF8
+	}
+
+	c.Response().Header().Set(
+		echo.HeaderContentDisposition,
+		fmt.Sprintf(`attachment; filename="%s.%s"`, playlist.ULID, format),
+	)
+	return c.Blob(http.StatusOK, contentType, body)
+}
+
+// POST /api/playlist/import
+
+func apiPlaylistImportHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	var req ImportPlaylistRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to ImportPlaylistRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if req.Content == "" || playlistImportMaxContentLength < len(req.Content) {
+		return errorResponse(c, 400, "invalid content")
+	}
+
+	var name string
+	var entries []playlistImportEntry
+	switch req.Format {
+	case "m3u":
+		name, entries, err = parseM3U(req.Content)
+	case "xspf":
+		name, entries, err = parseXSPF(req.Content)
+	case "json":
+		name, entries, err = parsePlaylistExportJSON(req.Content)
+	default:
+		return errorResponse(c, 400, "invalid format")
+	}
+	if err != nil {
+		return errorResponse(c, 400, fmt.Sprintf("failed to parse %s: %s", req.Format, err))
+	}
+	if req.Name != "" {
+		name = req.Name
+	}
+	if name == "" || utf8.RuneCountInString(name) < 2 || 191 < utf8.RuneCountInString(name) {
+		return errorResponse(c, 400, "invalid name")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	songIDs := make([]int, 0, len(entries))
+	added := make(map[int]struct{}, len(entries))
+	unmatched := []UnmatchedImportEntry{}
+	for _, entry := range entries {
+		song, err := matchImportEntry(ctx, conn, entry)
+		if err != nil {
+			c.Logger().Errorf("error matchImportEntry: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		reason := ""
+		switch {
+		case song == nil:
+			reason = "song not found"
+		case len(songIDs) >= 80:
+			// 曲数は最大80曲
+			reason = "too many songs"
+		default:
+			if _, ok := added[song.ID]; ok {
+				// 曲は重複してはいけない
+				reason = "duplicated song"
+			}
+		}
+		if reason != "" {
+			unmatched = append(unmatched, UnmatchedImportEntry{
+				Line:   entry.Line,
+				Text:   entry.Text,
+				Reason: reason,
+			})
+			continue
+		}
+		added[song.ID] = struct{}{}
+		songIDs = append(songIDs, song.ID)
+	}
+
+	createTimestamp := time.Now()
+	playlistULID, err := ulid.New(ulid.Timestamp(createTimestamp), entropy)
+	if err != nil {
+		c.Logger().Errorf("error ulid.New: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Errorf("error conn.BeginTxx: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	res, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO playlist (`ulid`, `name`, `user_account`, `is_public`, `created_at`, `updated_at`) VALUES (?, ?, ?, ?, ?, ?)",
+		playlistULID.String(), name, user.Account, false, createTimestamp, createTimestamp, // 作成時は非公開
+	)
+	if err != nil {
+		tx.Rollback()
+		c.Logger().Errorf(
+			"error Insert playlist by ulid=%s, name=%s, user_account=%s, is_public=%t, created_at=%s, updated_at=%s: %s",
+			playlistULID, name, user.Account, false, createTimestamp, createTimestamp, err,
+		)
+		return errorResponse(c, 500, "internal server error")
+	}
+	playlistID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error LastInsertId: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	for i, songID := range songIDs {
+		if err := insertPlaylistSong(ctx, tx, int(playlistID), i+1, songID, createTimestamp); err != nil {
+			tx.Rollback()
+			c.Logger().Errorf("error insertPlaylistSong: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("error tx.Commit: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := ImportPlaylistResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		PlaylistULID:     playlistULID.String(),
+		MatchedSongCount: len(songIDs),
+		Unmatched:        unmatched,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
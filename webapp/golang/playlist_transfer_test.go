@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseM3U(t *testing.T) {
+	longTitle := strings.Repeat("a", 100*1024)
+	tests := []struct {
+		name      string
+		content   string
+		wantName  string
+		wantULIDs []string
+		wantTitle string
+	}{
+		{
+			name:      "extended",
+			content:   "#EXTM3U\n#PLAYLIST:My List\n#EXTINF:180,Artist - Title\n" + songLocationPrefix + "01G3F4J5K6M7N8P9Q0R1S2T3V4\n",
+			wantName:  "My List",
+			wantULIDs: []string{"01G3F4J5K6M7N8P9Q0R1S2T3V4"},
+			wantTitle: "Title",
+		},
+		{
+			name:      "plain",
+			content:   songLocationPrefix + "01G3F4J5K6M7N8P9Q0R1S2T3V4\r\nunknown.mp3\n",
+			wantULIDs: []string{"01G3F4J5K6M7N8P9Q0R1S2T3V4", ""},
+		},
+		{
+			name:      "line longer than 64KB",
+			content:   "#EXTINF:180,Artist - " + longTitle + "\n" + songLocationPrefix + "01G3F4J5K6M7N8P9Q0R1S2T3V4\n",
+			wantULIDs: []string{"01G3F4J5K6M7N8P9Q0R1S2T3V4"},
+			wantTitle: longTitle,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, entries, err := parseM3U(tt.content)
+			if err != nil {
+				t.Fatalf("parseM3U returns error: %s", err)
+			}
+			if name != tt.wantName {
+				t.Errorf("name = %q, want %q", name, tt.wantName)
+			}
+			if len(entries) != len(tt.wantULIDs) {
+				t.Fatalf("parseM3U returns %d entries, want %d", len(entries), len(tt.wantULIDs))
+			}
+			for i, want := range tt.wantULIDs {
+				if entries[i].ULID != want {
+					t.Errorf("entries[%d].ULID = %q, want %q", i, entries[i].ULID, want)
+				}
+			}
+			if entries[0].Title != tt.wantTitle {
+				t.Errorf("entries[0].Title has %d bytes, want %d", len(entries[0].Title), len(tt.wantTitle))
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// プレイリストのおすすめ
+// 順位の計算は重いので、計算結果をメモリに持ち、バックグラウンドで定期的に計算し直す
+// まだ計算していないものは最初に参照されたときに計算する 同じ対象の計算は1つにまとめる
+// 公開状態やbanは変わりうるので、返すときに確認する
+
+const (
+	// 曲の重なりが多い順
+	recommendationKindSimilar = "similar"
+	// 同じユーザーにお気に入りされている数が多い順
+	recommendationKindAlsoFavorited = "also_favorited"
+
+	// 計算してからこれだけ経ったら計算し直す
+	recommendationTTL = 5 * time.Minute
+	// これだけ参照されなかった計算結果は捨てる
+	recommendationKeepDuration = time.Hour
+	// 計算し直す対象を探す間隔
+	recommendationRefreshInterval = time.Minute
+	// 計算し直すときに同時に計算する数
+	recommendationRefreshConcurrency = 4
+	// 計算して持っておく候補数 非公開になったものを除いても返せるよう多めに持つ
+	recommendationCandidateLimit = 50
+	// 返す最大数
+	recommendationLimit = 20
+)
+
+var recommendationQueries = map[string]string{
+	recommendationKindSimilar: "SELECT other.playlist_id, COUNT(*) AS score FROM playlist_song AS target" +
+		" JOIN playlist_song AS other ON other.song_id = target.song_id AND other.playlist_id != target.playlist_id" +
+		" JOIN playlist ON playlist.id = other.playlist_id" +
+		" WHERE target.playlist_id = ? AND playlist.is_public = ? AND playlist.is_hidden = ?" +
+		" GROUP BY other.playlist_id ORDER BY score DESC, other.playlist_id DESC LIMIT ?",
+	recommendationKindAlsoFavorited: "SELECT other.playlist_id, COUNT(*) AS score FROM playlist_favorite AS target" +
+		" JOIN playlist_favorite AS other ON other.favorite_user_account = target.favorite_user_account AND other.playlist_id != target.playlist_id" +
+		" JOIN user ON user.account = other.favorite_user_account" +
+		" JOIN playlist ON playlist.id = other.playlist_id" +
+		" WHERE target.playlist_id = ? AND user.is_ban = ? AND playlist.is_public = ? AND playlist.is_hidden = ?" +
+		" GROUP BY other.playlist_id ORDER BY score DESC, other.playlist_id DESC LIMIT ?",
+}
+
+type recommendationKey struct {
+	kind       string
+	playlistID int
+}
+
+type recommendationScore struct {
+	PlaylistID int `db:"playlist_id"`
+	Score      int `db:"score"`
+}
+
+type recommendationEntry struct {
+	scores     []recommendationScore
+	computedAt time.Time
+	accessedAt time.Time
+}
+
+// 計算中の結果 同じ対象の計算が重ならないよう、後から来たリクエストはこれを待つ
+type recommendationCall struct {
+	done   chan struct{}
+	scores []recommendationScore
+	err    error
+}
+
+type recommendationCache struct {
+	mu       sync.Mutex
+	entries  map[recommendationKey]*recommendationEntry
+	inflight map[recommendationKey]*recommendationCall
+}
+
+var recommendations = &recommendationCache{
+	entries:  make(map[recommendationKey]*recommendationEntry),
+	inflight: make(map[recommendationKey]*recommendationCall),
+}
+
+func computeRecommendation(ctx context.Context, db connOrTx, key recommendationKey) ([]recommendationScore, error) {
+	args := []interface{}{key.playlistID}
+	if key.kind == recommendationKindAlsoFavorited {
+		args = append(args, false)
+	}
+	args = append(args, true, false, recommendationCandidateLimit)
+	var scores []recommendationScore
+	if err := db.SelectContext(ctx, &scores, recommendationQueries[key.kind], args...); err != nil {
+		return nil, fmt.Errorf("error Select %s recommendation by playlist_id=%d: %w", key.kind, key.playlistID, err)
+	}
+	return scores, nil
+}
+
+// 計算済みの結果を返す まだなければ計算する
+// 同じ対象を同時に計算しないよう、計算中なら終わるのを待って同じ結果を返す
+func (r *recommendationCache) get(ctx context.Context, key recommendationKey) ([]recommendationScore, error) {
+	now := time.Now()
+	r.mu.Lock()
+	if entry, ok := r.entries[key]; ok {
+		entry.accessedAt = now
+		scores := entry.scores
+		r.mu.Unlock()
+		return scores, nil
+	}
+	call, ok := r.inflight[key]
+	if !ok {
+		call = &recommendationCall{done: make(chan struct{})}
+		r.inflight[key] = call
+		// 待っているリクエストが切断されても計算は続けられるよう、リクエストのcontextは使わない
+		go r.compute(key, call)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.scores, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *recommendationCache) compute(key recommendationKey, call *recommendationCall) {
+	call.scores, call.err = computeRecommendation(context.Background(), db, key)
+	now := time.Now()
+	r.mu.Lock()
+	// 計算中にresetされていたら、古いデータでの結果なので残さない
+	if r.inflight[key] == call {
+		delete(r.inflight, key)
+		if call.err == nil {
+			r.entries[key] = &recommendationEntry{scores: call.scores, computedAt: now, accessedAt: now}
+		}
+	}
+	r.mu.Unlock()
+	close(call.done)
+}
+
+// 古くなった結果を計算し直し、参照されなくなった結果を捨てる
+// 計算し直している間も古い結果を返す
+func (r *recommendationCache) refresh(ctx context.Context) error {
+	now := time.Now()
+	var stale []recommendationKey
+	r.mu.Lock()
+	for key, entry := range r.entries {
+		if now.Sub(entry.accessedAt) > recommendationKeepDuration {
+			delete(r.entries, key)
+			continue
+		}
+		if now.Sub(entry.computedAt) > recommendationTTL {
+			stale = append(stale, key)
+		}
+	}
+	r.mu.Unlock()
+
+	keys := make(chan recommendationKey)
+	errs := make(chan error, recommendationRefreshConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < recommendationRefreshConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				scores, err := computeRecommendation(ctx, db, key)
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					continue
+				}
+				r.mu.Lock()
+				if entry, ok := r.entries[key]; ok {
+					entry.scores = scores
+					entry.computedAt = time.Now()
+				}
+				r.mu.Unlock()
+			}
+		}()
+	}
+	for _, key := range stale {
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+	close(errs)
+	// 計算できなかったものがあれば、最初のエラーを返す 次の周期で計算し直す
+	if err, ok := <-errs; ok {
+		return err
+	}
+	return nil
+}
+
+func (r *recommendationCache) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = make(map[recommendationKey]*recommendationEntry)
+	r.inflight = make(map[recommendationKey]*recommendationCall)
+}
+
+// main から goroutine で起動する
+func runRecommendationRefresher(logger echo.Logger) {
+	ticker := time.NewTicker(recommendationRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := recommendations.refresh(context.Background()); err != nil {
+			logger.Errorf("error recommendations.refresh: %s", err)
+		}
+	}
+}
+
+func getRecommendedPlaylists(ctx context.Context, db connOrTx, key recommendationKey, userAccount string) ([]RecommendedPlaylist, error) {
+	scores, err := recommendations.get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("error recommendations.get: %w", err)
+	}
+	rows := make([]PlaylistRow, 0, len(scores))
+	scoreByPlaylistULID := make(map[string]int, len(scores))
+	for _, score := range scores {
+		row, err := getPlaylistByID(ctx, db, score.PlaylistID)
+		if err != nil {
+			return nil, fmt.Errorf("error getPlaylistByID: %w", err)
+		}
+		// 計算後に非公開、非表示になったものは除外
+		if row == nil || !row.IsPublic || row.IsHidden {
+			continue
+		}
+		rows = append(rows, *row)
+		scoreByPlaylistULID[row.ULID] = score.Score
+	}
+	// banされていたら除外
+	summaries, err := getPublicPlaylistSummaries(ctx, db, rows, userAccount, recommendationLimit)
+	if err != nil {
+		return nil, fmt.Errorf("error getPublicPlaylistSummaries: %w", err)
+	}
+	playlists := make([]RecommendedPlaylist, 0, len(summaries))
+	for _, playlist := range summaries {
+		playlists = append(playlists, RecommendedPlaylist{Playlist: playlist, Score: scoreByPlaylistULID[playlist.ULID]})
+	}
+	return playlists, nil
+}
+
+func recommendedPlaylistsResponse(c echo.Context, kind string) error {
+	// ログインは不要
+	userAccount, err := getViewerUserAccount(c)
+	if err != nil {
+		c.Logger().Errorf("error getViewerUserAccount: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	playlistULID := c.Param("playlistUlid")
+	if playlistULID == "" {
+		return errorResponse(c, 400, "bad playlist ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", playlistULID); matched {
+		return errorResponse(c, 400, "bad playlist ulid")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	playlist, err := getPlaylistByULID(ctx, conn, playlistULID)
+	if err != nil {
+		c.Logger().Errorf("error getPlaylistByULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if playlist == nil {
+		return errorResponse(c, 404, "playlist not found")
+	}
+	// 詳細を見れないプレイリストのおすすめは返さない
+	if !canViewPlaylist(playlist, userAccount, c.QueryParam("share_token")) ||
+		(playlist.UserAccount != userAccount && playlist.IsHidden) {
+		return errorResponse(c, 404, "playlist not found")
+	}
+
+	playlists, err := getRecommendedPlaylists(ctx, conn, recommendationKey{kind: kind, playlistID: playlist.ID}, userAccount)
+	if err != nil {
+		c.Logger().Errorf("error getRecommendedPlaylists: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := GetRecommendedPlaylistsResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Playlists: playlists,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// GET /api/playlist/:playlistUlid/similar
+
+func apiPlaylistSimilarHandler(c echo.Context) error {
+	return recommendedPlaylistsResponse(c, recommendationKindSimilar)
+}
+
+// GET /api/playlist/:playlistUlid/also_favorited
+
+func apiPlaylistAlsoFavoritedHandler(c echo.Context) error {
+	return recommendedPlaylistsResponse(c, recommendationKindAlsoFavorited)
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	reportTargetPlaylist = "playlist"
+	reportTargetUser     = "user"
+
+	reportActionDismiss      = "dismiss"
+	reportActionHidePlaylist = "hide_playlist"
+	reportActionBanUser      = "ban_user"
+)
+
+var reportCategories = map[string]struct{}{
+	"spam":       {},
+	"offensive":  {},
+	"harassment": {},
+	"copyright":  {},
+	"other":      {},
+}
+
+func getOpenReportByReporter(ctx context.Context, db connOrTx, targetType, targetID, reporterAccount string) (*ReportRow, error) {
+	var result []ReportRow
+	if err := db.SelectContext(
+		ctx,
+		&result,
+		"SELECT * FROM report WHERE `resolution_id` = 0 AND `target_type` = ? AND `target_id` = ? AND `reporter_account` = ?",
+		targetType, targetID, reporterAccount,
+	); err != nil {
+		return nil, fmt.Errorf(
+			"error Select report by target_type=%s, target_id=%s, reporter_account=%s: %w",
+			targetType, targetID, reporterAccount, err,
+		)
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return &result[0], nil
+}
+
+func getOpenReportsCountByTarget(ctx context.Context, db connOrTx, targetType, targetID string) (int, error) {
+	var count int
+	if err := db.GetContext(
+		ctx,
+		&count,
+		"SELECT COUNT(*) AS cnt FROM report WHERE `resolution_id` = 0 AND `target_type` = ? AND `target_id` = ?",
+		targetType, targetID,
+	); err != nil {
+		return 0, fmt.Errorf(
+			"error Get count of report by target_type=%s, target_id=%s: %w",
+			targetType, targetID, err,
+		)
+	}
+	return count, nil
+}
+
+func toReportResolution(row ReportResolutionRow) ReportResolution {
+	return ReportResolution{
+		ID:           row.ID,
+		TargetType:   row.TargetType,
+		TargetID:     row.TargetID,
+		Action:       row.Action,
+		Note:         row.Note,
+		AdminAccount: row.AdminAccount,
+		ReportCount:  row.ReportCount,
+		CreatedAt:    row.CreatedAt,
+	}
+}
+
+// POST /api/report
+
+func apiReportHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	var req ReportRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to ReportRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	// validation
+	if req.TargetType != reportTargetPlaylist && req.TargetType != reportTargetUser {
+		return errorResponse(c, 400, "invalid target_type")
+	}
+	if req.TargetID == "" || 191 < len(req.TargetID) {
+		return errorResponse(c, 400, "invalid target_id")
+	}
+	if matched, _ := regexp.MatchString(`[^a-zA-Z0-9\-_]`, req.TargetID); matched {
+		return errorResponse(c, 400, "invalid target_id")
+	}
+	if _, ok := reportCategories[req.Category]; !ok {
+		return errorResponse(c, 400, "invalid category")
+	}
+	if 1000 < utf8.RuneCountInString(req.Comment) {
+		return errorResponse(c, 400, "invalid comment")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	// 通報対象が存在し、通報者から見えることを確認
+	switch req.TargetType {
+	case reportTargetPlaylist:
+		playlist, err := getPlaylistByULID(ctx, conn, req.TargetID)
+		if err != nil {
+			c.Logger().Errorf("error getPlaylistByULID: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		if playlist == nil {
+			return errorResponse(c, 404, "playlist not found")
+		}
+		if playlist.UserAccount == user.Account {
+			return errorResponse(c, 400, "do not report own playlist")
+		}
+		if !playlist.IsPublic || playlist.IsHidden {
+			return errorResponse(c, 404, "playlist not found")
+		}
+	case reportTargetUser:
+		if req.TargetID == user.Account {
+			return errorResponse(c, 400, "do not report yourself")
+		}
+		target, err := getUserByAccount(ctx, conn, req.TargetID)
+		if err != nil {
+			c.Logger().Errorf("error getUserByAccount: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		if target == nil {
+			return errorResponse(c, 404, "user not found")
+		}
+	}
+
+	// 同じ通報者による未対応の通報があれば、新たには登録しない
+	report, err := getOpenReportByReporter(ctx, conn, req.TargetType, req.TargetID, user.Account)
+	if err != nil {
+		c.Logger().Errorf("error getOpenReportByReporter: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	var reportID int
+	if report != nil {
+		reportID = report.ID
+	} else {
+		createdTimestamp := time.Now()
+		res, err := conn.ExecContext(
+			ctx,
+			"INSERT INTO report (`target_type`, `target_id`, `reporter_account`, `category`, `comment`, `created_at`) VALUES (?, ?, ?, ?, ?, ?)",
+			req.TargetType, req.TargetID, user.Account, req.Category, req.Comment, createdTimestamp,
+		)
+		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 {
+			// 同時に同じ通報が登録された 先に登録された通報のIDを返す
+			report, err := getOpenReportByReporter(ctx, conn, req.TargetType, req.TargetID, user.Account)
+			if err != nil {
+				c.Logger().Errorf("error getOpenReportByReporter: %s", err)
+				return errorResponse(c, 500, "internal server error")
+			}
+			if report == nil {
+				c.Logger().Errorf(
+					"error open report not found after duplicate entry by target_type=%s, target_id=%s, reporter_account=%s",
+					req.TargetType, req.TargetID, user.Account,
+				)
+				return errorResponse(c, 500, "internal server error")
+			}
+			reportID = report.ID
+		} else if err != nil {
+			c.Logger().Errorf(
+				"error Insert report by target_type=%s, target_id=%s, reporter_account=%s, category=%s, created_at=%s: %s",
+				req.TargetType, req.TargetID, user.Account, req.Category, createdTimestamp, err,
+			)
+			return errorResponse(c, 500, "internal server error")
+		} else {
+			id, err := res.LastInsertId()
+			if err != nil {
+				c.Logger().Errorf("error LastInsertId: %s", err)
+				return errorResponse(c, 500, "internal server error")
+			}
+			reportID = int(id)
+		}
+	}
+
+	body := ReportResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		ReportID: reportID,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// GET /api/admin/reports
+
+func apiAdminReportsHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	// 管理者userであることを確認,でなければ403
+	if !isAdminUser(user.Account) {
+		return errorResponse(c, 403, "not admin user")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	var reports []ReportRow
+	if err := conn.SelectContext(
+		ctx,
+		&reports,
+		"SELECT * FROM report WHERE `resolution_id` = 0 ORDER BY created_at ASC",
+	); err != nil {
+		c.Logger().Errorf("error Select report by resolution_id=0: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	// 通報対象ごとにまとめる
+	targets := make([]ReportTarget, 0, len(reports))
+	indexes := make(map[string]int, len(reports))
+	for _, row := range reports {
+		key := row.TargetType + ":" + row.TargetID
+		i, ok := indexes[key]
+		if !ok {
+			i = len(targets)
+			indexes[key] = i
+			targets = append(targets, ReportTarget{
+				TargetType:      row.TargetType,
+				TargetID:        row.TargetID,
+				Categories:      map[string]int{},
+				FirstReportedAt: row.CreatedAt,
+				Reports:         []Report{},
+			})
+		}
+		t := &targets[i]
+		t.ReportCount++
+		t.Categories[row.Category]++
+		t.LastReportedAt = row.CreatedAt
+		t.Reports = append(t.Reports, Report{
+			ID:              row.ID,
+			ReporterAccount: row.ReporterAccount,
+			Category:        row.Category,
+			Comment:         row.Comment,
+			CreatedAt:       row.CreatedAt,
+		})
+	}
+
+	for i := range targets {
+		t := &targets[i]
+		switch t.TargetType {
+		case reportTargetPlaylist:
+			playlist, err := getPlaylistByULID(ctx, conn, t.TargetID)
+			if err != nil {
+				c.Logger().Errorf("error getPlaylistByULID: %s", err)
+				return errorResponse(c, 500, "internal server error")
+			}
+			if playlist != nil {
+				t.TargetName = playlist.Name
+			}
+		case reportTargetUser:
+			target, err := getUserByAccount(ctx, conn, t.TargetID)
+			if err != nil {
+				c.Logger().Errorf("error getUserByAccount: %s", err)
+				return errorResponse(c, 500, "internal server error")
+			}
+			if target != nil {
+				t.TargetName = target.DisplayName
+			}
+		}
+	}
+
+	// 通報の多いものから対応する 同数なら先に通報されたものから
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].ReportCount > targets[j].ReportCount
+	})
+
+	body := AdminReportsResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Targets: targets,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/admin/reports/resolve
+
+func apiAdminReportsResolveHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	// 管理者userであることを確認,でなければ403
+	if !isAdminUser(user.Account) {
+		return errorResponse(c, 403, "not admin user")
+	}
+
+	var req AdminReportsResolveRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AdminReportsResolveRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	// validation
+	if req.TargetType != reportTargetPlaylist && req.TargetType != reportTargetUser {
+		return errorResponse(c, 400, "invalid target_type")
+	}
+	if req.TargetID == "" {
+		return errorResponse(c, 400, "invalid target_id")
+	}
+	if 191 < utf8.RuneCountInString(req.Note) {
+		return errorResponse(c, 400, "invalid note")
+	}
+	switch req.Action {
+	case reportActionDismiss, reportActionBanUser:
+	case reportActionHidePlaylist:
+		if req.TargetType != reportTargetPlaylist {
+			return errorResponse(c, 400, "invalid action")
+		}
+		// 作成者に理由として表示するので必須
+		if req.Note == "" {
+			return errorResponse(c, 400, "invalid note")
+		}
+	default:
+		return errorResponse(c, 400, "invalid action")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Errorf("error conn.BeginTxx: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	reportCount, err := getOpenReportsCountByTarget(ctx, tx, req.TargetType, req.TargetID)
+	if err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error getOpenReportsCountByTarget: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if reportCount == 0 {
+		tx.Rollback()
+		return errorResponse(c, 400, "no open reports")
+	}
+
+	// banする対象 プレイリストの場合は作成者
+	banAccount := req.TargetID
+	if req.TargetType == reportTargetPlaylist && req.Action != reportActionDismiss {
+		playlist, err := getPlaylistByULID(ctx, tx, req.TargetID)
+		if err != nil {
+			tx.Rollback()
+			c.Logger().Errorf("error getPlaylistByULID: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+		if playlist == nil {
+			tx.Rollback()
+			return errorResponse(c, 400, "playlist not found")
+		}
+		banAccount = playlist.UserAccount
+		if req.Action == reportActionHidePlaylist {
+			if err := moderatePlaylist(ctx, tx, playlist.ID, moderationActionHide, req.Note); err != nil {
+				tx.Rollback()
+				c.Logger().Errorf("error moderatePlaylist: %s", err)
+				return errorResponse(c, 500, "internal server error")
+			}
+		}
+	}
+	if req.Action == reportActionBanUser {
+		if err := updateUserIsBan(ctx, tx, banAccount, true); err != nil {
+			tx.Rollback()
+			c.Logger().Errorf("error updateUserIsBan: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+	}
+
+	resolution := ReportResolutionRow{
+		TargetType:   req.TargetType,
+		TargetID:     req.TargetID,
+		Action:       req.Action,
+		Note:         req.Note,
+		AdminAccount: user.Account,
+		ReportCount:  reportCount,
+		CreatedAt:    time.Now(),
+	}
+	res, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO report_resolution (`target_type`, `target_id`, `action`, `note`, `admin_account`, `report_count`, `created_at`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		resolution.TargetType, resolution.TargetID, resolution.Action, resolution.Note, resolution.AdminAccount, resolution.ReportCount, resolution.CreatedAt,
+	)
+	if err != nil {
+		tx.Rollback()
+		c.Logger().Errorf(
+			"error Insert report_resolution by target_type=%s, target_id=%s, action=%s: %s",
+			resolution.TargetType, resolution.TargetID, resolution.Action, err,
+		)
+		return errorResponse(c, 500, "internal server error")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error LastInsertId: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	resolution.ID = int(id)
+
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE report SET `resolution_id` = ? WHERE `resolution_id` = 0 AND `target_type` = ? AND `target_id` = ?",
+		resolution.ID, req.TargetType, req.TargetID,
+	); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf(
+			"error Update report by resolution_id=%d, target_type=%s, target_id=%s: %s",
+			resolution.ID, req.TargetType, req.TargetID, err,
+		)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("error tx.Commit: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := AdminReportsResolveResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Resolution: toReportResolution(resolution),
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// GET /api/admin/reports/history
+
+func apiAdminReportsHistoryHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	// 管理者userであることを確認,でなければ403
+	if !isAdminUser(user.Account) {
+		return errorResponse(c, 403, "not admin user")
+	}
+
+	// target_type, target_id が指定されていればその対象の履歴のみ
+	targetType := c.QueryParam("target_type")
+	targetID := c.QueryParam("target_id")
+	if (targetType == "") != (targetID == "") {
+		return errorResponse(c, 400, "target_type and target_id are required together")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	var rows []ReportResolutionRow
+	if targetType == "" {
+		err = conn.SelectContext(
+			ctx,
+			&rows,
+			"SELECT * FROM report_resolution ORDER BY created_at DESC LIMIT 100",
+		)
+	} else {
+		err = conn.SelectContext(
+			ctx,
+			&rows,
+			"SELECT * FROM report_resolution WHERE `target_type` = ? AND `target_id` = ? ORDER BY created_at DESC LIMIT 100",
+			targetType, targetID,
+		)
+	}
+	if err != nil {
+		c.Logger().Errorf("error Select report_resolution by target_type=%s, target_id=%s: %s", targetType, targetID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	resolutions := make([]ReportResolution, 0, len(rows))
+	for _, row := range rows {
+		resolutions = append(resolutions, toReportResolution(row))
+	}
+
+	body := AdminReportsHistoryResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Resolutions: resolutions,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
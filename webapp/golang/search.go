@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/unicode/norm"
+)
+
+// プレイリスト名の全文検索
+// 日本語の名前は単語に区切れないので、MySQLのngramパーサーによるFULLTEXT INDEXで部分一致を引く
+// ngram_token_size(2)より短い語はINDEXを使えないのでLIKEで探す
+
+const (
+	// my.cnf の ngram_token_size と合わせる
+	searchNgramSize = 2
+	// 検索語の最大長
+	maxSearchQueryLength = 64
+	// 空白で区切った検索語の最大数
+	maxSearchTerms = 5
+	// 1ページあたりの件数
+	searchResultsPerPage = 20
+)
+
+// 検索語を正規化して空白で区切る 全角英数字や半角カナを揃え、大文字小文字は区別しない
+func tokenizeSearchQuery(q string) ([]string, error) {
+	q = strings.ToLower(norm.NFKC.String(q))
+	if maxSearchQueryLength < utf8.RuneCountInString(q) {
+		return nil, fmt.Errorf("query is too long: max %d", maxSearchQueryLength)
+	}
+	terms := make([]string, 0, maxSearchTerms)
+	seen := make(map[string]struct{})
+	// フレーズ検索の区切りになるダブルクォートは取り除く
+	for _, term := range strings.Fields(strings.ReplaceAll(q, `"`, " ")) {
+		if _, ok := seen[term]; ok {
+			continue
+		}
+		seen[term] = struct{}{}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("query is empty")
+	}
+	if maxSearchTerms < len(terms) {
+		return nil, fmt.Errorf("too many terms: max %d", maxSearchTerms)
+	}
+	return terms, nil
+}
+
+// 全ての検索語を名前に含むプレイリストを探す
+// 関連度にお気に入り数を掛け合わせた順に並べる
+func buildPlaylistSearchQuery(terms []string) (string, []interface{}) {
+	var phrases []string
+	var likes []string
+	for _, term := range terms {
+		if utf8.RuneCountInString(term) < searchNgramSize {
+			likes = append(likes, term)
+			continue
+		}
+		// ngramが連続して現れるものだけ一致させるため、フレーズとして全て必須にする
+		phrases = append(phrases, `+"`+term+`"`)
+	}
+
+	var selectArgs []interface{}
+	relevance := "1"
+	conditions := []string{"playlist.is_public = ?", "playlist.is_hidden = ?", "user.is_ban = ?"}
+	whereArgs := []interface{}{true, false, false}
+	if len(phrases) > 0 {
+		against := strings.Join(phrases, " ")
+		relevance = "MATCH (playlist.name) AGAINST (? IN BOOLEAN MODE)"
+		selectArgs = append(selectArgs, against)
+		conditions = append(conditions, relevance)
+		whereArgs = append(whereArgs, against)
+	}
+	for _, term := range likes {
+		conditions = append(conditions, "playlist.name LIKE ?")
+		whereArgs = append(whereArgs, "%"+escapeLike(term)+"%")
+	}
+
+	query := "SELECT hit.id FROM (" +
+		"SELECT playlist.id, " + relevance + " AS relevance," +
+		" (SELECT COUNT(*) FROM playlist_favorite WHERE playlist_favorite.playlist_id = playlist.id) AS favorite_count" +
+		" FROM playlist JOIN user ON user.account = playlist.user_account" +
+		" WHERE " + strings.Join(conditions, " AND ") +
+		") AS hit ORDER BY hit.relevance * (1 + LN(1 + hit.favorite_count)) DESC, hit.id DESC LIMIT ? OFFSET ?"
+	return query, append(selectArgs, whereArgs...)
+}
+
+func searchPlaylistSummaries(ctx context.Context, db connOrTx, terms []string, page int, userAccount string) ([]Playlist, bool, error) {
+	query, args := buildPlaylistSearchQuery(terms)
+	// 次のページがあるか知るため1件多く取る
+	args = append(args, searchResultsPerPage+1, (page-1)*searchResultsPerPage)
+	var ids []int
+	if err := db.SelectContext(ctx, &ids, query, args...); err != nil {
+		return nil, false, fmt.Errorf("error Select playlist by search terms=%v: %w", terms, err)
+	}
+	hasNext := len(ids) > searchResultsPerPage
+	if hasNext {
+		ids = ids[:searchResultsPerPage]
+	}
+
+	rows := make([]PlaylistRow, 0, len(ids))
+	for _, id := range ids {
+		row, err := getPlaylistByID(ctx, db, id)
+		if err != nil {
+			return nil, false, fmt.Errorf("error getPlaylistByID: %w", err)
+		}
+		if row == nil {
+			continue
+		}
+		rows = append(rows, *row)
+	}
+	playlists, err := getPublicPlaylistSummaries(ctx, db, rows, userAccount, len(rows))
+	if err != nil {
+		return nil, false, fmt.Errorf("error getPublicPlaylistSummaries: %w", err)
+	}
+	return playlists, hasNext, nil
+}
+
+// GET /api/playlists/search
+
+func apiPlaylistSearchHandler(c echo.Context) error {
+	// ログインは不要
+	userAccount, err := getViewerUserAccount(c)
+	if err != nil {
+		c.Logger().Errorf("error getViewerUserAccount: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	q := c.QueryParam("q")
+	terms, err := tokenizeSearchQuery(q)
+	if err != nil {
+		return errorResponse(c, 400, "invalid q")
+	}
+	page, ok := getPageFromParam(c)
+	if !ok {
+		return errorResponse(c, 400, "invalid page")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	playlists, hasNext, err := searchPlaylistSummaries(ctx, conn, terms, page, userAccount)
+	if err != nil {
+		c.Logger().Errorf("error searchPlaylistSummaries: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := SearchPlaylistsResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Query:     q,
+		Playlists: playlists,
+		Page:      page,
+		HasNext:   hasNext,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+// ログイン中のセッションの管理
+// セッションの中身は暗号化されていて検索できないので、誰のセッションかは user_session に別に記録する
+// セッションを無効にするときは sessions_golang の行を消す
+
+const (
+	// 最終アクセス日時はこれより細かくは更新しない
+	userSessionLastSeenResolution = time.Minute
+	maxUserAgentLength            = 191
+	// 記録のないセッションを探すときに一度に読む数
+	userSessionBackfillBatchSize = 500
+)
+
+// 最後に記録した日時をセッションごとに覚えておき、リクエストのたびにDBへ書き込まないようにする
+// プロセス内で覚えるので、再起動したあとは最初のアクセスで記録し直す
+type sessionActivity struct {
+	mu          sync.Mutex
+	seen        map[string]sessionActivityEntry
+	lastSweepAt time.Time
+}
+
+type sessionActivityEntry struct {
+	userAccount string
+	seenAt      time.Time
+}
+
+var userSessionActivity = &sessionActivity{
+	seen: make(map[string]sessionActivityEntry),
+}
+
+// 同じユーザーで最近記録したばかりならtrue
+func (a *sessionActivity) isFresh(now time.Time, sessionID string, userAccount string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := a.seen[sessionID]
+	return ok && entry.userAccount == userAccount && now.Sub(entry.seenAt) < userSessionLastSeenResolution
+}
+
+func (a *sessionActivity) record(now time.Time, sessionID string, userAccount string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if userSessionLastSeenResolution <= now.Sub(a.lastSweepAt) {
+		a.lastSweepAt = now
+		for id, entry := range a.seen {
+			if userSessionLastSeenResolution <= now.Sub(entry.seenAt) {
+				delete(a.seen, id)
+			}
+		}
+	}
+	a.seen[sessionID] = sessionActivityEntry{userAccount: userAccount, seenAt: now}
+}
+
+func (a *sessionActivity) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seen = make(map[string]sessionActivityEntry)
+	a.lastSweepAt = time.Time{}
+}
+
+func getSessionRowID(sess *sessions.Session) (int, bool) {
+	id, err := strconv.Atoi(sess.ID)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+func truncateUserAgent(userAgent string) string {
+	runes := []rune(userAgent)
+	if maxUserAgentLength < len(runes) {
+		return string(runes[:maxUserAgentLength])
+	}
+	return userAgent
+}
+
+// ログイン中のセッションへのアクセスを記録する
+// 古い鍵で署名されたセッションの署名し直しと最終アクセス日時の更新は、セッションごとに1分に1回までにする
+func refreshUserSession(c echo.Context, sess *sessions.Session, userAccount string) error {
+	if userSessionActivity.isFresh(time.Now(), sess.ID, userAccount) {
+		return nil
+	}
+	if err := resignSession(c, sess); err != nil {
+		return fmt.Errorf("error resignSession: %w", err)
+	}
+	return touchUserSession(c, db, sess, userAccount)
+}
+
+// ログインしたセッションを記録する 記録がなければ作り、あれば最終アクセス日時を更新する
+// ログインしたままで別のユーザーでログインし直すとセッションが使い回されるので、ユーザーも更新する
+// IPアドレスはnginxが X-Real-IP で渡す接続元のもの(e.IPExtractor)で、利用者が送ったヘッダーは使わない
+func touchUserSession(c echo.Context, db connOrTx, sess *sessions.Session, userAccount string) error {
+	sessionID, ok := getSessionRowID(sess)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	sessionULID, err := ulid.New(ulid.Timestamp(now), entropy)
+	if err != nil {
+		return fmt.Errorf("error ulid.New: %w", err)
+	}
+	if _, err := db.ExecContext(
+		c.Request().Context(),
+		"INSERT INTO user_session (`session_id`, `ulid`, `user_account`, `user_agent`, `ip_address`, `created_at`, `last_seen_at`) VALUES (?, ?, ?, ?, ?, ?, ?)"+
+			" ON DUPLICATE KEY UPDATE `last_seen_at` = IF(`last_seen_at` < ? OR `user_account` != VALUES(`user_account`), VALUES(`last_seen_at`), `last_seen_at`),"+
+			" `user_account` = VALUES(`user_account`)",
+		sessionID, sessionULID.String(), userAccount, truncateUserAgent(c.Request().UserAgent()), c.RealIP(), now, now,
+		now.Add(-userSessionLastSeenResolution),
+	); err != nil {
+		return fmt.Errorf("error Upsert user_session by session_id=%d: %w", sessionID, err)
+	}
+	userSessionActivity.record(now, sess.ID, userAccount)
+	return nil
+}
+
+type userSessionBackfillRow struct {
+	ID          int       `db:"id"`
+	SessionData string    `db:"session_data"`
+	CreatedOn   time.Time `db:"created_on"`
+	ModifiedOn  time.Time `db:"modified_on"`
+}
+
+// user_session を作る前にログインしたセッションを記録する 起動したときに一度だけ実行する
+// セッションの中身は暗号化されていてSQLでは読めないので、ここで読んで誰のセッションかを調べる
+// 端末の情報は分からないので空にしておく
+func backfillUserSessions(ctx context.Context) (int, error) {
+	now := time.Now()
+	lastID := 0
+	inserted := 0
+	for {
+		var rows []userSessionBackfillRow
+		if err := db.SelectContext(
+			ctx,
+			&rows,
+			"SELECT s.id, s.session_data, COALESCE(s.created_on, s.modified_on) AS created_on, s.modified_on FROM "+sessionTableName+" AS s"+
+				" LEFT JOIN user_session ON user_session.session_id = s.id"+
+				" WHERE s.id > ? AND s.expires_on > ? AND user_session.session_id IS NULL ORDER BY s.id LIMIT ?",
+			lastID, now, userSessionBackfillBatchSize,
+		); err != nil {
+			return inserted, fmt.Errorf("error Select %s: %w", sessionTableName, err)
+		}
+		for _, row := range rows {
+			lastID = row.ID
+			values := make(map[interface{}]interface{})
+			if err := securecookie.DecodeMulti(sessionCookieName, row.SessionData, &values, sessionCodecs...); err != nil {
+				continue
+			}
+			// ログインしていないセッション
+			userAccount, ok := values["user_account"].(string)
+			if !ok || userAccount == "" {
+				continue
+			}
+			sessionULID, err := ulid.New(ulid.Timestamp(row.CreatedOn), entropy)
+			if err != nil {
+				return inserted, fmt.Errorf("error ulid.New: %w", err)
+			}
+			// 先にアクセスされて記録されていれば、そちらを残す
+			if _, err := db.ExecContext(
+				ctx,
+				"INSERT IGNORE INTO user_session (`session_id`, `ulid`, `user_account`, `user_agent`, `ip_address`, `created_at`, `last_seen_at`) VALUES (?, ?, ?, '', '', ?, ?)",
+				row.ID, sessionULID.String(), userAccount, row.CreatedOn, row.ModifiedOn,
+			); err != nil {
+				return inserted, fmt.Errorf("error Insert user_session by session_id=%d: %w", row.ID, err)
+			}
+			inserted++
+		}
+		if len(rows) < userSessionBackfillBatchSize {
+			return inserted, nil
+		}
+	}
+}
+
+// main から goroutine で起動する
+func runUserSessionBackfill(logger echo.Logger) {
+	inserted, err := backfillUserSessions(context.Background())
+	if err != nil {
+		logger.Errorf("error backfillUserSessions: %s", err)
+		return
+	}
+	if 0 < inserted {
+		logger.Infof("backfilled %d user sessions", inserted)
+	}
+}
+
+func deleteUserSessionsWhere(ctx context.Context, db connOrTx, condition string, args ...interface{}) error {
+	if _, err := db.ExecContext(
+		ctx,
+		"DELETE FROM "+sessionTableName+" WHERE id IN (SELECT session_id FROM user_session WHERE "+condition+")",
+		args...,
+	); err != nil {
+		return fmt.Errorf("error Delete %s by %s: %w", sessionTableName, condition, err)
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM user_session WHERE "+condition, args...); err != nil {
+		return fmt.Errorf("error Delete user_session by %s: %w", condition, err)
+	}
+	return nil
+}
+
+// ユーザーの全てのセッションを無効にする
+func revokeUserSessions(ctx context.Context, db connOrTx, userAccount string) error {
+	return deleteUserSessionsWhere(ctx, db, "user_account = ?", userAccount)
+}
+
+// ログアウトしたセッションを無効にする cookieを消すだけではセッションが残るため
+func revokeCurrentSession(ctx context.Context, db connOrTx, sess *sessions.Session) error {
+	sessionID, ok := getSessionRowID(sess)
+	if !ok {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM "+sessionTableName+" WHERE id = ?", sessionID); err != nil {
+		return fmt.Errorf("error Delete %s by id=%d: %w", sessionTableName, sessionID, err)
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM user_session WHERE session_id = ?", sessionID); err != nil {
+		return fmt.Errorf("error Delete user_session by session_id=%d: %w", sessionID, err)
+	}
+	return nil
+}
+
+// cookieのセッションでログインしているユーザーと、そのセッションを返す
+// セッションの管理はtokenではできない
+func validateCookieSession(c echo.Context) (*UserRow, *sessions.Session, error) {
+	if _, ok := getBearerToken(c.Request()); ok {
+		return nil, nil, nil
+	}
+	user, ok, err := validateSession(c)
+	if err != nil || !ok || user == nil {
+		return nil, nil, err
+	}
+	sess, err := getSession(c.Request())
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getSession: %w", err)
+	}
+	return user, sess, nil
+}
+
+// GET /api/sessions
+
+func apiSessionsHandler(c echo.Context) error {
+	user, sess, err := validateCookieSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateCookieSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	currentSessionID, _ := getSessionRowID(sess)
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	// 期限切れのセッションは含めない
+	var rows []UserSessionRow
+	if err := conn.SelectContext(
+		ctx,
+		&rows,
+		"SELECT user_session.* FROM user_session JOIN "+sessionTableName+" ON "+sessionTableName+".id = user_session.session_id"+
+			" WHERE user_session.user_account = ? AND "+sessionTableName+".expires_on > ?"+
+			" ORDER BY user_session.last_seen_at DESC, user_session.session_id DESC",
+		user.Account, time.Now(),
+	); err != nil {
+		c.Logger().Errorf("error Select user_session by user_account=%s: %s", user.Account, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	userSessions := make([]UserSession, 0, len(rows))
+	for _, row := range rows {
+		userSessions = append(userSessions, UserSession{
+			ULID:       row.ULID,
+			UserAgent:  row.UserAgent,
+			IPAddress:  row.IPAddress,
+			IsCurrent:  row.SessionID == currentSessionID,
+			CreatedAt:  row.CreatedAt,
+			LastSeenAt: row.LastSeenAt,
+		})
+	}
+
+	body := GetSessionsResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Sessions: userSessions,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/session/:sessionUlid/revoke
+
+func apiSessionRevokeHandler(c echo.Context) error {
+	user, _, err := validateCookieSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateCookieSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	sessionULID := c.Param("sessionUlid")
+	if sessionULID == "" {
+		return errorResponse(c, 404, "bad session ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", sessionULID); matched {
+		return errorResponse(c, 404, "bad session ulid")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	// 他のユーザーのセッションは存在しないものとして扱う
+	var count int
+	if err := conn.GetContext(
+		ctx,
+		&count,
+		"SELECT COUNT(*) FROM user_session WHERE ulid = ? AND user_account = ?",
+		sessionULID, user.Account,
+	); err != nil {
+		c.Logger().Errorf("error Get count of user_session by ulid=%s: %s", sessionULID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if count == 0 {
+		return errorResponse(c, 404, "session not found")
+	}
+	// 今のセッションを指定したときはログアウトと同じになる
+	if err := deleteUserSessionsWhere(ctx, conn, "ulid = ? AND user_account = ?", sessionULID, user.Account); err != nil {
+		c.Logger().Errorf("error deleteUserSessionsWhere: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := BasicResponse{
+		Result: true,
+		Status: 200,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/sessions/revoke_others
+
+func apiSessionsRevokeOthersHandler(c echo.Context) error {
+	user, sess, err := validateCookieSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateCookieSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	currentSessionID, _ := getSessionRowID(sess)
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	if err := deleteUserSessionsWhere(ctx, conn, "user_account = ? AND session_id != ?", user.Account, currentSessionID); err != nil {
+		c.Logger().Errorf("error deleteUserSessionsWhere: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := BasicResponse{
+		Result: true,
+		Status: 200,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
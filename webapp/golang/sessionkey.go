@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// セッションの署名・暗号化の鍵
+//
+//	ISUCON_SESSION_KEYS="新しい署名鍵:新しい暗号化鍵,古い署名鍵"
+//
+// 新しい順にカンマ区切りで並べる 先頭の鍵で署名し、2つ目以降は検証にのみ使う
+// 暗号化鍵は省略でき、指定するときはAESの鍵長(16, 24, 32バイト)にする
+
+const (
+	// 未設定のときの鍵 以前のハードコードされていた鍵と同じ
+	defaultSessionKeys = "powawa"
+	// 署名し直すときに一度に読むセッション数
+	sessionResignBatchSize = 500
+)
+
+var sessionCodecs []securecookie.Codec
+
+// 鍵の設定を securecookie.CodecsFromPairs に渡す形にする
+func parseSessionKeys(value string) ([][]byte, error) {
+	var keyPairs [][]byte
+	for i, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		hashKey, blockKey, _ := strings.Cut(entry, ":")
+		if hashKey == "" {
+			return nil, fmt.Errorf("session key #%d: empty hash key", i+1)
+		}
+		var block []byte
+		if blockKey != "" {
+			switch len(blockKey) {
+			case 16, 24, 32:
+			default:
+				return nil, fmt.Errorf("session key #%d: block key must be 16, 24 or 32 bytes", i+1)
+			}
+			block = []byte(blockKey)
+		}
+		keyPairs = append(keyPairs, []byte(hashKey), block)
+	}
+	return keyPairs, nil
+}
+
+func loadSessionKeys() ([][]byte, error) {
+	keyPairs, err := parseSessionKeys(getEnv("ISUCON_SESSION_KEYS", defaultSessionKeys))
+	if err != nil {
+		return nil, err
+	}
+	sessionCodecs = securecookie.CodecsFromPairs(keyPairs...)
+	return keyPairs, nil
+}
+
+// 古い鍵で署名されたセッションを今の鍵で署名し直す 有効期限は延ばさない
+// cookieは書き換えるまで古い鍵のままなので、アクセスしたときにここで書き換える
+func resignSession(c echo.Context, sess *sessions.Session) error {
+	if len(sessionCodecs) < 2 || sess.IsNew {
+		return nil
+	}
+	cookie, err := c.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	var id string
+	if err := sessionCodecs[0].Decode(sessionCookieName, cookie.Value, &id); err == nil {
+		return nil
+	}
+	expiresOn, ok := sess.Values["expires_on"].(time.Time)
+	if !ok {
+		return nil
+	}
+	maxAge := int(time.Until(expiresOn).Seconds())
+	if maxAge <= 0 {
+		return nil
+	}
+
+	values := make(map[interface{}]interface{}, len(sess.Values))
+	for k, v := range sess.Values {
+		if k != "expires_on" {
+			values[k] = v
+		}
+	}
+	data, err := sessionCodecs[0].Encode(sessionCookieName, values)
+	if err != nil {
+		return fmt.Errorf("error encode session values: %w", err)
+	}
+	if _, err := db.ExecContext(
+		c.Request().Context(),
+		"UPDATE "+sessionTableName+" SET session_data = ? WHERE id = ?",
+		data, sess.ID,
+	); err != nil {
+		return fmt.Errorf("error Update %s by id=%s: %w", sessionTableName, sess.ID, err)
+	}
+	encoded, err := sessionCodecs[0].Encode(sessionCookieName, sess.ID)
+	if err != nil {
+		return fmt.Errorf("error encode session id: %w", err)
+	}
+	options := *sess.Options
+	options.MaxAge = maxAge
+	http.SetCookie(c.Response(), sessions.NewCookie(sessionCookieName, encoded, &options))
+	return nil
+}
+
+// 古い鍵で署名されたセッションの保存内容を署名し直す、または無効にする
+//
+//	./isucon session-keys [-expire] [-dry-run]
+//
+// どの鍵でも検証できないセッションは使えないので削除する
+// cookieは利用者がアクセスしたときに署名し直されるので、古い鍵を設定から外すのはセッションの有効期限(1日)が過ぎてからにする
+// すぐに外したいときは -expire で古い鍵のセッションを無効にする(ログアウトさせる)
+
+type sessionResignStats struct {
+	Current  int
+	Resigned int
+	Expired  int
+	Invalid  int
+}
+
+type sessionResigner struct {
+	db     *sqlx.DB
+	expire bool
+	dryRun bool
+	out    io.Writer
+	stats  sessionResignStats
+}
+
+type sessionDataRow struct {
+	ID          int    `db:"id"`
+	SessionData string `db:"session_data"`
+}
+
+func runSessionKeysCommand(args []string) error {
+	fs := flag.NewFlagSet("session-keys", flag.ExitOnError)
+	expire := fs.Bool("expire", false, "expire sessions signed with retired keys instead of re-signing them")
+	dryRun := fs.Bool("dry-run", false, "print what would change without writing to the database")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s session-keys [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("too many arguments")
+	}
+
+	if _, err := loadSessionKeys(); err != nil {
+		return fmt.Errorf("invalid ISUCON_SESSION_KEYS: %w", err)
+	}
+	dbx, err := connectDB()
+	if err != nil {
+		return fmt.Errorf("failed to connect db: %w", err)
+	}
+	defer dbx.Close()
+
+	r := &sessionResigner{
+		db:     dbx,
+		expire: *expire,
+		dryRun: *dryRun,
+		out:    os.Stdout,
+	}
+	if err := r.run(context.Background()); err != nil {
+		return err
+	}
+
+	s := r.stats
+	fmt.Fprintf(
+		r.out,
+		"session: current=%d resigned=%d expired=%d invalid=%d\n",
+		s.Current, s.Resigned, s.Expired, s.Invalid,
+	)
+	if r.dryRun {
+		fmt.Fprintln(r.out, "dry-run: no changes were written")
+	}
+	return nil
+}
+
+func (r *sessionResigner) run(ctx context.Context) error {
+	// 期限切れのセッションは読み込まれないので対象にしない
+	now := time.Now()
+	lastID := 0
+	for {
+		var rows []sessionDataRow
+		if err := r.db.SelectContext(
+			ctx,
+			&rows,
+			"SELECT id, session_data FROM "+sessionTableName+" WHERE id > ? AND expires_on > ? ORDER BY id LIMIT ?",
+			lastID, now, sessionResignBatchSize,
+		); err != nil {
+			return fmt.Errorf("error Select %s: %w", sessionTableName, err)
+		}
+		for _, row := range rows {
+			if err := r.process(ctx, row); err != nil {
+				return err
+			}
+			lastID = row.ID
+		}
+		if len(rows) < sessionResignBatchSize {
+			return nil
+		}
+	}
+}
+
+func (r *sessionResigner) process(ctx context.Context, row sessionDataRow) error {
+	values := make(map[interface{}]interface{})
+	if err := sessionCodecs[0].Decode(sessionCookieName, row.SessionData, &values); err == nil {
+		r.stats.Current++
+		return nil
+	}
+	if err := securecookie.DecodeMulti(sessionCookieName, row.SessionData, &values, sessionCodecs[1:]...); err != nil {
+		r.stats.Invalid++
+		fmt.Fprintf(r.out, "session id=%d: no key can verify, delete\n", row.ID)
+		return r.delete(ctx, row.ID)
+	}
+	if r.expire {
+		r.stats.Expired++
+		fmt.Fprintf(r.out, "session id=%d: signed with a retired key, expire\n", row.ID)
+		return r.delete(ctx, row.ID)
+	}
+
+	r.stats.Resigned++
+	if r.dryRun {
+		return nil
+	}
+	data, err := sessionCodecs[0].Encode(sessionCookieName, values)
+	if err != nil {
+		return fmt.Errorf("error encode session id=%d: %w", row.ID, err)
+	}
+	if _, err := r.db.ExecContext(
+		ctx,
+		"UPDATE "+sessionTableName+" SET session_data = ? WHERE id = ?",
+		data, row.ID,
+	); err != nil {
+		return fmt.Errorf("error Update %s by id=%d: %w", sessionTableName, row.ID, err)
+	}
+	return nil
+}
+
+func (r *sessionResigner) delete(ctx context.Context, id int) error {
+	if r.dryRun {
+		return nil
+	}
+	if err := deleteUserSessionsWhere(ctx, r.db, "session_id = ?", id); err != nil {
+		return err
+	}
+	// この変更より前に作られて user_session に記録がないセッション
+	if _, err := r.db.ExecContext(ctx, "DELETE FROM "+sessionTableName+" WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error Delete %s by id=%d: %w", sessionTableName, id, err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseSessionKeys(t *testing.T) {
+	block16 := strings.Repeat("b", 16)
+	block24 := strings.Repeat("c", 24)
+	block32 := strings.Repeat("d", 32)
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "default", value: defaultSessionKeys, want: []string{"powawa", ""}},
+		{name: "hash and block", value: "hash:" + block16, want: []string{"hash", block16}},
+		{name: "rotation", value: "new:" + block32 + ", old", want: []string{"new", block32, "old", ""}},
+		{name: "block 24 bytes", value: "hash:" + block24, want: []string{"hash", block24}},
+		{name: "colon in block key", value: "hash:" + strings.Repeat("e", 15) + ":", want: []string{"hash", strings.Repeat("e", 15) + ":"}},
+		{name: "empty", value: "", wantErr: true},
+		{name: "empty entry", value: "new,,old", wantErr: true},
+		{name: "empty hash key", value: ":" + block16, wantErr: true},
+		{name: "short block key", value: "hash:short", wantErr: true},
+		{name: "long block key", value: "hash:" + strings.Repeat("f", 33), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSessionKeys(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseSessionKeys(%q) returns no error", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSessionKeys(%q) returns error: %s", tt.value, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseSessionKeys(%q) returns %d keys, want %d", tt.value, len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				// 暗号化鍵を省略したときはnilにする
+				if want == "" && got[i] != nil {
+					t.Errorf("key #%d = %q, want nil", i, got[i])
+				}
+				if !bytes.Equal(got[i], []byte(want)) {
+					t.Errorf("key #%d = %q, want %q", i, got[i], want)
+				}
+			}
+		})
+	}
+}
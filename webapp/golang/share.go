@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 限定公開のプレイリスト
+// 一覧には出さず、share_tokenを知っている人だけが見れる
+
+const shareTokenBytes = 24
+
+func generateShareToken() (string, error) {
+	b := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error rand.Read: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// 作成者か、公開中か、限定公開でshare_tokenが一致すれば見れる
+func canViewPlaylist(playlist *PlaylistRow, viewerUserAccount string, shareToken string) bool {
+	if playlist.UserAccount == viewerUserAccount || playlist.IsPublic {
+		return true
+	}
+	if !playlist.IsUnlisted || playlist.ShareToken == "" || shareToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(playlist.ShareToken), []byte(shareToken)) == 1
+}
+
+// share_tokenは作成者にだけ返す
+func getPlaylistShareToken(playlist *PlaylistRow, viewerUserAccount string) string {
+	if playlist.UserAccount != viewerUserAccount {
+		return ""
+	}
+	return playlist.ShareToken
+}
+
+func updatePlaylistShareToken(ctx context.Context, db connOrTx, playlistID int, shareToken string, updatedAt time.Time) error {
+	if _, err := db.ExecContext(
+		ctx,
+		"UPDATE playlist SET `share_token` = ?, `updated_at` = ? WHERE `id` = ?",
+		shareToken, updatedAt, playlistID,
+	); err != nil {
+		return fmt.Errorf("error Update playlist share_token by id=%d: %w", playlistID, err)
+	}
+	return nil
+}
+
+// POST /api/playlist/:playlistUlid/share_token/rotate
+
+func apiPlaylistShareTokenRotateHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	playlist, err := getOwnPlaylistFromParam(c, conn, user.Account)
+	if playlist == nil {
+		return err
+	}
+	if !playlist.IsUnlisted {
+		return errorResponse(c, 400, "playlist is not unlisted")
+	}
+
+	// 新しいtokenにすると、以前のリンクでは見れなくなる
+	shareToken, err := generateShareToken()
+	if err != nil {
+		c.Logger().Errorf("error generateShareToken: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if err := updatePlaylistShareToken(ctx, conn, playlist.ID, shareToken, time.Now()); err != nil {
+		c.Logger().Errorf("error updatePlaylistShareToken: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	// 以前のリンクで購読している人は切断する
+	if err := publishPlaylistChanged(ctx, conn, playlist); err != nil {
+		c.Logger().Errorf("error publishPlaylistChanged: %s", err)
+	}
+
+	return playlistDetailResponse(c, conn, playlist.ULID, user.Account)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// スマートプレイリスト
+// 曲の一覧を持たず、保存した条件を表示のたびに song, artist に対して評価する
+
+type smartPlaylistField struct {
+	column  string
+	numeric bool
+}
+
+var smartPlaylistFields = map[string]smartPlaylistField{
+	"title":        {"song.title", false},
+	"artist":       {"artist.name", false},
+	"album":        {"song.album", false},
+	"genre":        {"song.genre", false},
+	"release_year": {"song.release_year", true},
+	"duration":     {"song.duration", true},
+	"track_number": {"song.track_number", true},
+}
+
+var smartPlaylistOps = map[string]string{
+	"=":        "=",
+	"!=":       "<>",
+	">":        ">",
+	">=":       ">=",
+	"<":        "<",
+	"<=":       "<=",
+	"contains": "LIKE",
+}
+
+var smartPlaylistSorts = map[string][]string{
+	"title":        {"song.title"},
+	"artist":       {"artist.name", "song.album", "song.track_number"},
+	"album":        {"song.album", "song.track_number"},
+	"release_year": {"song.release_year"},
+	"duration":     {"song.duration"},
+}
+
+const (
+	smartPlaylistMaxConditions = 10
+	// 通常のプレイリストと同じく最大80曲
+	smartPlaylistMaxLimit = 80
+)
+
+// 不正な条件ならエラーを返す 省略された値はデフォルト値で埋める
+func validateSmartPlaylistRules(rules *SmartPlaylistRules) error {
+	if len(rules.Conditions) == 0 || smartPlaylistMaxConditions < len(rules.Conditions) {
+		return errors.New("invalid conditions")
+	}
+	for i := range rules.Conditions {
+		cond := &rules.Conditions[i]
+		field, ok := smartPlaylistFields[cond.Field]
+		if !ok {
+			return fmt.Errorf("invalid field: %s", cond.Field)
+		}
+		if _, ok := smartPlaylistOps[cond.Op]; !ok {
+			return fmt.Errorf("invalid op: %s", cond.Op)
+		}
+		if field.numeric {
+			if cond.Op == "contains" {
+				return fmt.Errorf("invalid op for %s: %s", cond.Field, cond.Op)
+			}
+			n, ok := smartPlaylistIntValue(cond.Value)
+			if !ok {
+				return fmt.Errorf("invalid value for %s", cond.Field)
+			}
+			cond.Value = n
+		} else {
+			v, ok := cond.Value.(string)
+			if !ok || 191 < utf8.RuneCountInString(v) {
+				return fmt.Errorf("invalid value for %s", cond.Field)
+			}
+		}
+	}
+	if rules.Sort != "" {
+		if _, ok := smartPlaylistSorts[rules.Sort]; !ok {
+			return fmt.Errorf("invalid sort: %s", rules.Sort)
+		}
+	}
+	switch rules.Order {
+	case "":
+		rules.Order = "asc"
+	case "asc", "desc":
+	default:
+		return fmt.Errorf("invalid order: %s", rules.Order)
+	}
+	if rules.Limit == 0 {
+		rules.Limit = smartPlaylistMaxLimit
+	}
+	if rules.Limit < 0 || smartPlaylistMaxLimit < rules.Limit {
+		return errors.New("invalid limit")
+	}
+	return nil
+}
+
+// JSONの数値はfloat64になるので整数に直す
+func smartPlaylistIntValue(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case float64:
+		if n != math.Trunc(n) {
+			return 0, false
+		}
+		return int(n), true
+	}
+	return 0, false
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func buildSmartPlaylistQuery(rules *SmartPlaylistRules) (string, []interface{}) {
+	conditions := []string{"song.is_public = ?"}
+	args := []interface{}{true}
+	for _, cond := range rules.Conditions {
+		field := smartPlaylistFields[cond.Field]
+		op := smartPlaylistOps[cond.Op]
+		conditions = append(conditions, field.column+" "+op+" ?")
+		if field.numeric {
+			n, _ := smartPlaylistIntValue(cond.Value)
+			args = append(args, n)
+		} else if cond.Op == "contains" {
+			args = append(args, "%"+escapeLike(cond.Value.(string))+"%")
+		} else {
+			args = append(args, cond.Value)
+		}
+	}
+
+	orders := make([]string, 0, 4)
+	for _, column := range smartPlaylistSorts[rules.Sort] {
+		orders = append(orders, column+" "+strings.ToUpper(rules.Order))
+	}
+	orders = append(orders, "song.id ASC")
+	args = append(args, rules.Limit)
+
+	query := "SELECT song.*, artist.name AS artist_name FROM song JOIN artist ON artist.id = song.artist_id" +
+		" WHERE " + strings.Join(conditions, " AND ") +
+		" ORDER BY " + strings.Join(orders, ", ") +
+		" LIMIT ?"
+	return query, args
+}
+
+func getSmartPlaylistRules(ctx context.Context, db connOrTx, playlistID int) (*SmartPlaylistRules, error) {
+	var row PlaylistSmartRuleRow
+	if err := db.GetContext(ctx, &row, "SELECT * FROM playlist_smart_rule WHERE `playlist_id` = ?", playlistID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error Get playlist_smart_rule by playlist_id=%d: %w", playlistID, err)
+	}
+	var rules SmartPlaylistRules
+	if err := json.Unmarshal([]byte(row.Rules), &rules); err != nil {
+		return nil, fmt.Errorf("error Unmarshal playlist_smart_rule by playlist_id=%d: %w", playlistID, err)
+	}
+	return &rules, nil
+}
+
+// 一覧用に複数のプレイリストの条件をまとめて読む スマートプレイリストでなければmapに含まない
+func getSmartPlaylistRulesByPlaylistIDs(ctx context.Context, db connOrTx, playlistIDs []int) (map[int]*SmartPlaylistRules, error) {
+	result := make(map[int]*SmartPlaylistRules, len(playlistIDs))
+	if len(playlistIDs) == 0 {
+		return result, nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM playlist_smart_rule WHERE `playlist_id` IN (?)", playlistIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error sqlx.In: %w", err)
+	}
+	var rows []PlaylistSmartRuleRow
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, fmt.Errorf("error Select playlist_smart_rule by playlist_ids: %w", err)
+	}
+	for _, row := range rows {
+		var rules SmartPlaylistRules
+		if err := json.Unmarshal([]byte(row.Rules), &rules); err != nil {
+			return nil, fmt.Errorf("error Unmarshal playlist_smart_rule by playlist_id=%d: %w", row.PlaylistID, err)
+		}
+		result[row.PlaylistID] = &rules
+	}
+	return result, nil
+}
+
+func getSmartPlaylistSongs(ctx context.Context, db connOrTx, rules *SmartPlaylistRules) ([]SongWithArtistRow, error) {
+	query, args := buildSmartPlaylistQuery(rules)
+	var rows []SongWithArtistRow
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, fmt.Errorf("error Select song by smart playlist rules: %w", err)
+	}
+	return rows, nil
+}
+
+type smartPlaylistSongsCount struct {
+	PlaylistID int `db:"playlist_id"`
+	Count      int `db:"cnt"`
+	Duration   int `db:"duration"`
+}
+
+// 一覧用に複数のスマートプレイリストの曲数と合計再生時間(秒)を1つのクエリで集計する
+func getSmartPlaylistSongsCountsAndDurations(ctx context.Context, db connOrTx, rulesByPlaylistID map[int]*SmartPlaylistRules) (map[int]smartPlaylistSongsCount, error) {
+	result := make(map[int]smartPlaylistSongsCount, len(rulesByPlaylistID))
+	if len(rulesByPlaylistID) == 0 {
+		return result, nil
+	}
+	playlistIDs := make([]int, 0, len(rulesByPlaylistID))
+	for id := range rulesByPlaylistID {
+		playlistIDs = append(playlistIDs, id)
+	}
+	sort.Ints(playlistIDs)
+
+	queries := make([]string, 0, len(playlistIDs))
+	var args []interface{}
+	for _, id := range playlistIDs {
+		query, queryArgs := buildSmartPlaylistQuery(rulesByPlaylistID[id])
+		queries = append(queries, "(SELECT ? AS playlist_id, COUNT(*) AS cnt, COALESCE(SUM(t.duration), 0) AS duration FROM ("+query+") AS t)")
+		args = append(args, id)
+		args = append(args, queryArgs...)
+	}
+	var rows []smartPlaylistSongsCount
+	if err := db.SelectContext(ctx, &rows, strings.Join(queries, " UNION ALL "), args...); err != nil {
+		return nil, fmt.Errorf("error Select count of song by smart playlist rules: %w", err)
+	}
+	for _, row := range rows {
+		result[row.PlaylistID] = row
+	}
+	return result, nil
+}
+
+// URLで指定された、自分が作成したプレイリストを取得する
+// nilを返した場合はエラーレスポンスを書き込み済みなので、errorをそのままハンドラから返す
+func getOwnPlaylistFromParam(c echo.Context, conn connOrTx, userAccount string) (*PlaylistRow, error) {
+	playlistULID := c.Param("playlistUlid")
+	if playlistULID == "" {
+		return nil, errorResponse(c, 404, "bad playlist ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", playlistULID); matched {
+		return nil, errorResponse(c, 404, "bad playlist ulid")
+	}
+	playlist, err := getPlaylistByULID(c.Request().Context(), conn, playlistULID)
+	if err != nil {
+		c.Logger().Errorf("error getPlaylistByULID: %s", err)
+		return nil, errorResponse(c, 500, "internal server error")
+	}
+	if playlist == nil || playlist.UserAccount != userAccount {
+		// 権限エラーだが、URI上のパラメータが不正なので404を返す
+		return nil, errorResponse(c, 404, "playlist not found")
+	}
+	return playlist, nil
+}
+
+func playlistDetailResponse(c echo.Context, conn connOrTx, playlistULID string, userAccount string) error {
+	playlistDetails, err := getPlaylistDetailByPlaylistULID(c.Request().Context(), conn, playlistULID, &userAccount)
+	if err != nil {
+		c.Logger().Errorf("error getPlaylistDetailByPlaylistULID: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if playlistDetails == nil {
+		return errorResponse(c, 404, "playlist not found")
+	}
+
+	body := SinglePlaylistResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Playlist: *playlistDetails,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	return nil
+}
+
+// POST /api/playlist/:playlistUlid/smart
+
+func apiPlaylistSmartHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	var req SmartPlaylistRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to SmartPlaylistRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if req.Rules == nil {
+		return errorResponse(c, 400, "rules is required")
+	}
+	if err := validateSmartPlaylistRules(req.Rules); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+	rules, err := json.Marshal(req.Rules)
+	if err != nil {
+		c.Logger().Errorf("error Marshal SmartPlaylistRules: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	playlist, err := getOwnPlaylistFromParam(c, conn, user.Account)
+	if playlist == nil {
+		return err
+	}
+
+	updatedTimestamp := time.Now()
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Errorf("error conn.BeginTxx: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO playlist_smart_rule (`playlist_id`, `rules`, `created_at`, `updated_at`) VALUES (?, ?, ?, ?)"+
+			" ON DUPLICATE KEY UPDATE `rules` = VALUES(`rules`), `updated_at` = VALUES(`updated_at`)",
+		playlist.ID, string(rules), updatedTimestamp, updatedTimestamp,
+	); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Insert playlist_smart_rule by playlist_id=%d, rules=%s: %s", playlist.ID, rules, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	// 曲は条件から決まるので、固定の曲の一覧は消しておく
+	if _, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM playlist_song WHERE playlist_id = ?",
+		playlist.ID,
+	); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Delete playlist_song by id=%d: %s", playlist.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE playlist SET `updated_at` = ? WHERE `id` = ?",
+		updatedTimestamp, playlist.ID,
+	); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Update playlist by updated_at=%s, id=%d: %s", updatedTimestamp, playlist.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("error tx.Commit: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return playlistDetailResponse(c, conn, playlist.ULID, user.Account)
+}
+
+// POST /api/playlist/:playlistUlid/snapshot
+
+func apiPlaylistSnapshotHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	playlist, err := getOwnPlaylistFromParam(c, conn, user.Account)
+	if playlist == nil {
+		return err
+	}
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Errorf("error conn.BeginTxx: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	rules, err := getSmartPlaylistRules(ctx, tx, playlist.ID)
+	if err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error getSmartPlaylistRules: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if rules == nil {
+		tx.Rollback()
+		return errorResponse(c, 400, "not a smart playlist")
+	}
+	songs, err := getSmartPlaylistSongs(ctx, tx, rules)
+	if err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error getSmartPlaylistSongs: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	// 今の評価結果を固定の曲の一覧として保存し、条件を消す
+	updatedTimestamp := time.Now()
+	if _, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM playlist_song WHERE playlist_id = ?",
+		playlist.ID,
+	); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Delete playlist_song by id=%d: %s", playlist.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	for i, song := range songs {
+		if err := insertPlaylistSong(ctx, tx, playlist.ID, i+1, song.ID, updatedTimestamp); err != nil {
+			tx.Rollback()
+			c.Logger().Errorf("error insertPlaylistSong: %s", err)
+			return errorResponse(c, 500, "internal server error")
+		}
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM playlist_smart_rule WHERE playlist_id = ?",
+		playlist.ID,
+	); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Delete playlist_smart_rule by playlist_id=%d: %s", playlist.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE playlist SET `updated_at` = ? WHERE `id` = ?",
+		updatedTimestamp, playlist.ID,
+	); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Update playlist by updated_at=%s, id=%d: %s", updatedTimestamp, playlist.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("error tx.Commit: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return playlistDetailResponse(c, conn, playlist.ULID, user.Account)
+}
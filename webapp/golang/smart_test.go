@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateSmartPlaylistRules(t *testing.T) {
+	cond := func(field, op string, value interface{}) SmartPlaylistCondition {
+		return SmartPlaylistCondition{Field: field, Op: op, Value: value}
+	}
+	tooMany := make([]SmartPlaylistCondition, 0, smartPlaylistMaxConditions+1)
+	for i := 0; i <= smartPlaylistMaxConditions; i++ {
+		tooMany = append(tooMany, cond("genre", "=", "rock"))
+	}
+
+	tests := []struct {
+		name    string
+		rules   SmartPlaylistRules
+		wantErr bool
+	}{
+		{name: "string field", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("title", "contains", "love")}}},
+		{name: "numeric field", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("release_year", ">=", float64(2000))}}},
+		{name: "sort and order", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("genre", "=", "rock")}, Sort: "artist", Order: "desc", Limit: 10}},
+		{name: "no conditions", rules: SmartPlaylistRules{}, wantErr: true},
+		{name: "too many conditions", rules: SmartPlaylistRules{Conditions: tooMany}, wantErr: true},
+		{name: "unknown field", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("password", "=", "x")}}, wantErr: true},
+		{name: "unknown op", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("title", "like", "x")}}, wantErr: true},
+		{name: "contains numeric", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("duration", "contains", float64(1))}}, wantErr: true},
+		{name: "fractional number", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("duration", ">", 1.5)}}, wantErr: true},
+		{name: "string for numeric", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("duration", ">", "100")}}, wantErr: true},
+		{name: "number for string", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("title", "=", float64(1))}}, wantErr: true},
+		{name: "too long value", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("title", "=", string(make([]rune, 192)))}}, wantErr: true},
+		{name: "unknown sort", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("genre", "=", "rock")}, Sort: "random"}, wantErr: true},
+		{name: "unknown order", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("genre", "=", "rock")}, Order: "up"}, wantErr: true},
+		{name: "negative limit", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("genre", "=", "rock")}, Limit: -1}, wantErr: true},
+		{name: "too large limit", rules: SmartPlaylistRules{Conditions: []SmartPlaylistCondition{cond("genre", "=", "rock")}, Limit: smartPlaylistMaxLimit + 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := tt.rules
+			err := validateSmartPlaylistRules(&rules)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("validateSmartPlaylistRules(%+v) returns no error", tt.rules)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("validateSmartPlaylistRules(%+v) returns error: %s", tt.rules, err)
+			}
+		})
+	}
+}
+
+func TestValidateSmartPlaylistRulesDefaults(t *testing.T) {
+	rules := SmartPlaylistRules{
+		Conditions: []SmartPlaylistCondition{{Field: "release_year", Op: "=", Value: float64(1999)}},
+	}
+	if err := validateSmartPlaylistRules(&rules); err != nil {
+		t.Fatalf("validateSmartPlaylistRules returns error: %s", err)
+	}
+	if rules.Order != "asc" {
+		t.Errorf("Order = %q, want asc", rules.Order)
+	}
+	if rules.Limit != smartPlaylistMaxLimit {
+		t.Errorf("Limit = %d, want %d", rules.Limit, smartPlaylistMaxLimit)
+	}
+	// JSONの数値は整数に直して保存する
+	if v, ok := rules.Conditions[0].Value.(int); !ok || v != 1999 {
+		t.Errorf("Value = %#v, want int 1999", rules.Conditions[0].Value)
+	}
+}
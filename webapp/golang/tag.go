@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/html"
+	"golang.org/x/text/unicode/norm"
+)
+
+// プレイリストの説明文とタグ
+
+const (
+	// 1プレイリストに付けられるタグの最大数
+	maxPlaylistTags = 10
+	// タグの最大文字数
+	maxTagLength = 32
+	// 説明文の最大文字数 (サニタイズ前)
+	maxDescriptionLength = 1000
+	// タグの補完で返す最大数
+	tagSuggestionLimit = 10
+)
+
+// 説明文で使えるタグ これ以外はエスケープして文字として表示する
+var descriptionAllowedTags = map[string]struct{}{
+	"a":      {},
+	"b":      {},
+	"br":     {},
+	"em":     {},
+	"i":      {},
+	"li":     {},
+	"ol":     {},
+	"p":      {},
+	"strong": {},
+	"ul":     {},
+}
+
+// 中身ごと捨てるタグ
+var descriptionDroppedTags = map[string]struct{}{
+	"script": {},
+	"style":  {},
+}
+
+// タグを正規化する
+// 全角英数は半角に、英字は小文字にし、空白は _ にまとめる
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(norm.NFKC.String(tag))
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+	var b strings.Builder
+	lastUnderscore := false
+	for _, r := range tag {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-':
+			b.WriteRune(r)
+			lastUnderscore = false
+		case unicode.IsSpace(r) || r == '_':
+			if !lastUnderscore {
+				b.WriteRune('_')
+				lastUnderscore = true
+			}
+		default:
+			return "", fmt.Errorf("invalid tag: %s", tag)
+		}
+	}
+	normalized := strings.Trim(b.String(), "_")
+	if normalized == "" || maxTagLength < utf8.RuneCountInString(normalized) {
+		return "", fmt.Errorf("invalid tag: %s", tag)
+	}
+	return normalized, nil
+}
+
+// 正規化して重複を除く 順番は指定された順のまま
+func normalizeTags(tags []string) ([]string, error) {
+	results := make([]string, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		normalized, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[normalized]; ok {
+			continue
+		}
+		seen[normalized] = struct{}{}
+		results = append(results, normalized)
+	}
+	if maxPlaylistTags < len(results) {
+		return nil, fmt.Errorf("too many tags: max %d", maxPlaylistTags)
+	}
+	return results, nil
+}
+
+func validateDescription(description string) error {
+	if maxDescriptionLength < utf8.RuneCountInString(description) {
+		return fmt.Errorf("description is too long: max %d", maxDescriptionLength)
+	}
+	return nil
+}
+
+// 説明文を許可したタグだけのHTMLにする
+// リンクは http, https のみ残し、閉じられていないタグは最後に閉じる
+func sanitizeDescription(description string) string {
+	var b strings.Builder
+	var opened []string
+	dropping := ""
+	z := html.NewTokenizer(strings.NewReader(description))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		token := z.Token()
+		name := strings.ToLower(token.Data)
+		if dropping != "" {
+			if tt == html.EndTagToken && name == dropping {
+				dropping = ""
+			}
+			continue
+		}
+		switch tt {
+		case html.TextToken:
+			b.WriteString(html.EscapeString(token.Data))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if _, ok := descriptionDroppedTags[name]; ok {
+				if tt == html.StartTagToken {
+					dropping = name
+				}
+				continue
+			}
+			if _, ok := descriptionAllowedTags[name]; !ok {
+				continue
+			}
+			if name == "br" {
+				b.WriteString("<br>")
+				continue
+			}
+			if name == "a" {
+				href := ""
+				for _, attr := range token.Attr {
+					if strings.ToLower(attr.Key) == "href" {
+						href = attr.Val
+					}
+				}
+				u, err := url.Parse(strings.TrimSpace(href))
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					b.WriteString("<a>")
+				} else {
+					fmt.Fprintf(&b, `<a href="%s" rel="nofollow noopener">`, html.EscapeString(u.String()))
+				}
+			} else {
+				b.WriteString("<" + name + ">")
+			}
+			if tt == html.StartTagToken {
+				opened = append(opened, name)
+			} else {
+				b.WriteString("</" + name + ">")
+			}
+		case html.EndTagToken:
+			// 開いているタグまで閉じる 開いていないタグの閉じタグは捨てる
+			for i := len(opened) - 1; i >= 0; i-- {
+				if opened[i] != name {
+					continue
+				}
+				for j := len(opened) - 1; j >= i; j-- {
+					b.WriteString("</" + opened[j] + ">")
+				}
+				opened = opened[:i]
+				break
+			}
+		}
+	}
+	for i := len(opened) - 1; i >= 0; i-- {
+		b.WriteString("</" + opened[i] + ">")
+	}
+	return b.String()
+}
+
+func getPlaylistTags(ctx context.Context, db connOrTx, playlistID int) ([]string, error) {
+	tags := []string{}
+	if err := db.SelectContext(
+		ctx,
+		&tags,
+		"SELECT tag FROM playlist_tag WHERE playlist_id = ? ORDER BY sort_order",
+		playlistID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select playlist_tag by playlist_id=%d: %w", playlistID, err)
+	}
+	return tags, nil
+}
+
+// 一覧用に複数のプレイリストのタグをまとめて読む タグのないプレイリストは空のスライスにする
+func getPlaylistTagsByPlaylistIDs(ctx context.Context, db connOrTx, playlistIDs []int) (map[int][]string, error) {
+	result := make(map[int][]string, len(playlistIDs))
+	for _, id := range playlistIDs {
+		result[id] = []string{}
+	}
+	if len(playlistIDs) == 0 {
+		return result, nil
+	}
+	query, args, err := sqlx.In(
+		"SELECT playlist_id, tag FROM playlist_tag WHERE playlist_id IN (?) ORDER BY playlist_id, sort_order",
+		playlistIDs,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error sqlx.In: %w", err)
+	}
+	var rows []struct {
+		PlaylistID int    `db:"playlist_id"`
+		Tag        string `db:"tag"`
+	}
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, fmt.Errorf("error Select playlist_tag by playlist_ids: %w", err)
+	}
+	for _, row := range rows {
+		result[row.PlaylistID] = append(result[row.PlaylistID], row.Tag)
+	}
+	return result, nil
+}
+
+// タグを全て入れ替える
+func replacePlaylistTags(ctx context.Context, db connOrTx, playlistID int, tags []string, createdAt time.Time) error {
+	if _, err := db.ExecContext(
+		ctx,
+		"DELETE FROM playlist_tag WHERE playlist_id = ?",
+		playlistID,
+	); err != nil {
+		return fmt.Errorf("error Delete playlist_tag by playlist_id=%d: %w", playlistID, err)
+	}
+	for i, tag := range tags {
+		if _, err := db.ExecContext(
+			ctx,
+			"INSERT INTO playlist_tag (`playlist_id`, `tag`, `sort_order`, `created_at`) VALUES (?, ?, ?, ?)",
+			playlistID, tag, i+1, createdAt,
+		); err != nil {
+			return fmt.Errorf(
+				"error Insert playlist_tag by playlist_id=%d, tag=%s, sort_order=%d: %w",
+				playlistID, tag, i+1, err,
+			)
+		}
+	}
+	return nil
+}
+
+func getTagPlaylistSummaries(ctx context.Context, db connOrTx, tag string, sort string, userAccount string) ([]Playlist, error) {
+	var query string
+	switch sort {
+	case "popular":
+		query = "SELECT playlist.* FROM playlist_tag JOIN playlist ON playlist.id = playlist_tag.playlist_id" +
+			" LEFT JOIN playlist_favorite ON playlist_favorite.playlist_id = playlist.id" +
+			" WHERE playlist_tag.tag = ? AND playlist.is_public = ? AND playlist.is_hidden = ?" +
+			" GROUP BY playlist.id ORDER BY COUNT(playlist_favorite.playlist_id) DESC, playlist.created_at DESC"
+	default:
+		query = "SELECT playlist.* FROM playlist_tag JOIN playlist ON playlist.id = playlist_tag.playlist_id" +
+			" WHERE playlist_tag.tag = ? AND playlist.is_public = ? AND playlist.is_hidden = ?" +
+			" ORDER BY playlist.created_at DESC"
+	}
+	var rows []PlaylistRow
+	if err := db.SelectContext(ctx, &rows, query, tag, true, false); err != nil {
+		return nil, fmt.Errorf("error Select playlist by tag=%s: %w", tag, err)
+	}
+
+	playlists, err := getPublicPlaylistSummaries(ctx, db, rows, userAccount, 100)
+	if err != nil {
+		return nil, fmt.Errorf("error getPublicPlaylistSummaries: %w", err)
+	}
+	return playlists, nil
+}
+
+// GET /api/tags/:tag/playlists
+
+func apiTagPlaylistsHandler(c echo.Context) error {
+	// ログインは不要
+	userAccount, err := getViewerUserAccount(c)
+	if err != nil {
+		c.Logger().Errorf("error getViewerUserAccount: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	tag, err := normalizeTag(c.Param("tag"))
+	if err != nil {
+		return errorResponse(c, 400, "invalid tag")
+	}
+	sort := c.QueryParam("sort")
+	switch sort {
+	case "":
+		sort = "recent"
+	case "recent", "popular":
+	default:
+		return errorResponse(c, 400, "invalid sort")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	playlists, err := getTagPlaylistSummaries(ctx, conn, tag, sort, userAccount)
+	if err != nil {
+		c.Logger().Errorf("error getTagPlaylistSummaries: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := GetTagPlaylistsResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Tag:       tag,
+		Playlists: playlists,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// GET /api/tags
+
+func apiTagsHandler(c echo.Context) error {
+	// 前方一致で、公開中のプレイリストに多く付いているタグから返す
+	// タグのプレイリスト一覧と同じく、非表示のプレイリストとbanされたユーザーのプレイリストは数えない
+	var prefix string
+	if q := c.QueryParam("q"); q != "" {
+		var err error
+		prefix, err = normalizeTag(q)
+		if err != nil {
+			return errorResponse(c, 400, "invalid q")
+		}
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	tags := []TagSuggestion{}
+	if err := conn.SelectContext(
+		ctx,
+		&tags,
+		"SELECT playlist_tag.tag, COUNT(*) AS playlist_count FROM playlist_tag"+
+			" JOIN playlist ON playlist.id = playlist_tag.playlist_id"+
+			" JOIN user ON user.account = playlist.user_account"+
+			" WHERE playlist_tag.tag LIKE ? AND playlist.is_public = ? AND playlist.is_hidden = ? AND user.is_ban = ?"+
+			" GROUP BY playlist_tag.tag ORDER BY playlist_count DESC, playlist_tag.tag LIMIT ?",
+		escapeLike(prefix)+"%", true, false, false, tagSuggestionLimit,
+	); err != nil {
+		c.Logger().Errorf("error Select playlist_tag by prefix=%s: %s", prefix, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := GetTagsResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Tags: tags,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{name: "lower", tag: "Rock", want: "rock"},
+		{name: "full width", tag: "ＪＰＯＰ", want: "jpop"},
+		{name: "hash prefix", tag: "#anime", want: "anime"},
+		{name: "spaces", tag: "  city  pop ", want: "city_pop"},
+		{name: "underscores", tag: "lo__fi", want: "lo_fi"},
+		{name: "hyphen", tag: "hip-hop", want: "hip-hop"},
+		{name: "japanese", tag: "作業用", want: "作業用"},
+		{name: "half width kana", tag: "ｱﾆｿﾝ", want: "アニソン"},
+		{name: "trim underscores", tag: "_edm_", want: "edm"},
+		{name: "max length", tag: strings.Repeat("a", maxTagLength), want: strings.Repeat("a", maxTagLength)},
+		{name: "too long", tag: strings.Repeat("a", maxTagLength+1), wantErr: true},
+		{name: "empty", tag: "", wantErr: true},
+		{name: "only hash", tag: "#", wantErr: true},
+		{name: "only spaces", tag: "   ", wantErr: true},
+		{name: "symbol", tag: "rock&roll", wantErr: true},
+		{name: "html", tag: "<b>", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeTag(tt.tag)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("normalizeTag(%q) = %q, want error", tt.tag, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalizeTag(%q) returns error: %s", tt.tag, err)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeTag(%q) = %q, want %q", tt.tag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	got, err := normalizeTags([]string{"Rock", "#rock", "City Pop", "ROCK"})
+	if err != nil {
+		t.Fatalf("normalizeTags returns error: %s", err)
+	}
+	want := []string{"rock", "city_pop"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("normalizeTags = %v, want %v", got, want)
+	}
+
+	tooMany := make([]string, 0, maxPlaylistTags+1)
+	for i := 0; i <= maxPlaylistTags; i++ {
+		tooMany = append(tooMany, strings.Repeat("a", i+1))
+	}
+	if _, err := normalizeTags(tooMany); err == nil {
+		t.Errorf("normalizeTags with %d tags, want error", len(tooMany))
+	}
+}
+
+func TestSanitizeDescription(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		want        string
+	}{
+		{name: "text", description: "hello", want: "hello"},
+		{name: "escape text", description: "a < b & c", want: "a &lt; b &amp; c"},
+		{name: "allowed tags", description: "<p><b>bold</b> and <em>em</em></p>", want: "<p><b>bold</b> and <em>em</em></p>"},
+		{name: "upper case tag", description: "<STRONG>x</STRONG>", want: "<strong>x</strong>"},
+		{name: "drop attributes", description: `<p class="x" onclick="alert(1)">x</p>`, want: "<p>x</p>"},
+		{name: "br", description: "a<br/>b<br>c", want: "a<br>b<br>c"},
+		{name: "unknown tag", description: "<div>x</div>", want: "x"},
+		{name: "script", description: "a<script>alert(1)</script>b", want: "ab"},
+		{name: "style", description: "a<style>p{}</style>b", want: "ab"},
+		{name: "http link", description: `<a href="https://example.com/?a=1&b=2">x</a>`, want: `<a href="https://example.com/?a=1&amp;b=2" rel="nofollow noopener">x</a>`},
+		{name: "javascript link", description: `<a href="javascript:alert(1)">x</a>`, want: "<a>x</a>"},
+		{name: "link without href", description: "<a>x</a>", want: "<a>x</a>"},
+		{name: "close unclosed", description: "<ul><li>x", want: "<ul><li>x</li></ul>"},
+		{name: "close inner tags", description: "<b><i>x</b>y", want: "<b><i>x</i></b>y"},
+		{name: "stray end tag", description: "x</b>", want: "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeDescription(tt.description); got != tt.want {
+				t.Errorf("sanitizeDescription(%q) = %q, want %q", tt.description, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+// スクリプトなどから使うための個人用アクセストークン
+// Authorization: Bearer で渡すとcookieのセッションの代わりになる
+// tokenそのものは保存せず、ハッシュ値で照合する
+
+const (
+	accessTokenScopeRead          = "read"
+	accessTokenScopePlaylistWrite = "playlist:write"
+	accessTokenScopeFavorite      = "favorite"
+	accessTokenScopePlay          = "play"
+	accessTokenScopeCommentWrite  = "comment:write"
+
+	// tokenの接頭辞 漏洩したときに見つけやすくする
+	accessTokenPrefix = "l80_"
+	accessTokenBytes  = 32
+	// 一覧で見分けるために返すtokenの先頭の長さ
+	accessTokenDisplayPrefixLength = 8
+
+	maxAccessTokensPerUser   = 10
+	maxAccessTokenNameLength = 64
+
+	// 最終使用日時はこれより細かくは更新しない
+	accessTokenLastUsedResolution = time.Minute
+)
+
+var accessTokenScopes = []string{
+	accessTokenScopeRead,
+	accessTokenScopePlaylistWrite,
+	accessTokenScopeFavorite,
+	accessTokenScopePlay,
+	accessTokenScopeCommentWrite,
+}
+
+// tokenで呼べるAPIと必要なscope
+// ここにないAPI(tokenやアカウントの管理、管理者用のAPIなど)はcookieのセッションでしか呼べない
+var accessTokenRouteScopes = map[string]string{
+	"GET /api/recent_playlists":                      accessTokenScopeRead,
+	"GET /api/popular_playlists":                     accessTokenScopeRead,
+	"GET /api/playlists":                             accessTokenScopeRead,
+	"GET /api/playlists/search":                      accessTokenScopeRead,
+	"GET /api/playlist/:playlistUlid":                accessTokenScopeRead,
+	"GET /api/playlist/:playlistUlid/export":         accessTokenScopeRead,
+	"GET /api/playlist/:playlistUlid/comments":       accessTokenScopeRead,
+	"GET /api/playlist/:playlistUlid/events":         accessTokenScopeRead,
+	"GET /api/playlist/:playlistUlid/similar":        accessTokenScopeRead,
+	"GET /api/playlist/:playlistUlid/also_favorited": accessTokenScopeRead,
+	"GET /api/song/:songUlid":                        accessTokenScopeRead,
+	"GET /api/liked_songs":                           accessTokenScopeRead,
+	"GET /api/history":                               accessTokenScopeRead,
+	"GET /api/tags/:tag/playlists":                   accessTokenScopeRead,
+
+	"POST /api/playlist/add":                              accessTokenScopePlaylistWrite,
+	"POST /api/playlist/import":                           accessTokenScopePlaylistWrite,
+	"POST /api/playlist/:playlistUlid/update":             accessTokenScopePlaylistWrite,
+	"POST /api/playlist/:playlistUlid/delete":             accessTokenScopePlaylistWrite,
+	"POST /api/playlist/:playlistUlid/smart":              accessTokenScopePlaylistWrite,
+	"POST /api/playlist/:playlistUlid/snapshot":           accessTokenScopePlaylistWrite,
+	"POST /api/playlist/:playlistUlid/share_token/rotate": accessTokenScopePlaylistWrite,
+
+	"POST /api/playlist/:playlistUlid/favorite": accessTokenScopeFavorite,
+	"POST /api/song/:songUlid/like":             accessTokenScopeFavorite,
+
+	"POST /api/play": accessTokenScopePlay,
+
+	"POST /api/playlist/:playlistUlid/comment": accessTokenScopeCommentWrite,
+	"POST /api/comment/:commentUlid/update":    accessTokenScopeCommentWrite,
+	"POST /api/comment/:commentUlid/delete":    accessTokenScopeCommentWrite,
+}
+
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateAccessToken() (string, error) {
+	b := make([]byte, accessTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error rand.Read: %w", err)
+	}
+	return accessTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func getBearerToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return "", false
+	}
+	scheme, token, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func normalizeAccessTokenScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("scopes is required")
+	}
+	results := make([]string, 0, len(scopes))
+	seen := make(map[string]struct{}, len(scopes))
+	for _, scope := range scopes {
+		valid := false
+		for _, s := range accessTokenScopes {
+			if s == scope {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid scope: %s", scope)
+		}
+		if _, ok := seen[scope]; ok {
+			continue
+		}
+		seen[scope] = struct{}{}
+		results = append(results, scope)
+	}
+	return results, nil
+}
+
+func hasAccessTokenScope(token *AccessTokenRow, scope string) bool {
+	for _, s := range strings.Split(token.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func toAccessToken(row *AccessTokenRow) AccessToken {
+	return AccessToken{
+		ULID:        row.ULID,
+		Name:        row.Name,
+		TokenPrefix: row.TokenPrefix,
+		Scopes:      strings.Split(row.Scopes, ","),
+		LastUsedAt:  row.LastUsedAt,
+		CreatedAt:   row.CreatedAt,
+	}
+}
+
+func getAccessTokenByHash(ctx context.Context, db connOrTx, tokenHash string) (*AccessTokenRow, error) {
+	var row AccessTokenRow
+	if err := db.GetContext(ctx, &row, "SELECT * FROM access_token WHERE `token_hash` = ?", tokenHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error Get access_token by token_hash: %w", err)
+	}
+	return &row, nil
+}
+
+func getAccessTokensByUserAccount(ctx context.Context, db connOrTx, userAccount string) ([]AccessTokenRow, error) {
+	var rows []AccessTokenRow
+	if err := db.SelectContext(
+		ctx,
+		&rows,
+		"SELECT * FROM access_token WHERE `user_account` = ? ORDER BY `created_at`, `id`",
+		userAccount,
+	); err != nil {
+		return nil, fmt.Errorf("error Select access_token by user_account=%s: %w", userAccount, err)
+	}
+	return rows, nil
+}
+
+// Bearer tokenで認証する 呼ばれたAPIに必要なscopeがなければ認証しない
+func validateAccessToken(c echo.Context, token string) (*UserRow, bool, error) {
+	scope, ok := accessTokenRouteScopes[c.Request().Method+" "+c.Path()]
+	if !ok || !strings.HasPrefix(token, accessTokenPrefix) {
+		return nil, false, nil
+	}
+
+	ctx := c.Request().Context()
+	row, err := getAccessTokenByHash(ctx, db, hashAccessToken(token))
+	if err != nil {
+		return nil, false, fmt.Errorf("error getAccessTokenByHash: %w", err)
+	}
+	if row == nil || !hasAccessTokenScope(row, scope) {
+		return nil, false, nil
+	}
+	user, err := getUserByAccount(ctx, db, row.UserAccount)
+	if err != nil {
+		return nil, false, fmt.Errorf("error getUserByAccount: %w", err)
+	}
+	if user == nil || user.IsBan {
+		return nil, false, nil
+	}
+
+	// 毎リクエスト書き込まないよう、前回から一定時間経っていれば更新する
+	now := time.Now()
+	if _, err := db.ExecContext(
+		ctx,
+		"UPDATE access_token SET `last_used_at` = ? WHERE `id` = ? AND (`last_used_at` IS NULL OR `last_used_at` < ?)",
+		now, row.ID, now.Add(-accessTokenLastUsedResolution),
+	); err != nil {
+		return nil, false, fmt.Errorf("error Update access_token by id=%d: %w", row.ID, err)
+	}
+
+	return user, true, nil
+}
+
+// ログインしていなくても見れるAPI用 ログインしていなければ anonUserAccount を返す
+func getViewerUserAccount(c echo.Context) (string, error) {
+	if token, ok := getBearerToken(c.Request()); ok {
+		user, ok, err := validateAccessToken(c, token)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return anonUserAccount, nil
+		}
+		return user.Account, nil
+	}
+
+	sess, err := getSession(c.Request())
+	if err != nil {
+		return "", fmt.Errorf("error getSession: %w", err)
+	}
+	if account, ok := sess.Values["user_account"]; ok {
+		return account.(string), nil
+	}
+	return anonUserAccount, nil
+}
+
+// GET /api/tokens
+
+func apiAccessTokensHandler(c echo.Context) error {
+	// tokenの管理は accessTokenRouteScopes にないので、cookieのセッションでのみ行える
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	rows, err := getAccessTokensByUserAccount(ctx, conn, user.Account)
+	if err != nil {
+		c.Logger().Errorf("error getAccessTokensByUserAccount: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	tokens := make([]AccessToken, 0, len(rows))
+	for _, row := range rows {
+		tokens = append(tokens, toAccessToken(&row))
+	}
+
+	body := GetAccessTokensResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Tokens: tokens,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/token/add
+
+func apiAccessTokenAddHandler(c echo.Context) error {
+	// tokenの管理は accessTokenRouteScopes にないので、cookieのセッションでのみ行える
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	var req AddAccessTokenRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AddAccessTokenRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || maxAccessTokenNameLength < utf8.RuneCountInString(name) {
+		return errorResponse(c, 400, "invalid name")
+	}
+	scopes, err := normalizeAccessTokenScopes(req.Scopes)
+	if err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	tokens, err := getAccessTokensByUserAccount(ctx, conn, user.Account)
+	if err != nil {
+		c.Logger().Errorf("error getAccessTokensByUserAccount: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if maxAccessTokensPerUser <= len(tokens) {
+		return errorResponse(c, 400, fmt.Sprintf("too many tokens: max %d", maxAccessTokensPerUser))
+	}
+
+	createdAt := time.Now()
+	tokenULID, err := ulid.New(ulid.Timestamp(createdAt), entropy)
+	if err != nil {
+		c.Logger().Errorf("error ulid.New: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	token, err := generateAccessToken()
+	if err != nil {
+		c.Logger().Errorf("error generateAccessToken: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	row := AccessTokenRow{
+		ULID:        tokenULID.String(),
+		UserAccount: user.Account,
+		Name:        name,
+		TokenHash:   hashAccessToken(token),
+		TokenPrefix: token[:accessTokenDisplayPrefixLength],
+		Scopes:      strings.Join(scopes, ","),
+		CreatedAt:   createdAt,
+	}
+	if _, err := conn.ExecContext(
+		ctx,
+		"INSERT INTO access_token (`ulid`, `user_account`, `name`, `token_hash`, `token_prefix`, `scopes`, `created_at`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		row.ULID, row.UserAccount, row.Name, row.TokenHash, row.TokenPrefix, row.Scopes, row.CreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error Insert access_token by user_account=%s: %s", user.Account, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	// tokenそのものは保存していないので、このときしか返せない
+	accessToken := toAccessToken(&row)
+	accessToken.Token = token
+	body := AccessTokenResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Token: accessToken,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/token/:tokenUlid/revoke
+
+func apiAccessTokenRevokeHandler(c echo.Context) error {
+	// tokenの管理は accessTokenRouteScopes にないので、cookieのセッションでのみ行える
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	tokenULID := c.Param("tokenUlid")
+	if tokenULID == "" {
+		return errorResponse(c, 404, "bad token ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", tokenULID); matched {
+		return errorResponse(c, 404, "bad token ulid")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	// 他のユーザーのtokenは存在しないものとして扱う
+	res, err := conn.ExecContext(
+		ctx,
+		"DELETE FROM access_token WHERE `ulid` = ? AND `user_account` = ?",
+		tokenULID, user.Account,
+	)
+	if err != nil {
+		c.Logger().Errorf("error Delete access_token by ulid=%s: %s", tokenULID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		c.Logger().Errorf("error RowsAffected: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	} else if affected == 0 {
+		return errorResponse(c, 404, "token not found")
+	}
+
+	body := BasicResponse{
+		Result: true,
+		Status: 200,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
@@ -0,0 +1,794 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+// ユーザーが登録したURLへ、自分のプレイリストで起きたことを通知する
+// 送信内容は webhook_delivery に積み、バックグラウンドで送る 失敗したら間隔を空けて送り直す
+// 受け取る側は X-Listen80-Signature で送信元を確かめられる
+
+const (
+	webhookEventPlaylistPublished = "playlist.published"
+	webhookEventPlaylistUpdated   = "playlist.updated"
+	webhookEventPlaylistDeleted   = "playlist.deleted"
+	webhookEventPlaylistFavorited = "playlist.favorited"
+	// 疎通確認用 登録したwebhookにのみ送る
+	webhookEventPing = "ping"
+
+	webhookDeliveryStatusPending   = "pending"
+	webhookDeliveryStatusSucceeded = "succeeded"
+	webhookDeliveryStatusFailed    = "failed"
+
+	// 1ユーザーが登録できる数
+	maxWebhooksPerUser  = 5
+	maxWebhookURLLength = 1000
+	webhookSecretBytes  = 32
+
+	// 送信待ちを探す間隔
+	webhookDispatchInterval = time.Second
+	// 1回に送る最大数
+	webhookDispatchBatchSize = 20
+	// 送信中として他から拾われないようにしておく時間 送信のタイムアウトより長くする
+	webhookLeaseDuration  = time.Minute
+	webhookRequestTimeout = 5 * time.Second
+	// この回数失敗したら諦める
+	webhookMaxAttempts = 8
+	// 送り直すまでの間隔 失敗するごとに倍にする
+	webhookInitialBackoff = 10 * time.Second
+	webhookMaxBackoff     = time.Hour
+	// 記録するエラーの最大長
+	maxWebhookErrorLength = 500
+	// 接続を使い回すために読み捨てるレスポンスの最大長
+	maxWebhookResponseDrainBytes = 64 * 1024
+
+	webhookDeliveriesPerPage = 20
+)
+
+// 登録できるイベント
+var webhookEvents = []string{
+	webhookEventPlaylistPublished,
+	webhookEventPlaylistUpdated,
+	webhookEventPlaylistDeleted,
+	webhookEventPlaylistFavorited,
+}
+
+// 内部のネットワークへ送れると、サーバーの中からしか見えないサービスを叩かれてしまうので、
+// ループバック、プライベート、リンクローカルなどのアドレスには送らない
+// 手元で受信側を動かして試すときは ISUCON_WEBHOOK_ALLOW_PRIVATE_NETWORK=1 にする
+var webhookAllowPrivateNetwork bool
+
+var errWebhookForbiddenAddress = errors.New("destination address is not allowed")
+
+func loadWebhookConfig() {
+	webhookAllowPrivateNetwork = getEnv("ISUCON_WEBHOOK_ALLOW_PRIVATE_NETWORK", "") == "1"
+}
+
+func isForbiddenWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified()
+}
+
+// 名前解決した結果で確かめないと、内部のアドレスを返すドメインで抜けられるので、接続する直前に確かめる
+func controlWebhookDial(network, address string, _ syscall.RawConn) error {
+	if webhookAllowPrivateNetwork {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isForbiddenWebhookIP(ip) {
+		return errWebhookForbiddenAddress
+	}
+	return nil
+}
+
+var webhookHTTPClient = &http.Client{
+	Timeout: webhookRequestTimeout,
+	Transport: &http.Transport{
+		// プロキシを通すと接続先のアドレスを確かめられない
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: webhookRequestTimeout,
+			Control: controlWebhookDial,
+		}).DialContext,
+		TLSHandshakeTimeout: webhookRequestTimeout,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	// リダイレクト先には送らない
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func validateWebhookURL(rawURL string) error {
+	if rawURL == "" || maxWebhookURLLength < len(rawURL) {
+		return fmt.Errorf("invalid url")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url: scheme must be http or https")
+	}
+	if webhookAllowPrivateNetwork {
+		return nil
+	}
+	// 明らかに内部を指すものは登録させない 名前解決した先は送るときに確かめる
+	host := u.Hostname()
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return fmt.Errorf("invalid url: %w", errWebhookForbiddenAddress)
+	}
+	if ip := net.ParseIP(host); ip != nil && isForbiddenWebhookIP(ip) {
+		return fmt.Errorf("invalid url: %w", errWebhookForbiddenAddress)
+	}
+	return nil
+}
+
+func normalizeWebhookEvents(events []string) ([]string, error) {
+	if len(events) == 0 {
+		return nil, fmt.Errorf("events is required")
+	}
+	results := make([]string, 0, len(events))
+	seen := make(map[string]struct{}, len(events))
+	for _, event := range events {
+		valid := false
+		for _, e := range webhookEvents {
+			if e == event {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid event: %s", event)
+		}
+		if _, ok := seen[event]; ok {
+			continue
+		}
+		seen[event] = struct{}{}
+		results = append(results, event)
+	}
+	return results, nil
+}
+
+func generateWebhookSecret() (string, error) {
+	b := make([]byte, webhookSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error rand.Read: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// 送信日時とボディをつなげたものに署名する 受け取る側は古い日時のリクエストを捨てることで再送攻撃を防げる
+func signWebhookPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookBackoff(attemptCount int) time.Duration {
+	backoff := webhookInitialBackoff
+	for i := 1; i < attemptCount; i++ {
+		backoff *= 2
+		if webhookMaxBackoff < backoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+func toWebhook(row *WebhookRow) Webhook {
+	return Webhook{
+		ULID:      row.ULID,
+		URL:       row.URL,
+		Events:    strings.Split(row.Events, ","),
+		CreatedAt: row.CreatedAt,
+	}
+}
+
+func toWebhookDelivery(row *WebhookDeliveryRow) WebhookDelivery {
+	delivery := WebhookDelivery{
+		ULID:           row.ULID,
+		Event:          row.Event,
+		Payload:        json.RawMessage(row.Payload),
+		Status:         row.Status,
+		AttemptCount:   row.AttemptCount,
+		LastStatusCode: row.LastStatusCode,
+		LastError:      row.LastError,
+		CreatedAt:      row.CreatedAt,
+		UpdatedAt:      row.UpdatedAt,
+	}
+	if row.Status == webhookDeliveryStatusPending {
+		nextAttemptAt := row.NextAttemptAt
+		delivery.NextAttemptAt = &nextAttemptAt
+	}
+	return delivery
+}
+
+func toWebhookPlaylistData(playlist *PlaylistRow) WebhookPlaylistData {
+	return WebhookPlaylistData{
+		PlaylistULID: playlist.ULID,
+		Name:         playlist.Name,
+		IsPublic:     playlist.IsPublic,
+		IsUnlisted:   playlist.IsUnlisted,
+		UpdatedAt:    playlist.UpdatedAt,
+	}
+}
+
+func getWebhookByULID(ctx context.Context, db connOrTx, webhookULID string) (*WebhookRow, error) {
+	var row WebhookRow
+	if err := db.GetContext(ctx, &row, "SELECT * FROM webhook WHERE `ulid` = ?", webhookULID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error Get webhook by ulid=%s: %w", webhookULID, err)
+	}
+	return &row, nil
+}
+
+func getWebhooksByUserAccount(ctx context.Context, db connOrTx, userAccount string) ([]WebhookRow, error) {
+	var rows []WebhookRow
+	if err := db.SelectContext(
+		ctx,
+		&rows,
+		"SELECT * FROM webhook WHERE `user_account` = ? ORDER BY `created_at`, `id`",
+		userAccount,
+	); err != nil {
+		return nil, fmt.Errorf("error Select webhook by user_account=%s: %w", userAccount, err)
+	}
+	return rows, nil
+}
+
+func insertWebhookDelivery(ctx context.Context, db connOrTx, webhook *WebhookRow, event string, data interface{}, createdAt time.Time) error {
+	deliveryULID, err := ulid.New(ulid.Timestamp(createdAt), entropy)
+	if err != nil {
+		return fmt.Errorf("error ulid.New: %w", err)
+	}
+	payload, err := json.Marshal(WebhookEventBody{
+		DeliveryULID: deliveryULID.String(),
+		Event:        event,
+		CreatedAt:    createdAt,
+		Data:         data,
+	})
+	if err != nil {
+		return fmt.Errorf("error json.Marshal webhook payload: %w", err)
+	}
+	if _, err := db.ExecContext(
+		ctx,
+		"INSERT INTO webhook_delivery (`ulid`, `webhook_id`, `event`, `payload`, `status`, `next_attempt_at`, `last_error`, `created_at`, `updated_at`)"+
+			" VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		deliveryULID.String(), webhook.ID, event, string(payload), webhookDeliveryStatusPending, createdAt, "", createdAt, createdAt,
+	); err != nil {
+		return fmt.Errorf("error Insert webhook_delivery by webhook_id=%d, event=%s: %w", webhook.ID, event, err)
+	}
+	return nil
+}
+
+// イベントを購読しているユーザーのwebhookに送信を積む
+func enqueueWebhookEvent(ctx context.Context, db connOrTx, userAccount string, event string, data interface{}) error {
+	webhooks, err := getWebhooksByUserAccount(ctx, db, userAccount)
+	if err != nil {
+		return fmt.Errorf("error getWebhooksByUserAccount: %w", err)
+	}
+	now := time.Now()
+	for _, webhook := range webhooks {
+		subscribed := false
+		for _, e := range strings.Split(webhook.Events, ",") {
+			if e == event {
+				subscribed = true
+				break
+			}
+		}
+		if !subscribed {
+			continue
+		}
+		if err := insertWebhookDelivery(ctx, db, &webhook, event, data, now); err != nil {
+			return fmt.Errorf("error insertWebhookDelivery: %w", err)
+		}
+	}
+	return nil
+}
+
+// プレイリストの更新を通知する 非公開から公開になったときは playlist.published も送る
+func enqueuePlaylistChangedWebhooks(ctx context.Context, db connOrTx, before *PlaylistRow) error {
+	after, err := getPlaylistByID(ctx, db, before.ID)
+	if err != nil {
+		return fmt.Errorf("error getPlaylistByID: %w", err)
+	}
+	if after == nil {
+		return nil
+	}
+	data := toWebhookPlaylistData(after)
+	if err := enqueueWebhookEvent(ctx, db, after.UserAccount, webhookEventPlaylistUpdated, data); err != nil {
+		return err
+	}
+	if !before.IsPublic && after.IsPublic {
+		return enqueueWebhookEvent(ctx, db, after.UserAccount, webhookEventPlaylistPublished, data)
+	}
+	return nil
+}
+
+func enqueuePlaylistFavoritedWebhooks(ctx context.Context, db connOrTx, playlist *PlaylistRow, favoriteUserAccount string) error {
+	favoriteCount, err := getFavoritesCountByPlaylistID(ctx, db, playlist.ID)
+	if err != nil {
+		return fmt.Errorf("error getFavoritesCountByPlaylistID: %w", err)
+	}
+	return enqueueWebhookEvent(ctx, db, playlist.UserAccount, webhookEventPlaylistFavorited, WebhookFavoriteData{
+		WebhookPlaylistData: toWebhookPlaylistData(playlist),
+		FavoriteUserAccount: favoriteUserAccount,
+		FavoriteCount:       favoriteCount,
+	})
+}
+
+type webhookDeliveryTask struct {
+	WebhookDeliveryRow
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+// 送信待ちのものを送る
+func dispatchWebhookDeliveries(ctx context.Context) error {
+	now := time.Now()
+	var tasks []webhookDeliveryTask
+	if err := db.SelectContext(
+		ctx,
+		&tasks,
+		"SELECT webhook_delivery.*, webhook.url, webhook.secret FROM webhook_delivery"+
+			" JOIN webhook ON webhook.id = webhook_delivery.webhook_id"+
+			" WHERE webhook_delivery.status = ? AND webhook_delivery.next_attempt_at <= ?"+
+			" ORDER BY webhook_delivery.next_attempt_at, webhook_delivery.id LIMIT ?",
+		webhookDeliveryStatusPending, now, webhookDispatchBatchSize,
+	); err != nil {
+		return fmt.Errorf("error Select webhook_delivery by status=%s: %w", webhookDeliveryStatusPending, err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(tasks))
+	for i := range tasks {
+		task := &tasks[i]
+		// 他のプロセスや前回の送信と重ならないよう、次の送信日時を先に延ばせたものだけ送る
+		res, err := db.ExecContext(
+			ctx,
+			"UPDATE webhook_delivery SET `next_attempt_at` = ? WHERE `id` = ? AND `status` = ? AND `next_attempt_at` = ?",
+			now.Add(webhookLeaseDuration), task.ID, webhookDeliveryStatusPending, task.NextAttemptAt,
+		)
+		if err != nil {
+			return fmt.Errorf("error Update webhook_delivery by id=%d: %w", task.ID, err)
+		}
+		if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := deliverWebhook(ctx, task); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	// 送信結果を記録できなかったものがあれば、最初のエラーを返す
+	if err, ok := <-errs; ok {
+		return err
+	}
+	return nil
+}
+
+func deliverWebhook(ctx context.Context, task *webhookDeliveryTask) error {
+	statusCode, sendErr := sendWebhook(ctx, task)
+	attemptCount := task.AttemptCount + 1
+	now := time.Now()
+	status := webhookDeliveryStatusSucceeded
+	nextAttemptAt := now
+	lastError := ""
+	if sendErr != nil {
+		lastError = sendErr.Error()
+		if maxWebhookErrorLength < len(lastError) {
+			lastError = lastError[:maxWebhookErrorLength]
+		}
+		if attemptCount < webhookMaxAttempts {
+			status = webhookDeliveryStatusPending
+			nextAttemptAt = now.Add(webhookBackoff(attemptCount))
+		} else {
+			status = webhookDeliveryStatusFailed
+		}
+	}
+	if _, err := db.ExecContext(
+		ctx,
+		"UPDATE webhook_delivery SET `status` = ?, `attempt_count` = ?, `next_attempt_at` = ?, `last_status_code` = ?, `last_error` = ?, `updated_at` = ? WHERE `id` = ?",
+		status, attemptCount, nextAttemptAt, statusCode, lastError, now, task.ID,
+	); err != nil {
+		return fmt.Errorf("error Update webhook_delivery by id=%d: %w", task.ID, err)
+	}
+	return nil
+}
+
+// 2xxが返れば成功とする
+func sendWebhook(ctx context.Context, task *webhookDeliveryTask) (int, error) {
+	payload := []byte(task.Payload)
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, task.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("error http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "listen80-webhook")
+	req.Header.Set("X-Listen80-Event", task.Event)
+	req.Header.Set("X-Listen80-Delivery", task.ULID)
+	req.Header.Set("X-Listen80-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Listen80-Signature", signWebhookPayload(task.Secret, timestamp, payload))
+
+	res, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// レスポンスの本文は記録しない 登録したユーザーに送り先の中身を読ませないため
+	io.Copy(io.Discard, io.LimitReader(res.Body, maxWebhookResponseDrainBytes))
+	if res.StatusCode < 200 || 300 <= res.StatusCode {
+		return res.StatusCode, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// main から goroutine で起動する
+func runWebhookDispatcher(logger echo.Logger) {
+	ticker := time.NewTicker(webhookDispatchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := dispatchWebhookDeliveries(context.Background()); err != nil {
+			logger.Errorf("error dispatchWebhookDeliveries: %s", err)
+		}
+	}
+}
+
+func getOwnWebhookFromParam(c echo.Context, conn connOrTx, userAccount string) (*WebhookRow, error) {
+	webhookULID := c.Param("webhookUlid")
+	if webhookULID == "" {
+		return nil, errorResponse(c, 404, "bad webhook ulid")
+	}
+	if matched, _ := regexp.MatchString("[^a-zA-Z0-9]", webhookULID); matched {
+		return nil, errorResponse(c, 404, "bad webhook ulid")
+	}
+	webhook, err := getWebhookByULID(c.Request().Context(), conn, webhookULID)
+	if err != nil {
+		c.Logger().Errorf("error getWebhookByULID: %s", err)
+		return nil, errorResponse(c, 500, "internal server error")
+	}
+	// 他のユーザーのwebhookは存在しないものとして扱う
+	if webhook == nil || webhook.UserAccount != userAccount {
+		return nil, errorResponse(c, 404, "webhook not found")
+	}
+	return webhook, nil
+}
+
+// GET /api/webhooks
+
+func apiWebhooksHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	rows, err := getWebhooksByUserAccount(ctx, conn, user.Account)
+	if err != nil {
+		c.Logger().Errorf("error getWebhooksByUserAccount: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	webhooks := make([]Webhook, 0, len(rows))
+	for _, row := range rows {
+		webhooks = append(webhooks, toWebhook(&row))
+	}
+
+	body := GetWebhooksResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Webhooks: webhooks,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/webhook/add
+
+func apiWebhookAddHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	var req AddWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Errorf("error Bind request to AddWebhookRequest: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+	events, err := normalizeWebhookEvents(req.Events)
+	if err != nil {
+		return errorResponse(c, 400, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	webhooks, err := getWebhooksByUserAccount(ctx, conn, user.Account)
+	if err != nil {
+		c.Logger().Errorf("error getWebhooksByUserAccount: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if maxWebhooksPerUser <= len(webhooks) {
+		return errorResponse(c, 400, fmt.Sprintf("too many webhooks: max %d", maxWebhooksPerUser))
+	}
+
+	createdAt := time.Now()
+	webhookULID, err := ulid.New(ulid.Timestamp(createdAt), entropy)
+	if err != nil {
+		c.Logger().Errorf("error ulid.New: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		c.Logger().Errorf("error generateWebhookSecret: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	row := WebhookRow{
+		ULID:        webhookULID.String(),
+		UserAccount: user.Account,
+		URL:         req.URL,
+		Secret:      secret,
+		Events:      strings.Join(events, ","),
+		CreatedAt:   createdAt,
+	}
+	if _, err := conn.ExecContext(
+		ctx,
+		"INSERT INTO webhook (`ulid`, `user_account`, `url`, `secret`, `events`, `created_at`) VALUES (?, ?, ?, ?, ?, ?)",
+		row.ULID, row.UserAccount, row.URL, row.Secret, row.Events, row.CreatedAt,
+	); err != nil {
+		c.Logger().Errorf("error Insert webhook by user_account=%s: %s", user.Account, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	// secretは作成したときにしか返さない
+	webhook := toWebhook(&row)
+	webhook.Secret = row.Secret
+	body := WebhookResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Webhook: webhook,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/webhook/:webhookUlid/delete
+
+func apiWebhookDeleteHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	webhook, err := getOwnWebhookFromParam(c, conn, user.Account)
+	if webhook == nil {
+		return err
+	}
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Errorf("error conn.BeginTxx: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhook WHERE `id` = ?", webhook.ID); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Delete webhook by id=%d: %s", webhook.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhook_delivery WHERE `webhook_id` = ?", webhook.ID); err != nil {
+		tx.Rollback()
+		c.Logger().Errorf("error Delete webhook_delivery by webhook_id=%d: %s", webhook.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("error tx.Commit: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := BasicResponse{
+		Result: true,
+		Status: 200,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// POST /api/webhook/:webhookUlid/ping
+
+func apiWebhookPingHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	webhook, err := getOwnWebhookFromParam(c, conn, user.Account)
+	if webhook == nil {
+		return err
+	}
+	if err := insertWebhookDelivery(ctx, conn, webhook, webhookEventPing, toWebhook(webhook), time.Now()); err != nil {
+		c.Logger().Errorf("error insertWebhookDelivery: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	body := BasicResponse{
+		Result: true,
+		Status: 200,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
+
+// GET /api/webhook/:webhookUlid/deliveries
+
+func apiWebhookDeliveriesHandler(c echo.Context) error {
+	user, ok, err := validateSession(c)
+	if err != nil {
+		c.Logger().Errorf("error validateSession: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	if !ok || user == nil {
+		return errorResponse(c, 401, "login required")
+	}
+	page, ok := getPageFromParam(c)
+	if !ok {
+		return errorResponse(c, 400, "invalid page")
+	}
+
+	ctx := c.Request().Context()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		c.Logger().Errorf("error db.Conn: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	defer conn.Close()
+
+	webhook, err := getOwnWebhookFromParam(c, conn, user.Account)
+	if webhook == nil {
+		return err
+	}
+
+	// 新しい順 次のページがあるか知るため1件多く取る
+	var rows []WebhookDeliveryRow
+	if err := conn.SelectContext(
+		ctx,
+		&rows,
+		"SELECT * FROM webhook_delivery WHERE `webhook_id` = ? ORDER BY `created_at` DESC, `id` DESC LIMIT ? OFFSET ?",
+		webhook.ID, webhookDeliveriesPerPage+1, (page-1)*webhookDeliveriesPerPage,
+	); err != nil {
+		c.Logger().Errorf("error Select webhook_delivery by webhook_id=%d: %s", webhook.ID, err)
+		return errorResponse(c, 500, "internal server error")
+	}
+	hasNext := len(rows) > webhookDeliveriesPerPage
+	if hasNext {
+		rows = rows[:webhookDeliveriesPerPage]
+	}
+	deliveries := make([]WebhookDelivery, 0, len(rows))
+	for _, row := range rows {
+		deliveries = append(deliveries, toWebhookDelivery(&row))
+	}
+
+	body := GetWebhookDeliveriesResponse{
+		BasicResponse: BasicResponse{
+			Result: true,
+			Status: 200,
+		},
+		Deliveries: deliveries,
+		Page:       page,
+		HasNext:    hasNext,
+	}
+	if err := c.JSON(http.StatusOK, body); err != nil {
+		c.Logger().Errorf("error returns JSON: %s", err)
+		return errorResponse(c, 500, "internal server error")
+	}
+
+	return nil
+}
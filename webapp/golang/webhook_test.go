@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSignWebhookPayload(t *testing.T) {
+	secret := "whsec_test"
+	payload := []byte(`{"event":"ping"}`)
+	var timestamp int64 = 1652400000
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("1652400000." + string(payload)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	got := signWebhookPayload(secret, timestamp, payload)
+	if got != want {
+		t.Fatalf("signWebhookPayload = %s, want %s", got, want)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		payload   []byte
+	}{
+		{name: "other secret", secret: "whsec_other", timestamp: timestamp, payload: payload},
+		{name: "other timestamp", secret: secret, timestamp: timestamp + 1, payload: payload},
+		{name: "other payload", secret: secret, timestamp: timestamp, payload: []byte(`{"event":"pong"}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if signWebhookPayload(tt.secret, tt.timestamp, tt.payload) == got {
+				t.Errorf("signature does not change")
+			}
+		})
+	}
+}
+
+func TestIsForbiddenWebhookIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "127.0.0.1", want: true},
+		{ip: "::1", want: true},
+		{ip: "10.0.0.1", want: true},
+		{ip: "172.16.0.1", want: true},
+		{ip: "192.168.1.1", want: true},
+		{ip: "169.254.169.254", want: true},
+		{ip: "fe80::1", want: true},
+		{ip: "fc00::1", want: true},
+		{ip: "224.0.0.1", want: true},
+		{ip: "0.0.0.0", want: true},
+		{ip: "::", want: true},
+		{ip: "::ffff:127.0.0.1", want: true},
+		{ip: "93.184.216.34", want: false},
+		{ip: "2606:2800:220:1:248:1893:25c8:1946", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := isForbiddenWebhookIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("isForbiddenWebhookIP(%s) = %t, want %t", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		url          string
+		wantErr      bool
+		wantAllowErr bool
+	}{
+		{name: "https", url: "https://example.com/hook"},
+		{name: "http with port", url: "http://example.com:8080/hook"},
+		{name: "public ip", url: "http://93.184.216.34/hook"},
+		{name: "empty", url: "", wantErr: true, wantAllowErr: true},
+		{name: "too long", url: "https://example.com/" + strings.Repeat("a", maxWebhookURLLength), wantErr: true, wantAllowErr: true},
+		{name: "ftp", url: "ftp://example.com/hook", wantErr: true, wantAllowErr: true},
+		{name: "no host", url: "https:///hook", wantErr: true, wantAllowErr: true},
+		{name: "localhost", url: "http://localhost/hook", wantErr: true},
+		{name: "localhost upper case", url: "http://LOCALHOST:3000/hook", wantErr: true},
+		{name: "localhost subdomain", url: "http://api.localhost/hook", wantErr: true},
+		{name: "loopback", url: "http://127.0.0.1/hook", wantErr: true},
+		{name: "loopback v6", url: "http://[::1]:8080/hook", wantErr: true},
+		{name: "private", url: "http://192.168.0.10/hook", wantErr: true},
+		{name: "metadata", url: "http://169.254.169.254/latest/meta-data/", wantErr: true},
+	}
+	defer func(allow bool) { webhookAllowPrivateNetwork = allow }(webhookAllowPrivateNetwork)
+	for _, allow := range []bool{false, true} {
+		webhookAllowPrivateNetwork = allow
+		for _, tt := range tests {
+			wantErr := tt.wantErr
+			if allow {
+				wantErr = tt.wantAllowErr
+			}
+			err := validateWebhookURL(tt.url)
+			if wantErr && err == nil {
+				t.Errorf("allow=%t %s: validateWebhookURL(%q) returns no error", allow, tt.name, tt.url)
+			}
+			if !wantErr && err != nil {
+				t.Errorf("allow=%t %s: validateWebhookURL(%q) returns error: %s", allow, tt.name, tt.url, err)
+			}
+		}
+	}
+}
+
+func TestControlWebhookDial(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{address: "93.184.216.34:443"},
+		{address: "[2606:2800:220:1:248:1893:25c8:1946]:443"},
+		{address: "127.0.0.1:80", wantErr: true},
+		{address: "10.1.2.3:80", wantErr: true},
+		{address: "[::1]:80", wantErr: true},
+		{address: "169.254.169.254:80", wantErr: true},
+	}
+	defer func(allow bool) { webhookAllowPrivateNetwork = allow }(webhookAllowPrivateNetwork)
+	webhookAllowPrivateNetwork = false
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := controlWebhookDial("tcp", tt.address, nil)
+			if tt.wantErr && !errors.Is(err, errWebhookForbiddenAddress) {
+				t.Errorf("controlWebhookDial(%s) = %v, want %v", tt.address, err, errWebhookForbiddenAddress)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("controlWebhookDial(%s) returns error: %s", tt.address, err)
+			}
+		})
+	}
+
+	webhookAllowPrivateNetwork = true
+	if err := controlWebhookDial("tcp", "127.0.0.1:80", nil); err != nil {
+		t.Errorf("controlWebhookDial with allowing private network returns error: %s", err)
+	}
+}
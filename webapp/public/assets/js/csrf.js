@@ -0,0 +1,27 @@
+// Go実装のCSRF対策
+// ログイン時にサーバーがcookieで渡すtokenを、POSTなどのリクエストのヘッダーに付けて送る
+(() => {
+  const cookieName = 'listen80_csrf_golang'
+  const headerName = 'X-CSRF-Token'
+  const originalFetch = window.fetch
+
+  const readToken = () => {
+    const found = document.cookie.split('; ').find((c) => c.startsWith(cookieName + '='))
+    return found ? decodeURIComponent(found.slice(cookieName.length + 1)) : ''
+  }
+
+  window.fetch = (input, init = {}) => {
+    const method = (init.method || 'GET').toUpperCase()
+    // 同じサイトへのリクエストにだけ付ける
+    if (method === 'GET' || method === 'HEAD' || typeof input !== 'string' || !input.startsWith('/') || input.startsWith('//')) {
+      return originalFetch(input, init)
+    }
+    const token = readToken()
+    if (token === '') {
+      return originalFetch(input, init)
+    }
+    const headers = new Headers(init.headers || {})
+    headers.set(headerName, token)
+    return originalFetch(input, { ...init, headers })
+  }
+})()